@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_ALARM_CHECK_INTERVAL = 30
+
+// AlarmWatcher polls the nodes of a RabbitMQ connection for memory and disk
+// alarms, pausing the jobs marked pause_on_alarm (and the jobs of the groups
+// listed in alarm_pause_groups) while an alarm is raised. Manual pauses are
+// kept apart: clearing the alarm doesn't unpause a job paused by hand.
+type AlarmWatcher struct {
+	connectionConfig ConnectionConfig
+	client           *Client
+	jobs             []*Job
+	alarm            string
+	lastError        string
+	mu               sync.Mutex // protects jobs and alarm, changed by add-job and remove-job
+}
+
+// alarmWatchers are the watchers started by startAlarmWatchers
+var alarmWatchers []*AlarmWatcher
+
+func createAlarmWatcher(connectionConfig ConnectionConfig, jobs []*Job) *AlarmWatcher {
+	client := createClient(connectionConfig.Endpoint, connectionConfig.Username, connectionConfig.Password)
+	client.cluster = connectionRegistry.register(connectionConfig)
+	if tlsConfig, _ := connectionConfig.getTLSConfig(); tlsConfig != nil {
+		client.Transport = createHTTPTransport(tlsConfig)
+	}
+	watcher := AlarmWatcher{
+		connectionConfig: connectionConfig,
+		client:           client,
+	}
+	for _, job := range jobs {
+		if watcher.isTarget(job) {
+			watcher.jobs = append(watcher.jobs, job)
+		}
+	}
+
+	return &watcher
+}
+
+func (watcher *AlarmWatcher) isTarget(job *Job) bool {
+	if job.PauseOnAlarm && job.ConnectionName == watcher.connectionConfig.Name {
+		return true
+	}
+	for _, group := range job.GetGroups() {
+		for _, alarmGroup := range watcher.connectionConfig.AlarmPauseGroups {
+			if group == alarmGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (watcher *AlarmWatcher) run(ctx context.Context) {
+	interval := watcher.connectionConfig.AlarmCheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_ALARM_CHECK_INTERVAL
+	}
+	for {
+		watcher.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+// check reads the alarms of the nodes and applies them to the jobs. When
+// the nodes can't be read the previous state is kept, so that a management
+// API outage doesn't unpause the jobs in the middle of an alarm.
+func (watcher *AlarmWatcher) check() {
+	nodes, err := watcher.client.getNodes()
+	if err != nil {
+		if err.Error() != watcher.lastError {
+			log.Printf("Can't check alarms of connection %q: %v\n", watcher.connectionConfig.Name, err)
+		}
+		watcher.lastError = err.Error()
+		return
+	}
+	watcher.lastError = ""
+	watcher.apply(describeAlarms(nodes))
+}
+
+func (watcher *AlarmWatcher) apply(alarm string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	if alarm == watcher.alarm {
+		return
+	}
+	name := watcher.connectionConfig.Name
+	if alarm != "" {
+		log.Printf("Connection %q raised %v: pausing %d jobs\n", name, alarm, len(watcher.jobs))
+	} else {
+		log.Printf("Alarms of connection %q cleared: unpausing %d jobs\n", name, len(watcher.jobs))
+	}
+	watcher.alarm = alarm
+	for _, job := range watcher.jobs {
+		job.setAlarmPause(name, alarm)
+	}
+}
+
+// addJob watches for a job added at runtime, pausing it right away if an
+// alarm is raised
+func (watcher *AlarmWatcher) addJob(job *Job) {
+	if !watcher.isTarget(job) {
+		return
+	}
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	watcher.jobs = append(watcher.jobs, job)
+	if watcher.alarm != "" {
+		job.setAlarmPause(watcher.connectionConfig.Name, watcher.alarm)
+	}
+}
+
+func (watcher *AlarmWatcher) removeJob(job *Job) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	for i, other := range watcher.jobs {
+		if other == job {
+			watcher.jobs = append(watcher.jobs[:i:i], watcher.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// describeAlarms returns the alarms raised by the nodes (e.g. "mem_alarm on
+// rabbit@node1"), empty when there are none
+func describeAlarms(nodes []NodeInfo) string {
+	var alarms []string
+	for _, node := range nodes {
+		if node.MemAlarm {
+			alarms = append(alarms, "mem_alarm on "+node.Name)
+		}
+		if node.DiskFreeAlarm {
+			alarms = append(alarms, "disk_free_alarm on "+node.Name)
+		}
+	}
+	sort.Strings(alarms)
+	return strings.Join(alarms, ", ")
+}
+
+// startAlarmWatchers starts a watcher for each connection with watch_alarms
+func startAlarmWatchers(ctx context.Context, connectionConfigs []ConnectionConfig, jobs []*Job) {
+	for _, connectionConfig := range connectionConfigs {
+		if !connectionConfig.WatchAlarms {
+			continue
+		}
+		watcher := createAlarmWatcher(connectionConfig, jobs)
+		alarmWatchers = append(alarmWatchers, watcher)
+		log.Printf("Watching alarms of connection %q for %d jobs\n", connectionConfig.Name, len(watcher.jobs))
+		go watcher.run(ctx)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newFakeNodesServer answers /api/nodes with the alarms set by the test
+func newFakeNodesServer(t *testing.T) (*httptest.Server, func(nodes string)) {
+	t.Helper()
+	var mu sync.Mutex
+	body := `[{"name":"rabbit@node1","mem_alarm":false,"disk_free_alarm":false}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/nodes" {
+			t.Errorf("Expected nodes request, got %v", r.URL.Path)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, func(nodes string) {
+		mu.Lock()
+		defer mu.Unlock()
+		body = nodes
+	}
+}
+
+func TestDescribeAlarms(t *testing.T) {
+	if got := describeAlarms([]NodeInfo{{Name: "rabbit@node1"}}); got != "" {
+		t.Errorf("Expected no alarm, got %q", got)
+	}
+	got := describeAlarms([]NodeInfo{
+		{Name: "rabbit@node2", DiskFreeAlarm: true},
+		{Name: "rabbit@node1", MemAlarm: true},
+	})
+	if got != "disk_free_alarm on rabbit@node2, mem_alarm on rabbit@node1" {
+		t.Errorf("Unexpected alarms %q", got)
+	}
+}
+
+func TestAlarmWatcher_Targets(t *testing.T) {
+	marked := createTestJob("marked", nil)
+	marked.ConnectionName = "main"
+	marked.PauseOnAlarm = true
+	otherConnection := createTestJob("other_connection", nil)
+	otherConnection.ConnectionName = "backup"
+	otherConnection.PauseOnAlarm = true
+	publisher := createTestJob("publisher", []string{"publishers"})
+	publisher.ConnectionName = "backup"
+	unmarked := createTestJob("unmarked", nil)
+	unmarked.ConnectionName = "main"
+
+	watcher := createAlarmWatcher(ConnectionConfig{Name: "main", AlarmPauseGroups: []string{"publishers"}},
+		[]*Job{marked, otherConnection, publisher, unmarked})
+
+	if len(watcher.jobs) != 2 || watcher.jobs[0] != marked || watcher.jobs[1] != publisher {
+		t.Errorf("Expected marked and publisher jobs, got %v", watcher.jobs)
+	}
+}
+
+func TestAlarmWatcher_PausesAndUnpauses(t *testing.T) {
+	server, setNodes := newFakeNodesServer(t)
+	job := createTestJob("consumer", nil)
+	job.ConnectionName = "alarm_test"
+	job.PauseOnAlarm = true
+	watcher := createAlarmWatcher(ConnectionConfig{Name: "alarm_test", Endpoint: server.URL, WatchAlarms: true}, []*Job{job})
+
+	watcher.check()
+	if job.isAlarmPaused() {
+		t.Fatal("Expected no pause without alarms")
+	}
+
+	setNodes(`[{"name":"rabbit@node1","mem_alarm":true,"disk_free_alarm":false}]`)
+	watcher.check()
+	if !job.isAlarmPaused() {
+		t.Fatal("Expected the job to be paused by the alarm")
+	}
+	job.SetStatus(STATUS_PAUSED)
+	if got := job.getStatusName(); got != "PAUSED (ALARM)" {
+		t.Errorf("Expected alarm-driven pause in status, got %q", got)
+	}
+	if reason := job.getAlarmReason(); !strings.Contains(reason, "mem_alarm on rabbit@node1") {
+		t.Errorf("Expected the alarm in the reason, got %q", reason)
+	}
+
+	// A manual pause is reported as such and survives the alarm clearing
+	job.SetPause(true)
+	if got := job.getStatusName(); got != "PAUSED" {
+		t.Errorf("Expected manual pause in status, got %q", got)
+	}
+	setNodes(`[{"name":"rabbit@node1","mem_alarm":false,"disk_free_alarm":false}]`)
+	watcher.check()
+	if job.isAlarmPaused() {
+		t.Error("Expected the alarm pause to clear")
+	}
+	if !job.GetPause() {
+		t.Error("Expected the manual pause to be kept")
+	}
+}
+
+func TestAlarmWatcher_KeepsStateWhenNodesUnreachable(t *testing.T) {
+	server, setNodes := newFakeNodesServer(t)
+	job := createTestJob("consumer", nil)
+	job.ConnectionName = "alarm_unreachable_test"
+	job.PauseOnAlarm = true
+	watcher := createAlarmWatcher(ConnectionConfig{Name: "alarm_unreachable_test", Endpoint: server.URL}, []*Job{job})
+
+	setNodes(`[{"name":"rabbit@node1","mem_alarm":false,"disk_free_alarm":true}]`)
+	watcher.check()
+	server.Close()
+	watcher.check()
+
+	if !job.isAlarmPaused() {
+		t.Error("Expected the job to stay paused while the alarms can't be read")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type AmqpClient struct {
+	ConnectionConfig ConnectionConfig
+	connection       *amqp.Connection
+	mu               sync.Mutex // protects connection
+}
+
+func createAmqpClient(connectionConfig ConnectionConfig) *AmqpClient {
+	client := AmqpClient{
+		ConnectionConfig: connectionConfig,
+	}
+
+	return &client
+}
+
+// getConnection returns the open connection, dialing the broker again when
+// the previous one was never established or has been closed
+func (client *AmqpClient) getConnection() (*amqp.Connection, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.connection == nil || client.connection.IsClosed() {
+		connection, err := dialAmqp(client.ConnectionConfig)
+		if err != nil {
+			return nil, err
+		}
+		client.connection = connection
+	}
+	return client.connection, nil
+}
+
+func (client *AmqpClient) Close() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.connection != nil {
+		client.connection.Close()
+		client.connection = nil
+	}
+}
+
+// dialAmqp opens an AMQP 0-9-1 connection to the broker behind a RabbitMQ
+// connection, reusing its credentials and virtual host
+func dialAmqp(connectionConfig ConnectionConfig) (*amqp.Connection, error) {
+	if connectionConfig.AmqpEndpoint == "" {
+		return nil, fmt.Errorf("connection %q has no amqp_endpoint", connectionConfig.Name)
+	}
+	if connectionConfig.getType() != CONNECTION_TYPE_RABBITMQ {
+		return nil, errors.New("AMQP is only available on rabbitmq connections")
+	}
+
+	tlsConfig, err := connectionConfig.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dialed again after a disconnection, with the credentials refreshed
+	// from Vault since
+	credentials := connectionRegistry.register(connectionConfig).getCredentials(connectionConfig.getCredentials())
+	vhost := connectionConfig.Vhost
+	if vhost == "" {
+		vhost = "/"
+	}
+	config := amqp.Config{
+		SASL: []amqp.Authentication{
+			&amqp.PlainAuth{Username: credentials.Username, Password: credentials.Password},
+		},
+		Vhost:      vhost,
+		Heartbeat:  10 * time.Second,
+		Properties: amqp.Table{"connection_name": "gormq-supervisor " + connectionConfig.Name},
+		Dial:       amqp.DefaultDial(10 * time.Second),
+		// Only used with amqps:// endpoints
+		TLSClientConfig: tlsConfig,
+	}
+
+	return amqp.DialConfig(connectionConfig.AmqpEndpoint, config)
+}
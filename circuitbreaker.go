@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const BREAKER_CLOSED = "CLOSED"
+const BREAKER_OPEN = "OPEN"
+const BREAKER_HALF_OPEN = "HALF_OPEN"
+
+const DEFAULT_BREAKER_THRESHOLD = 5
+const DEFAULT_BREAKER_BACKOFF = 5 * time.Second
+const DEFAULT_BREAKER_MAX_BACKOFF = 5 * time.Minute
+
+// CircuitBreaker stops the jobs of a connection from polling a broker that
+// keeps failing. It opens after threshold consecutive failures; once the
+// backoff has elapsed a single poll is let through as a probe (half-open),
+// closing the breaker when it succeeds or doubling the backoff when it fails.
+type CircuitBreaker struct {
+	Name       string
+	State      string
+	Failures   int
+	LastError  string
+	threshold  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	backoff    time.Duration
+	retryAt    time.Time
+	mu         sync.Mutex // protects every field
+}
+
+func createCircuitBreaker(connectionConfig ConnectionConfig) *CircuitBreaker {
+	breaker := CircuitBreaker{
+		Name:       connectionConfig.Name,
+		State:      BREAKER_CLOSED,
+		threshold:  DEFAULT_BREAKER_THRESHOLD,
+		minBackoff: DEFAULT_BREAKER_BACKOFF,
+		maxBackoff: DEFAULT_BREAKER_MAX_BACKOFF,
+	}
+	if connectionConfig.BreakerThreshold > 0 {
+		breaker.threshold = connectionConfig.BreakerThreshold
+	}
+	if connectionConfig.BreakerBackoff > 0 {
+		breaker.minBackoff = time.Duration(connectionConfig.BreakerBackoff) * time.Second
+	}
+	if connectionConfig.BreakerMaxBackoff > 0 {
+		breaker.maxBackoff = time.Duration(connectionConfig.BreakerMaxBackoff) * time.Second
+	}
+	if breaker.maxBackoff < breaker.minBackoff {
+		breaker.maxBackoff = breaker.minBackoff
+	}
+	return &breaker
+}
+
+// allow tells whether a poll may reach the broker. When the backoff of an
+// open breaker has elapsed, the first caller gets through as the probe and
+// the others keep being refused until the probe is recorded.
+func (breaker *CircuitBreaker) allow() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.State {
+	case BREAKER_OPEN:
+		if time.Now().Before(breaker.retryAt) {
+			return false
+		}
+		breaker.State = BREAKER_HALF_OPEN
+		return true
+	case BREAKER_HALF_OPEN:
+		return false
+	default:
+		return true
+	}
+}
+
+func (breaker *CircuitBreaker) recordSuccess() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.State != BREAKER_CLOSED {
+		log.Printf("Connection %q recovered after %d failures\n", breaker.Name, breaker.Failures)
+	}
+	breaker.State = BREAKER_CLOSED
+	breaker.Failures = 0
+	breaker.LastError = ""
+	breaker.backoff = 0
+}
+
+// recordFailure counts a failed poll and returns true when it is the first
+// one since the broker was last reachable, so that callers log it once
+func (breaker *CircuitBreaker) recordFailure(err error) bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.Failures++
+	breaker.LastError = err.Error()
+	switch {
+	case breaker.State == BREAKER_HALF_OPEN:
+		breaker.backoff *= 2
+		if breaker.backoff > breaker.maxBackoff {
+			breaker.backoff = breaker.maxBackoff
+		}
+		breaker.open()
+	case breaker.State == BREAKER_CLOSED && breaker.Failures >= breaker.threshold:
+		breaker.backoff = breaker.minBackoff
+		breaker.open()
+		log.Printf("Connection %q is DEGRADED after %d failures, polling suspended for %v: %v\n", breaker.Name, breaker.Failures, breaker.backoff, err)
+	}
+	return breaker.Failures == 1
+}
+
+func (breaker *CircuitBreaker) open() {
+	breaker.State = BREAKER_OPEN
+	breaker.retryAt = time.Now().Add(breaker.backoff)
+}
+
+func (breaker *CircuitBreaker) getState() string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.State
+}
+
+// isDegraded is true while the breaker keeps jobs from polling the broker
+func (breaker *CircuitBreaker) isDegraded() bool {
+	return breaker.getState() != BREAKER_CLOSED
+}
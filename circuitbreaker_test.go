@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreateCircuitBreaker_Defaults(t *testing.T) {
+	breaker := createCircuitBreaker(ConnectionConfig{Name: "main"})
+
+	if breaker.threshold != DEFAULT_BREAKER_THRESHOLD {
+		t.Errorf("Expected default threshold, got %d", breaker.threshold)
+	}
+	if breaker.minBackoff != DEFAULT_BREAKER_BACKOFF || breaker.maxBackoff != DEFAULT_BREAKER_MAX_BACKOFF {
+		t.Errorf("Expected default backoff, got %v-%v", breaker.minBackoff, breaker.maxBackoff)
+	}
+
+	breaker = createCircuitBreaker(ConnectionConfig{Name: "main", BreakerThreshold: 2, BreakerBackoff: 30, BreakerMaxBackoff: 10})
+	if breaker.threshold != 2 || breaker.minBackoff != 30*time.Second || breaker.maxBackoff != 30*time.Second {
+		t.Errorf("Unexpected settings %d %v-%v", breaker.threshold, breaker.minBackoff, breaker.maxBackoff)
+	}
+}
+
+func TestCircuitBreaker_OpensAfterThreshold(t *testing.T) {
+	breaker := createCircuitBreaker(ConnectionConfig{Name: "main", BreakerThreshold: 3})
+	err := errors.New("connection refused")
+
+	if !breaker.recordFailure(err) {
+		t.Error("Expected the first failure to be reported as such")
+	}
+	if breaker.recordFailure(err) {
+		t.Error("Expected only the first failure to be reported")
+	}
+	if !breaker.allow() || breaker.isDegraded() {
+		t.Error("Expected the breaker to stay closed below the threshold")
+	}
+	breaker.recordFailure(err)
+	if breaker.allow() || !breaker.isDegraded() {
+		t.Error("Expected the breaker to open at the threshold")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	breaker := createCircuitBreaker(ConnectionConfig{Name: "main", BreakerThreshold: 1, BreakerBackoff: 10, BreakerMaxBackoff: 25})
+	err := errors.New("connection refused")
+	breaker.recordFailure(err)
+
+	// Backoff elapsed: a single probe goes through
+	breaker.retryAt = time.Now().Add(-time.Second)
+	if !breaker.allow() {
+		t.Fatal("Expected the probe to be allowed")
+	}
+	if breaker.allow() {
+		t.Error("Expected a single probe while half-open")
+	}
+
+	// A failed probe doubles the backoff, up to the maximum
+	breaker.recordFailure(err)
+	if breaker.getState() != BREAKER_OPEN || breaker.backoff != 20*time.Second {
+		t.Errorf("Expected open breaker with 20s backoff, got %v %v", breaker.getState(), breaker.backoff)
+	}
+	breaker.retryAt = time.Now().Add(-time.Second)
+	breaker.allow()
+	breaker.recordFailure(err)
+	if breaker.backoff != 25*time.Second {
+		t.Errorf("Expected backoff capped at 25s, got %v", breaker.backoff)
+	}
+
+	// A successful probe closes it
+	breaker.retryAt = time.Now().Add(-time.Second)
+	breaker.allow()
+	breaker.recordSuccess()
+	if breaker.getState() != BREAKER_CLOSED || breaker.Failures != 0 || breaker.backoff != 0 {
+		t.Errorf("Expected closed breaker, got %v with %d failures", breaker.getState(), breaker.Failures)
+	}
+	if !breaker.allow() {
+		t.Error("Expected polls to be allowed again")
+	}
+}
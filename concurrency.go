@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SlotScheduler limits how many commands run at once, globally and per
+// group. Jobs waiting for a slot are admitted by priority (highest first,
+// then in arrival order). A waiting job that is only blocked by the limit of
+// one of its groups doesn't hold back the jobs of other groups.
+type SlotScheduler struct {
+	maxConcurrent int
+	groupLimits   map[string]int
+	running       int
+	runningGroups map[string]int
+	waiters       []*slotWaiter
+	sequence      int
+	mu            sync.Mutex // protects every field
+}
+
+// Slot is held by a job while its command runs
+type Slot struct {
+	groups []string
+}
+
+type slotWaiter struct {
+	slot     *Slot
+	priority int
+	sequence int
+	admitted chan struct{}
+}
+
+// slots is replaced by worker with the limits of the configuration
+var slots = createSlotScheduler(0, nil)
+
+// createSlotScheduler returns a scheduler allowing maxConcurrent commands
+// and groupLimits commands per group, zero meaning no limit
+func createSlotScheduler(maxConcurrent int, groupLimits map[string]int) *SlotScheduler {
+	return &SlotScheduler{
+		maxConcurrent: maxConcurrent,
+		groupLimits:   groupLimits,
+		runningGroups: make(map[string]int),
+	}
+}
+
+// acquire blocks until a command with the given groups and priority may be
+// launched, or until ctx is done. The slot must be released once the command
+// ends.
+func (scheduler *SlotScheduler) acquire(ctx context.Context, groups []string, priority int) (*Slot, error) {
+	scheduler.mu.Lock()
+	scheduler.sequence++
+	waiter := &slotWaiter{
+		slot:     &Slot{groups: groups},
+		priority: priority,
+		sequence: scheduler.sequence,
+		admitted: make(chan struct{}),
+	}
+	scheduler.waiters = append(scheduler.waiters, waiter)
+	scheduler.dispatchLocked()
+	scheduler.mu.Unlock()
+
+	select {
+	case <-waiter.admitted:
+		return waiter.slot, nil
+	case <-ctx.Done():
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	select {
+	case <-waiter.admitted:
+		// Admitted while giving up: hand the slot over
+		scheduler.releaseLocked(waiter.slot)
+	default:
+		scheduler.removeLocked(waiter)
+	}
+	return nil, ctx.Err()
+}
+
+func (scheduler *SlotScheduler) release(slot *Slot) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	scheduler.releaseLocked(slot)
+}
+
+func (scheduler *SlotScheduler) releaseLocked(slot *Slot) {
+	scheduler.running--
+	for _, group := range slot.groups {
+		scheduler.runningGroups[group]--
+	}
+	scheduler.dispatchLocked()
+}
+
+// dispatchLocked admits the waiting jobs that fit, by priority
+func (scheduler *SlotScheduler) dispatchLocked() {
+	sort.SliceStable(scheduler.waiters, func(i, j int) bool {
+		if scheduler.waiters[i].priority != scheduler.waiters[j].priority {
+			return scheduler.waiters[i].priority > scheduler.waiters[j].priority
+		}
+		return scheduler.waiters[i].sequence < scheduler.waiters[j].sequence
+	})
+	remaining := scheduler.waiters[:0]
+	for _, waiter := range scheduler.waiters {
+		if !scheduler.fitsLocked(waiter.slot.groups) {
+			remaining = append(remaining, waiter)
+			continue
+		}
+		scheduler.running++
+		for _, group := range waiter.slot.groups {
+			scheduler.runningGroups[group]++
+		}
+		close(waiter.admitted)
+	}
+	scheduler.waiters = remaining
+}
+
+func (scheduler *SlotScheduler) fitsLocked(groups []string) bool {
+	if scheduler.maxConcurrent > 0 && scheduler.running >= scheduler.maxConcurrent {
+		return false
+	}
+	for _, group := range groups {
+		if limit := scheduler.groupLimits[group]; limit > 0 && scheduler.runningGroups[group] >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+func (scheduler *SlotScheduler) removeLocked(waiter *slotWaiter) {
+	for i, candidate := range scheduler.waiters {
+		if candidate == waiter {
+			scheduler.waiters = append(scheduler.waiters[:i], scheduler.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// returnStatus summarizes the use of the slots, empty without limits
+func (scheduler *SlotScheduler) returnStatus() string {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if scheduler.maxConcurrent == 0 && len(scheduler.groupLimits) == 0 {
+		return ""
+	}
+	limit := "unlimited"
+	if scheduler.maxConcurrent > 0 {
+		limit = fmt.Sprint(scheduler.maxConcurrent)
+	}
+	status := fmt.Sprintf("Running: %v/%v, queued for a slot: %v\n", scheduler.running, limit, len(scheduler.waiters))
+	groups := make([]string, 0, len(scheduler.groupLimits))
+	for group := range scheduler.groupLimits {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		status += fmt.Sprintf("Group %v: %v/%v\n", group, scheduler.runningGroups[group], scheduler.groupLimits[group])
+	}
+	return status
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acquireAsync waits for a slot in the background, sending it once admitted
+func acquireAsync(scheduler *SlotScheduler, groups []string, priority int) chan *Slot {
+	admitted := make(chan *Slot, 1)
+	go func() {
+		slot, err := scheduler.acquire(context.Background(), groups, priority)
+		if err == nil {
+			admitted <- slot
+		}
+	}()
+	return admitted
+}
+
+// waitForWaiters waits until count jobs are queued for a slot
+func waitForWaiters(t *testing.T, scheduler *SlotScheduler, count int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		scheduler.mu.Lock()
+		waiting := len(scheduler.waiters)
+		scheduler.mu.Unlock()
+		if waiting == count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d jobs waiting for a slot", count)
+}
+
+func expectAdmitted(t *testing.T, admitted chan *Slot, expected bool) *Slot {
+	t.Helper()
+	select {
+	case slot := <-admitted:
+		if !expected {
+			t.Error("Expected the job to keep waiting")
+		}
+		return slot
+	case <-time.After(100 * time.Millisecond):
+		if expected {
+			t.Error("Expected the job to be admitted")
+		}
+		return nil
+	}
+}
+
+func TestSlotScheduler_Unlimited(t *testing.T) {
+	scheduler := createSlotScheduler(0, nil)
+
+	for i := 0; i < 10; i++ {
+		if _, err := scheduler.acquire(context.Background(), []string{"group1"}, 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if scheduler.returnStatus() != "" {
+		t.Error("Expected no status without limits")
+	}
+}
+
+func TestSlotScheduler_GlobalLimitAndPriority(t *testing.T) {
+	scheduler := createSlotScheduler(1, nil)
+	first, _ := scheduler.acquire(context.Background(), nil, 0)
+
+	low := acquireAsync(scheduler, nil, 1)
+	waitForWaiters(t, scheduler, 1)
+	high := acquireAsync(scheduler, nil, 10)
+	waitForWaiters(t, scheduler, 2)
+	expectAdmitted(t, low, false)
+
+	scheduler.release(first)
+	highSlot := expectAdmitted(t, high, true)
+	expectAdmitted(t, low, false)
+
+	scheduler.release(highSlot)
+	expectAdmitted(t, low, true)
+}
+
+func TestSlotScheduler_GroupLimit(t *testing.T) {
+	scheduler := createSlotScheduler(3, map[string]int{"db-heavy": 1})
+	heavy, _ := scheduler.acquire(context.Background(), []string{"db-heavy"}, 0)
+
+	// Blocked by its group, the waiting job doesn't hold back other groups
+	secondHeavy := acquireAsync(scheduler, []string{"db-heavy", "reports"}, 10)
+	waitForWaiters(t, scheduler, 1)
+	light := acquireAsync(scheduler, []string{"light"}, 0)
+	expectAdmitted(t, light, true)
+	expectAdmitted(t, secondHeavy, false)
+
+	status := scheduler.returnStatus()
+	if !strings.Contains(status, "Running: 2/3, queued for a slot: 1") || !strings.Contains(status, "Group db-heavy: 1/1") {
+		t.Errorf("Unexpected status:\n%s", status)
+	}
+
+	scheduler.release(heavy)
+	expectAdmitted(t, secondHeavy, true)
+}
+
+func TestSlotScheduler_AcquireCancelled(t *testing.T) {
+	scheduler := createSlotScheduler(1, nil)
+	scheduler.acquire(context.Background(), nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	slot, err := scheduler.acquire(ctx, nil, 0)
+
+	if err == nil || slot != nil {
+		t.Error("Expected a cancelled wait to return an error")
+	}
+	if running, waiting := scheduler.running, len(scheduler.waiters); running != 1 || waiting != 0 {
+		t.Errorf("Expected 1 running and no waiting job, got %d and %d", running, waiting)
+	}
+}
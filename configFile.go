@@ -7,11 +7,21 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 )
 
 type ConfigFile struct {
 	ConnectionConfigs []ConnectionConfig `json:"connections"`
-	Jobs              []Job              `json:"jobs"`
+	Jobs              []*Job             `json:"jobs"`
+	ResourceLimits    ResourceLimits     `json:"resource_limits"`
+	MaxConcurrent     int                `json:"max_concurrent"`
+	GroupLimits       map[string]int     `json:"group_limits"`
+	Include           []string           `json:"include"`
+	Defaults          *Job               `json:"defaults"`
+	Templates         map[string]*Job    `json:"templates"`
+	Vault             *VaultConfig       `json:"vault"`
+	source            *ConfigSource
+	vault             *VaultClient
 }
 
 func (configFile *ConfigFile) getConnectionByName(name string) (*ConnectionConfig, error) {
@@ -37,23 +47,57 @@ func createConfig(configFile string) (ConfigFile, error) {
 		return configuration, fmt.Errorf("failed to read config file %s: %w", configFile, err)
 	}
 
-	if err := json.Unmarshal(byteValue, &configuration); err != nil {
+	format, err := configFormatOf(configFile)
+	if err != nil {
+		return configuration, err
+	}
+	root, err := format.decode(byteValue)
+	if err != nil {
+		return configuration, fmt.Errorf("failed to parse config file %s: %w", configFile, err)
+	}
+	problems := checkJSONShape(root, reflect.TypeOf(configuration), "")
+	if len(problems) > 0 {
+		return configuration, ConfigErrors(problems)
+	}
+	tree, problems := loadConfigTree(configFile, root.(*jsonObject), *configDir)
+	if len(problems) > 0 {
+		return configuration, ConfigErrors(problems)
+	}
+	// Every format is loaded through the JSON of the merged configuration
+	jsonValue, err := encodeJSONConfig(tree.root, nil)
+	if err != nil {
 		return configuration, fmt.Errorf("failed to parse config file %s: %w", configFile, err)
 	}
+	if err := json.Unmarshal(jsonValue, &configuration); err != nil {
+		return configuration, fmt.Errorf("failed to parse config file %s: %w", configFile, err)
+	}
+	configuration.source = &ConfigSource{
+		Path:        configFile,
+		Checksum:    checksumOf(byteValue),
+		Included:    tree.included,
+		inheritance: tree.inheritance,
+	}
+	configuration.vault = tree.vault
+
+	if problems := tree.locate(configuration.validate(tree.root)); len(problems) > 0 {
+		return configuration, ConfigErrors(problems)
+	}
+	for _, connectionConfig := range configuration.ConnectionConfigs {
+		if connectionConfig.InsecureSkipVerify {
+			log.Printf("WARNING: connection %q has insecure_skip_verify enabled. TLS certificates of %v are NOT verified and the connection is open to man-in-the-middle attacks\n", connectionConfig.Name, connectionConfig.Endpoint)
+		}
+	}
 
-	for index := 0; index < len(configuration.ConnectionConfigs); index++ {
-		configuration.ConnectionConfigs[index].replaceEnvVariables()
+	for i, job := range configuration.Jobs {
+		job.baseName = job.Name
+		job.resourceLimits = configuration.ResourceLimits.override(job.ResourceLimits)
+		job.origin = tree.jobOrigins[i]
+		log.Printf("Job %v loaded from %v\n", job.Name, job.origin)
 	}
 
 	for job := 0; job < len(configuration.Jobs); job++ {
-		if configuration.Jobs[job].Spawn > 1 {
-			for spawn := 1; spawn < configuration.Jobs[job].Spawn; spawn++ {
-				newClonedJob := configuration.Jobs[job].clone(spawn)
-				configuration.Jobs = append(configuration.Jobs, newClonedJob)
-			}
-			configuration.Jobs[job].Name = configuration.Jobs[job].Name + "_0"
-			configuration.Jobs[job].Spawn = 1
-		}
+		copies := spawnJob(configuration.Jobs[job])
+		configuration.Jobs = append(configuration.Jobs, copies[1:]...)
 	}
 
 	return configuration, nil
@@ -3,9 +3,98 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// testConfig is the config file written by writeTestConfig. Unless content
+// is given, it holds the connection "main" and the job "job1" the config
+// tests share, with the fields of connection, job and root set on them, a
+// nil value removing a field.
+type testConfig struct {
+	name       string // of the config file, config.json by default
+	content    string
+	connection map[string]any
+	job        map[string]any
+	root       map[string]any
+	files      map[string]string // written next to the config, by relative path
+}
+
+// writeTestConfig writes the config and its files in a temporary directory
+// and returns the path of the config
+func writeTestConfig(t *testing.T, config testConfig) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range config.files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := config.content
+	if content == "" {
+		connection := withTestFields(map[string]any{"name": "main", "endpoint": "http://localhost:15672"}, config.connection)
+		job := withTestFields(map[string]any{
+			"name": "job1", "command": "true", "connection": "main", "queue": "q",
+			"sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0,
+		}, config.job)
+		root := withTestFields(map[string]any{"connections": []any{connection}, "jobs": []any{job}}, config.root)
+		encoded, err := encodeJSONConfig(toJSONValue(root), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = string(encoded)
+	}
+	name := config.name
+	if name == "" {
+		name = "config.json"
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withTestFields sets the fields of a test on the ones of the fixture
+func withTestFields(fields map[string]any, overrides map[string]any) map[string]any {
+	for key, value := range overrides {
+		if value == nil {
+			delete(fields, key)
+		} else {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// loadTestConfig writes the config and loads it
+func loadTestConfig(t *testing.T, config testConfig) (ConfigFile, string) {
+	t.Helper()
+	path := writeTestConfig(t, config)
+	configuration, err := createConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return configuration, path
+}
+
+// useTestConfig loads the config as the one the supervisor runs
+func useTestConfig(t *testing.T, config testConfig) (ConfigFile, string) {
+	t.Helper()
+	configuration, path := loadTestConfig(t, config)
+	previous := configSource
+	configSource = configuration.source
+	t.Cleanup(func() { configSource = previous })
+	useRuntimeJobKiller(t)
+	jobKiller.Connections = configuration.ConnectionConfigs
+	jobKiller.Jobs = configuration.Jobs
+	return configuration, path
+}
+
 // Test getConnectionByName
 
 func TestConfigFile_GetConnectionByName_Found(t *testing.T) {
@@ -145,13 +234,15 @@ func TestCreateConfig_WithSpawn(t *testing.T) {
 	configPath := filepath.Join(tmpDir, "spawn_config.json")
 
 	configContent := `{
-		"connections": [],
+		"connections": [{"name": "main", "endpoint": "http://localhost:15672"}],
 		"jobs": [
 			{
 				"name": "spawned_job",
 				"spawn": 3,
 				"command": "echo test",
-				"queue": "test_queue"
+				"connection": "main",
+				"queue": "test_queue",
+				"sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0
 			}
 		]
 	}`
@@ -271,19 +362,23 @@ func TestCreateConfig_MultipleSpawnedJobs(t *testing.T) {
 	configPath := filepath.Join(tmpDir, "multi_spawn_config.json")
 
 	configContent := `{
-		"connections": [],
+		"connections": [{"name": "main", "endpoint": "http://localhost:15672"}],
 		"jobs": [
 			{
 				"name": "job_a",
 				"spawn": 2,
 				"command": "echo a",
-				"queue": "queue_a"
+				"connection": "main",
+				"queue": "queue_a",
+				"sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0
 			},
 			{
 				"name": "job_b",
 				"spawn": 1,
 				"command": "echo b",
-				"queue": "queue_b"
+				"connection": "main",
+				"queue": "queue_b",
+				"sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0
 			}
 		]
 	}`
@@ -309,7 +404,7 @@ func TestCreateConfig_PreservesJobProperties(t *testing.T) {
 	configPath := filepath.Join(tmpDir, "props_config.json")
 
 	configContent := `{
-		"connections": [],
+		"connections": [{"name": "main", "endpoint": "http://localhost:15672"}],
 		"jobs": [
 			{
 				"name": "full_job",
@@ -373,3 +468,167 @@ func TestCreateConfig_PreservesJobProperties(t *testing.T) {
 		t.Errorf("Expected 2 groups, got %d", len(job.Groups))
 	}
 }
+
+func TestCreateConfig_InvalidTLSSettings(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "tls_config.json")
+
+	configContent := `{
+		"connections": [
+			{
+				"name": "secure",
+				"endpoint": "https://rabbit.internal:15671",
+				"ca_file": "/nonexistent/ca.pem"
+			}
+		],
+		"jobs": []
+	}`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	_, err = createConfig(configPath)
+	if err == nil {
+		t.Fatal("Expected error for unreadable ca_file")
+	}
+	if !strings.Contains(err.Error(), "secure") {
+		t.Errorf("Expected error to name the connection, got: %v", err)
+	}
+}
+
+func TestCreateConfig_InvalidEndpointSelection(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "cluster_config.json")
+
+	configContent := `{
+		"connections": [
+			{
+				"name": "cluster",
+				"endpoints": ["http://rabbit1:15672", "http://rabbit2:15672"],
+				"endpoint_selection": "random"
+			}
+		],
+		"jobs": []
+	}`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	_, err = createConfig(configPath)
+	if err == nil {
+		t.Fatal("Expected error for unknown endpoint_selection")
+	}
+	if !strings.Contains(err.Error(), "cluster") {
+		t.Errorf("Expected error to name the connection, got: %v", err)
+	}
+}
+
+func TestCreateConfig_ResourceLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "limits_config.json")
+
+	configContent := `{
+		"resource_limits": {"max_load": 8, "min_available_memory_mb": 512},
+		"connections": [{"name": "default", "endpoint": "http://localhost:15672"}],
+		"jobs": [
+			{"name": "plain", "command": "echo", "connection": "default", "queue": "q", "sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0},
+			{"name": "heavy", "command": "echo", "connection": "default", "queue": "q", "spawn": 2, "sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0,
+			 "resource_limits": {"max_load": 2, "min_free_disk_mb": 1024}}
+		]
+	}`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	config, err := createConfig(configPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]ResourceLimits{
+		"plain":   {MaxLoad: 8, MinAvailableMemoryMB: 512},
+		"heavy_0": {MaxLoad: 2, MinAvailableMemoryMB: 512, MinFreeDiskMB: 1024},
+		"heavy_1": {MaxLoad: 2, MinAvailableMemoryMB: 512, MinFreeDiskMB: 1024},
+	}
+	for _, job := range config.Jobs {
+		if job.resourceLimits != expected[job.Name] {
+			t.Errorf("Job %v: expected limits %+v, got %+v", job.Name, expected[job.Name], job.resourceLimits)
+		}
+	}
+}
+
+func TestCreateConfig_NegativeResourceLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "limits_config.json")
+
+	configContent := `{
+		"connections": [],
+		"jobs": [{"name": "job1", "command": "echo", "resource_limits": {"max_load": -1}}]
+	}`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	_, err = createConfig(configPath)
+	if err == nil || !strings.Contains(err.Error(), "job1") {
+		t.Errorf("Expected error naming the job, got %v", err)
+	}
+}
+
+func TestCreateConfig_DependencyCycle(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "relations_config.json")
+
+	configContent := `{
+		"connections": [{"name": "main", "endpoint": "http://localhost:15672"}],
+		"jobs": [
+			{"name": "import", "command": "echo", "connection": "main", "queue": "q", "sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "after": ["report"]},
+			{"name": "report", "command": "echo", "connection": "main", "queue": "q", "sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "after": ["import"], "on_success": true}
+		]
+	}`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	_, err = createConfig(configPath)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected dependency cycle error, got %v", err)
+	}
+}
+
+func TestCreateConfig_RelationsKeepBaseName(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "relations_config.json")
+
+	configContent := `{
+		"connections": [{"name": "main", "endpoint": "http://localhost:15672"}],
+		"jobs": [
+			{"name": "import", "command": "echo", "connection": "main", "queue": "q", "sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "spawn": 2},
+			{"name": "reindex", "command": "echo", "connection": "main", "queue": "q", "sleep_time": 5, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "conflicts_with": ["import"]}
+		]
+	}`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	config, err := createConfig(configPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, job := range config.Jobs {
+		if strings.HasPrefix(job.Name, "import_") && job.getBaseName() != "import" {
+			t.Errorf("Expected base name import for %v, got %v", job.Name, job.getBaseName())
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigProblem is something wrong in the configuration, located by its
+// JSON path (e.g. jobs[2].sleep_time)
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+func (problem ConfigProblem) String() string {
+	if problem.Path == "" {
+		return problem.Message
+	}
+	return problem.Path + ": " + problem.Message
+}
+
+// ConfigErrors are the problems that prevent a configuration from loading
+type ConfigErrors []ConfigProblem
+
+func (problems ConfigErrors) Error() string {
+	lines := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		lines = append(lines, problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// checkJSONShape compares the decoded JSON with the struct it is loaded
+// into: unknown fields and values of the wrong type are reported with their
+// path. Keys starting with an underscore are comments and are ignored.
+func checkJSONShape(value any, target reflect.Type, path string) []ConfigProblem {
+	if value == nil {
+		return nil
+	}
+	for target.Kind() == reflect.Pointer {
+		target = target.Elem()
+	}
+	var problems []ConfigProblem
+	switch target.Kind() {
+	case reflect.Struct:
+		object, ok := value.(*jsonObject)
+		if !ok {
+			return []ConfigProblem{{path, "expected an object"}}
+		}
+		fields := jsonFieldsOf(target)
+		for _, key := range object.keys {
+			if strings.HasPrefix(key, "_") {
+				continue
+			}
+			fieldType, found := fields[key]
+			if !found && target == reflect.TypeOf(ConnectionConfig{}) && secretFileField(key) != "" {
+				fieldType, found = reflect.TypeOf(""), true
+			}
+			if !found {
+				message := "unknown field"
+				if suggestion := closestName(key, fields); suggestion != "" {
+					message += fmt.Sprintf(" (did you mean %v?)", suggestion)
+				}
+				problems = append(problems, ConfigProblem{joinPath(path, key), message})
+				continue
+			}
+			problems = append(problems, checkJSONShape(object.values[key], fieldType, joinPath(path, key))...)
+		}
+	case reflect.Map:
+		object, ok := value.(*jsonObject)
+		if !ok {
+			return []ConfigProblem{{path, "expected an object"}}
+		}
+		for _, key := range object.keys {
+			problems = append(problems, checkJSONShape(object.values[key], target.Elem(), joinPath(path, key))...)
+		}
+	case reflect.Slice:
+		array, ok := value.([]any)
+		if !ok {
+			return []ConfigProblem{{path, "expected a list"}}
+		}
+		for i, element := range array {
+			problems = append(problems, checkJSONShape(element, target.Elem(), fmt.Sprintf("%v[%d]", path, i))...)
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return []ConfigProblem{{path, "expected a string"}}
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return []ConfigProblem{{path, "expected true or false"}}
+		}
+	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return []ConfigProblem{{path, "expected a number"}}
+		}
+		if _, err := number.Int64(); err != nil {
+			return []ConfigProblem{{path, "expected a whole number"}}
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(json.Number); !ok {
+			return []ConfigProblem{{path, "expected a number"}}
+		}
+	}
+	return problems
+}
+
+// jsonFieldsOf returns the fields of a struct that are set from the config
+// file, by their JSON name
+func jsonFieldsOf(target reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = field.Type
+		}
+	}
+	return fields
+}
+
+// closestName returns the field name a mistyped key most likely stands for
+func closestName(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if distance := editDistance(strings.ToLower(key), name); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// validate checks the values of the configuration, once decoded, against
+// what the README documents. root is the decoded JSON, to tell the fields
+// that are missing from the ones set to zero.
+func (configuration *ConfigFile) validate(root *jsonObject) []ConfigProblem {
+	var problems []ConfigProblem
+	connectionNames := make(map[string]bool)
+	for i := range configuration.ConnectionConfigs {
+		connectionConfig := &configuration.ConnectionConfigs[i]
+		path := fmt.Sprintf("connections[%d]", i)
+		if connectionNames[connectionConfig.Name] {
+			problems = append(problems, ConfigProblem{path + ".name", fmt.Sprintf("connection %q is defined more than once", connectionConfig.Name)})
+		}
+		connectionNames[connectionConfig.Name] = true
+		problems = append(problems, validateConnection(connectionConfig, path)...)
+	}
+
+	jobEntries, _ := root.values["jobs"].([]any)
+	jobNames := make(map[string]bool)
+	for i, job := range configuration.Jobs {
+		path := fmt.Sprintf("jobs[%d]", i)
+		if job == nil {
+			problems = append(problems, ConfigProblem{path, "expected a job"})
+			continue
+		}
+		if jobNames[job.Name] {
+			problems = append(problems, ConfigProblem{path + ".name", fmt.Sprintf("job %q is defined more than once", job.Name)})
+		}
+		jobNames[job.Name] = true
+		var entry *jsonObject
+		if i < len(jobEntries) {
+			entry, _ = jobEntries[i].(*jsonObject)
+		}
+		problems = append(problems, validateJob(job, entry, path, configuration.ConnectionConfigs)...)
+	}
+	if len(problems) == 0 {
+		if err := validateRelations(configuration.Jobs); err != nil {
+			problems = append(problems, ConfigProblem{"jobs", err.Error()})
+		}
+	}
+
+	if configuration.MaxConcurrent < 0 {
+		problems = append(problems, ConfigProblem{"max_concurrent", "max_concurrent can't be negative"})
+	}
+	groups := make([]string, 0, len(configuration.GroupLimits))
+	for group := range configuration.GroupLimits {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		if configuration.GroupLimits[group] < 0 {
+			problems = append(problems, ConfigProblem{"group_limits." + group, fmt.Sprintf("group_limits of group %q can't be negative", group)})
+		}
+	}
+	if err := configuration.ResourceLimits.validate(); err != nil {
+		problems = append(problems, ConfigProblem{"resource_limits", err.Error()})
+	}
+	return problems
+}
+
+func validateConnection(connectionConfig *ConnectionConfig, path string) []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field string, format string, arguments ...any) {
+		problems = append(problems, ConfigProblem{joinPath(path, field), fmt.Sprintf(format, arguments...)})
+	}
+	if connectionConfig.Name == "" {
+		add("name", "name is required")
+	}
+	connectionType := connectionConfig.getType()
+	switch connectionType {
+	case CONNECTION_TYPE_RABBITMQ, CONNECTION_TYPE_NATS:
+		if connectionConfig.Endpoint == "" && len(connectionConfig.Endpoints) == 0 {
+			add("endpoint", "connection %q needs an endpoint or endpoints", connectionConfig.Name)
+		}
+	case CONNECTION_TYPE_SQS:
+		if connectionConfig.Region == "" {
+			add("region", "connection %q of type sqs needs a region", connectionConfig.Name)
+		}
+	default:
+		add("type", "connection %q has unsupported type %q", connectionConfig.Name, connectionConfig.Type)
+	}
+	if selection := connectionConfig.getEndpointSelection(); selection != ENDPOINT_SELECTION_PRIORITY && selection != ENDPOINT_SELECTION_ROUND_ROBIN {
+		add("endpoint_selection", "connection %q has unknown endpoint_selection %q (expected %v or %v)", connectionConfig.Name, selection, ENDPOINT_SELECTION_PRIORITY, ENDPOINT_SELECTION_ROUND_ROBIN)
+	}
+	if connectionConfig.BreakerThreshold < 0 || connectionConfig.BreakerBackoff < 0 || connectionConfig.BreakerMaxBackoff < 0 {
+		add("breaker_threshold", "connection %q has negative circuit breaker settings", connectionConfig.Name)
+	}
+	if connectionConfig.AlarmCheckInterval < 0 {
+		add("alarm_check_interval", "connection %q has a negative alarm_check_interval", connectionConfig.Name)
+	}
+	if connectionConfig.WatchAlarms && connectionType != CONNECTION_TYPE_RABBITMQ {
+		add("watch_alarms", "connection %q: watch_alarms is only available on rabbitmq connections", connectionConfig.Name)
+	}
+	if _, err := connectionConfig.getTLSConfig(); err != nil {
+		add("", "invalid TLS settings for connection %q: %v", connectionConfig.Name, err)
+	}
+	return problems
+}
+
+// validateJob checks a job against the connections it can use. entry is the
+// JSON object of the job, nil when the job doesn't come from JSON.
+func validateJob(job *Job, entry *jsonObject, path string, connections []ConnectionConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field string, format string, arguments ...any) {
+		problems = append(problems, ConfigProblem{joinPath(path, field), fmt.Sprintf(format, arguments...)})
+	}
+	if strings.TrimSpace(job.Name) == "" {
+		add("name", "name is required")
+	}
+	if err := validateCommand(job.Command); err != nil {
+		add("command", "command is required")
+	}
+	for _, field := range []string{"sleep_increment", "max_sleep", "min_messages"} {
+		if entry != nil {
+			if _, found := entry.values[field]; !found {
+				add(field, "%v is required", field)
+			}
+		}
+	}
+	if job.SleepTime <= 0 {
+		add("sleep_time", "sleep_time must be greater than 0")
+	}
+	if job.SleepIncrement < 0 {
+		add("sleep_increment", "sleep_increment can't be negative")
+	}
+	if job.MaxSleep < job.SleepTime {
+		add("max_sleep", "max_sleep can't be lower than sleep_time")
+	}
+	if job.MinMessages < 0 {
+		add("min_messages", "min_messages can't be negative")
+	}
+	if job.Spawn < 0 {
+		add("spawn", "spawn can't be negative")
+	}
+	if job.MaxExecution < 0 {
+		add("max_execution", "max_execution can't be negative")
+	}
+	if job.BatchSize < 0 {
+		add("batch_size", "batch_size can't be negative")
+	}
+	if job.ErrorLogMaxKBSize < 0 {
+		add("error_log_max_kb_size", "error_log_max_kb_size can't be negative")
+	}
+	if job.ErrorLogMaxFiles < 0 {
+		add("error_log_max_files", "error_log_max_files can't be negative")
+	}
+	if job.ErrorLogPath != "" && !strings.HasSuffix(job.ErrorLogPath, "/") {
+		add("error_log_path", "error_log_path %v must end with /", job.ErrorLogPath)
+	}
+	if err := validateGroups(job.Groups); err != nil {
+		add("groups", "%v", err)
+	}
+	if job.ResourceLimits != nil {
+		if err := job.ResourceLimits.validate(); err != nil {
+			add("resource_limits", "job %q: %v", job.Name, err)
+		}
+	}
+	if job.Delivery != "" && job.Delivery != DELIVERY_STDIN && job.Delivery != DELIVERY_FILE {
+		add("delivery", "unsupported delivery %q (expected %v or %v)", job.Delivery, DELIVERY_STDIN, DELIVERY_FILE)
+	}
+	if job.EventMode != "" && job.EventMode != EVENT_MODE_CONSUMER {
+		add("event_mode", "unsupported event_mode %q (expected %v)", job.EventMode, EVENT_MODE_CONSUMER)
+	}
+
+	if job.ConnectionName == "" {
+		add("connection", "connection is required")
+		return problems
+	}
+	var connectionConfig *ConnectionConfig
+	for i := range connections {
+		if connections[i].Name == job.ConnectionName {
+			connectionConfig = &connections[i]
+		}
+	}
+	if connectionConfig == nil {
+		add("connection", "unknown connection %q", job.ConnectionName)
+		return problems
+	}
+	connectionType := connectionConfig.getType()
+	if connectionType == CONNECTION_TYPE_NATS {
+		if job.Stream == "" {
+			add("stream", "stream is required on nats connections")
+		}
+		if job.Consumer == "" {
+			add("consumer", "consumer is required on nats connections")
+		}
+	} else if err := validateQueue(job.Queue); err != nil {
+		add("queue", "queue is required")
+	}
+	if (job.Delivery != "" || job.EventMode != "") && (connectionType != CONNECTION_TYPE_RABBITMQ || connectionConfig.AmqpEndpoint == "") {
+		add("connection", "delivery and event_mode need a rabbitmq connection with an amqp_endpoint")
+	}
+	if job.PauseOnAlarm && !connectionConfig.WatchAlarms {
+		add("pause_on_alarm", "connection %q doesn't have watch_alarms", connectionConfig.Name)
+	}
+	return problems
+}
+
+// preflight checks, on this host, what the jobs need to run: their
+// directories, users and executables
+func (configuration *ConfigFile) preflight() []ConfigProblem {
+	var problems []ConfigProblem
+	checked := make(map[string]bool)
+	for i, job := range configuration.Jobs {
+		// Spawned copies are checked once, at the place of their job
+		if checked[job.getBaseName()] {
+			continue
+		}
+		checked[job.getBaseName()] = true
+		path := fmt.Sprintf("jobs[%d]", i)
+		if job.origin != nil && job.origin.label != "" {
+			path = job.origin.label
+		}
+		problems = append(problems, preflightJob(job, path)...)
+	}
+	return problems
+}
+
+// preflightJob checks the directories, user and executable of a job
+func preflightJob(job *Job, path string) []ConfigProblem {
+	var problems []ConfigProblem
+	if err := validateWorkingDir(job.WorkingDir); err != nil {
+		problems = append(problems, ConfigProblem{joinPath(path, "working_dir"), err.Error()})
+	}
+	if err := validateUser(job.UserId); err != nil {
+		problems = append(problems, ConfigProblem{joinPath(path, "user"), err.Error()})
+	}
+	if err := validateErrorLogPath(job.ErrorLogPath); err != nil {
+		problems = append(problems, ConfigProblem{joinPath(path, "error_log_path"), err.Error()})
+	}
+	if err := validateExecutable(job.Command, job.WorkingDir); err != nil {
+		problems = append(problems, ConfigProblem{joinPath(path, "command"), err.Error()})
+	}
+	return problems
+}
+
+// validateExecutable checks that the program of the command can be run, a
+// relative path being relative to the working directory
+func validateExecutable(command string, workingDir string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	program := fields[0]
+	if !strings.Contains(program, "/") {
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("executable %v not found in PATH", program)
+		}
+		return nil
+	}
+	if !filepath.IsAbs(program) && workingDir != "" {
+		program = filepath.Join(workingDir, program)
+	}
+	info, err := os.Stat(program)
+	if err != nil {
+		return fmt.Errorf("executable %v: %w", program, err)
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%v is not executable", program)
+	}
+	return nil
+}
+
+// checkConfig loads the config file and runs the preflight checks,
+// returning every problem found
+func checkConfig(configFile string) []ConfigProblem {
+	configuration, err := createConfig(configFile)
+	if err != nil {
+		if problems, ok := err.(ConfigErrors); ok {
+			return problems
+		}
+		return []ConfigProblem{{"", err.Error()}}
+	}
+	return configuration.preflight()
+}
+
+// reportConfigCheck prints the problems of the config file, one per line,
+// and returns the exit code of the check operation
+func reportConfigCheck(configFile string, output io.Writer) int {
+	problems := checkConfig(configFile)
+	for _, problem := range problems {
+		fmt.Fprintln(output, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(output, "%d problem(s) found in %v\n", len(problems), configFile)
+		return 1
+	}
+	fmt.Fprintf(output, "%v is valid\n", configFile)
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// problemAt returns the message of the problem found at path
+func problemAt(problems []ConfigProblem, path string) (string, bool) {
+	for _, problem := range problems {
+		if problem.Path == path {
+			return problem.Message, true
+		}
+	}
+	return "", false
+}
+
+func TestCheckConfig_Valid(t *testing.T) {
+	path := writeTestConfig(t, testConfig{job: map[string]any{"_comment": "ignored"}})
+
+	if problems := checkConfig(path); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestCheckConfig_UnknownField(t *testing.T) {
+	path := writeTestConfig(t, testConfig{job: map[string]any{"max_sleeep": 30}})
+
+	message, found := problemAt(checkConfig(path), "jobs[0].max_sleeep")
+
+	if !found || !strings.Contains(message, "did you mean max_sleep?") {
+		t.Errorf("Expected the unknown field to be reported with a suggestion, got %q", message)
+	}
+}
+
+func TestCheckConfig_WrongType(t *testing.T) {
+	path := writeTestConfig(t, testConfig{job: map[string]any{"spawn": "2"}})
+
+	if _, found := problemAt(checkConfig(path), "jobs[0].spawn"); !found {
+		t.Error("Expected the string spawn to be reported")
+	}
+}
+
+func TestCheckConfig_CollectsEveryProblem(t *testing.T) {
+	path := writeTestConfig(t, testConfig{root: map[string]any{"jobs": []any{
+		map[string]any{"name": "job1", "connection": "main", "queue": "q", "sleep_time": 0, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0},
+		map[string]any{"name": "job2", "command": "true", "connection": "other", "sleep_time": 5},
+	}}})
+
+	problems := checkConfig(path)
+
+	for _, expected := range []string{
+		"jobs[0].command",
+		"jobs[0].sleep_time",
+		"jobs[1].connection",
+		"jobs[1].sleep_increment",
+		"jobs[1].max_sleep",
+		"jobs[1].min_messages",
+	} {
+		if _, found := problemAt(problems, expected); !found {
+			t.Errorf("Expected a problem at %v, got %v", expected, problems)
+		}
+	}
+}
+
+func TestCheckConfig_Preflight(t *testing.T) {
+	path := writeTestConfig(t, testConfig{job: map[string]any{"command": "no-such-program-here", "working_dir": "/no/such/dir", "user": "no-such-user-here"}})
+
+	problems := checkConfig(path)
+
+	for _, expected := range []string{"jobs[0].command", "jobs[0].working_dir", "jobs[0].user"} {
+		if _, found := problemAt(problems, expected); !found {
+			t.Errorf("Expected a problem at %v, got %v", expected, problems)
+		}
+	}
+}
+
+func TestValidateExecutable_RelativeToWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\n"), 0644)
+
+	if err := validateExecutable("./run.sh --now", dir); err == nil {
+		t.Error("Expected a script without the execute permission to be refused")
+	}
+	os.Chmod(filepath.Join(dir, "run.sh"), 0755)
+	if err := validateExecutable("./run.sh --now", dir); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestReportConfigCheck(t *testing.T) {
+	var output bytes.Buffer
+
+	code := reportConfigCheck(writeTestConfig(t, testConfig{job: map[string]any{"sleep_time": -1}}), &output)
+
+	if code != 1 || !strings.Contains(output.String(), "jobs[0].sleep_time: ") {
+		t.Errorf("Expected the problem to be printed with its path and exit code 1, got %d: %s", code, output.String())
+	}
+
+	output.Reset()
+	if code := reportConfigCheck(writeTestConfig(t, testConfig{}), &output); code != 0 {
+		t.Errorf("Expected exit code 0 for a valid config, got %d: %s", code, output.String())
+	}
+}
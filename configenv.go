@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// interpolate replaces the references to environment variables in value:
+// ${VAR}, ${VAR:-default} when VAR is unset or empty, and ${VAR:?message}
+// which fails when VAR is unset or empty. An unset ${VAR} fails too, so that
+// a missing credential doesn't silently become empty. $$ is a literal $.
+func interpolate(value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	var result strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			result.WriteByte(value[i])
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			result.WriteByte('$')
+			i++
+		case '{':
+			end := closingBrace(value, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", value)
+			}
+			replacement, err := interpolateReference(value[i+2 : end])
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(replacement)
+			i = end
+		default:
+			result.WriteByte('$')
+		}
+	}
+	return result.String(), nil
+}
+
+// closingBrace returns the index of the brace closing the reference that
+// starts at start, -1 when there is none
+func closingBrace(value string, start int) int {
+	depth := 1
+	for i := start; i < len(value); i++ {
+		switch value[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func interpolateReference(reference string) (string, error) {
+	name, rest := reference, ""
+	if index := strings.Index(reference, ":"); index >= 0 {
+		name, rest = reference[:index], reference[index:]
+	}
+	if !isVariableName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+	value, set := os.LookupEnv(name)
+	switch {
+	case rest == "":
+		if !set {
+			return "", fmt.Errorf("environment variable %v is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(rest, ":-"):
+		if value == "" {
+			// The default can refer to variables too
+			return interpolate(rest[2:])
+		}
+		return value, nil
+	case strings.HasPrefix(rest, ":?"):
+		if value == "" {
+			message := rest[2:]
+			if message == "" {
+				message = "is required"
+			}
+			return "", fmt.Errorf("environment variable %v: %v", name, message)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unsupported reference ${%v} (expected ${%v}, ${%v:-default} or ${%v:?message})", reference, name, name, name)
+}
+
+func isVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, character := range name {
+		if !(character == '_' || character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' || i > 0 && character >= '0' && character <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// interpolateConfig interpolates, in place, every string of the config tree
+// but the ones under comment keys
+func interpolateConfig(value any, path string) []ConfigProblem {
+	var problems []ConfigProblem
+	interpolateElement := func(element any, elementPath string) any {
+		if text, ok := element.(string); ok {
+			interpolated, err := interpolate(text)
+			if err != nil {
+				problems = append(problems, ConfigProblem{elementPath, err.Error()})
+				return text
+			}
+			return interpolated
+		}
+		problems = append(problems, interpolateConfig(element, elementPath)...)
+		return element
+	}
+	switch value := value.(type) {
+	case *jsonObject:
+		for _, key := range value.keys {
+			if !strings.HasPrefix(key, "_") {
+				value.values[key] = interpolateElement(value.values[key], joinPath(path, key))
+			}
+		}
+	case []any:
+		for i := range value {
+			value[i] = interpolateElement(value[i], fmt.Sprintf("%v[%d]", path, i))
+		}
+	}
+	return problems
+}
+
+// interpolatedJSON returns a copy of the value with its strings
+// interpolated, the strings that fail being kept as they are
+func interpolatedJSON(value any) any {
+	switch value := value.(type) {
+	case string:
+		if interpolated, err := interpolate(value); err == nil {
+			return interpolated
+		}
+	case []any:
+		array := make([]any, len(value))
+		for i, element := range value {
+			array[i] = interpolatedJSON(element)
+		}
+		return array
+	case *jsonObject:
+		object := &jsonObject{values: make(map[string]any)}
+		for _, key := range value.keys {
+			object.set(key, interpolatedJSON(value.values[key]))
+		}
+		return object
+	}
+	return value
+}
+
+// secretFileField returns the string field of a connection that a key such
+// as password_file reads from a file, "" when the key isn't one
+func secretFileField(key string) string {
+	base, found := strings.CutSuffix(key, "_file")
+	if !found {
+		return ""
+	}
+	fields := jsonFieldsOf(reflect.TypeOf(ConnectionConfig{}))
+	if _, isField := fields[key]; isField {
+		return ""
+	}
+	if fieldType, isField := fields[base]; isField && fieldType.Kind() == reflect.String {
+		return base
+	}
+	return ""
+}
+
+// readSecretFiles sets the fields of the connection given as *_file keys
+// to the content of the files, as mounted by Docker or Kubernetes secrets.
+// Relative paths are relative to the directory of the config file.
+func readSecretFiles(connection *jsonObject, path string, configFile string) []ConfigProblem {
+	var problems []ConfigProblem
+	for _, key := range connection.keys {
+		field := secretFileField(key)
+		fileName, ok := connection.values[key].(string)
+		if field == "" || !ok {
+			continue
+		}
+		if _, found := connection.values[field]; found {
+			problems = append(problems, ConfigProblem{joinPath(path, key), fmt.Sprintf("%v and %v can't both be set", field, key)})
+			continue
+		}
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(filepath.Dir(configFile), fileName)
+		}
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			problems = append(problems, ConfigProblem{joinPath(path, key), fmt.Sprintf("failed to read secret file: %v", err)})
+			continue
+		}
+		connection.set(field, strings.TrimRight(string(content), "\r\n"))
+	}
+	return problems
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("GORMQ_TEST_HOST", "rabbit.local")
+	t.Setenv("GORMQ_TEST_EMPTY", "")
+	os.Unsetenv("GORMQ_TEST_UNSET")
+
+	tests := map[string]string{
+		"plain":                           "plain",
+		"":                                "",
+		"${GORMQ_TEST_HOST}":              "rabbit.local",
+		"http://${GORMQ_TEST_HOST}:15672": "http://rabbit.local:15672",
+		"${GORMQ_TEST_UNSET:-/}":          "/",
+		"${GORMQ_TEST_EMPTY:-fallback}":   "fallback",
+		"${GORMQ_TEST_HOST:-fallback}":    "rabbit.local",
+		"${GORMQ_TEST_UNSET:-${GORMQ_TEST_HOST}}": "rabbit.local",
+		"${GORMQ_TEST_UNSET:-}":                   "",
+		"${GORMQ_TEST_EMPTY}":                     "",
+		"echo $$HOME $1 costs 5$":                 "echo $HOME $1 costs 5$",
+		"$${GORMQ_TEST_HOST}":                     "${GORMQ_TEST_HOST}",
+	}
+	for value, expected := range tests {
+		result, err := interpolate(value)
+		if err != nil || result != expected {
+			t.Errorf("interpolate(%q): expected %q, got %q (%v)", value, expected, result, err)
+		}
+	}
+}
+
+func TestInterpolate_Errors(t *testing.T) {
+	t.Setenv("GORMQ_TEST_EMPTY", "")
+	os.Unsetenv("GORMQ_TEST_UNSET")
+
+	tests := map[string]string{
+		"${GORMQ_TEST_UNSET}":                      "GORMQ_TEST_UNSET is not set",
+		"${GORMQ_TEST_UNSET:?set the vhost}":       "GORMQ_TEST_UNSET: set the vhost",
+		"${GORMQ_TEST_EMPTY:?}":                    "GORMQ_TEST_EMPTY: is required",
+		"${INCOMPLETE":                             "unterminated",
+		"${1ST}":                                   "invalid variable name",
+		"${GORMQ_TEST_UNSET/a/b}":                  "invalid variable name",
+		"${GORMQ_TEST_UNSET:=x}":                   "unsupported reference",
+		"${GORMQ_TEST_UNSET:-${GORMQ_TEST_UNSET}}": "GORMQ_TEST_UNSET is not set",
+	}
+	for value, expected := range tests {
+		if _, err := interpolate(value); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("interpolate(%q): expected an error containing %q, got %v", value, expected, err)
+		}
+	}
+}
+
+// envTestConfig returns a config that reads its values from the
+// environment, and its password from a file
+func envTestConfig() testConfig {
+	return testConfig{
+		connection: map[string]any{
+			"endpoint":      "http://${GORMQ_TEST_HOST}:15672",
+			"vhost":         "${GORMQ_TEST_VHOST:-/}",
+			"username":      "worker",
+			"password_file": "secrets/rabbit_password",
+		},
+		job: map[string]any{
+			"name":        "import",
+			"command":     "php ${GORMQ_TEST_APP}/import.php",
+			"working_dir": "${GORMQ_TEST_APP}",
+			"queue":       "${GORMQ_TEST_QUEUE:?the queue of the import}",
+			"_comment":    "${NOT_INTERPOLATED}",
+		},
+		files: map[string]string{"secrets/rabbit_password": "s3cret\n"},
+	}
+}
+
+func setEnvTestVariables(t *testing.T) {
+	t.Setenv("GORMQ_TEST_HOST", "rabbit.local")
+	t.Setenv("GORMQ_TEST_APP", "/srv/app")
+	t.Setenv("GORMQ_TEST_QUEUE", "imports")
+	os.Unsetenv("GORMQ_TEST_VHOST")
+}
+
+func TestCreateConfig_Interpolation(t *testing.T) {
+	setEnvTestVariables(t)
+
+	configuration, err := createConfig(writeTestConfig(t, envTestConfig()))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	connectionConfig := configuration.ConnectionConfigs[0]
+	if connectionConfig.Endpoint != "http://rabbit.local:15672" || connectionConfig.Vhost != "/" {
+		t.Errorf("Unexpected connection: %+v", connectionConfig)
+	}
+	if connectionConfig.Password != "s3cret" {
+		t.Errorf("Expected the password to be read from the file without its newline, got %q", connectionConfig.Password)
+	}
+	job := configuration.Jobs[0]
+	if job.Command != "php /srv/app/import.php" || job.WorkingDir != "/srv/app" || job.Queue != "imports" {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+}
+
+func TestCreateConfig_InterpolationErrors(t *testing.T) {
+	tests := map[string]struct {
+		connection map[string]any
+		expected   string
+	}{
+		"unset required variable": {
+			nil,
+			"jobs[0].queue: environment variable GORMQ_TEST_QUEUE: the queue of the import",
+		},
+		"missing secret file": {
+			map[string]any{"password_file": "secrets/missing"},
+			"connections[0].password_file: failed to read secret file",
+		},
+		"password and password file": {
+			map[string]any{"password": "x"},
+			"connections[0].password_file: password and password_file can't both be set",
+		},
+		"unknown file variant": {
+			map[string]any{"password_file": nil, "token_file": "secrets/rabbit_password"},
+			"connections[0].token_file: unknown field",
+		},
+	}
+	for description, test := range tests {
+		setEnvTestVariables(t)
+		if description == "unset required variable" {
+			os.Unsetenv("GORMQ_TEST_QUEUE")
+		}
+		config := envTestConfig()
+		for key, value := range test.connection {
+			config.connection[key] = value
+		}
+
+		_, err := createConfig(writeTestConfig(t, config))
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected %q, got %v", description, test.expected, err)
+		}
+	}
+}
+
+func TestConfigSource_SaveJobs_KeepsVariables(t *testing.T) {
+	setEnvTestVariables(t)
+	configuration, path := loadTestConfig(t, envTestConfig())
+	configuration.Jobs[0].SetSleepTime(30)
+
+	if _, err := configuration.source.saveJobs(configuration.Jobs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	for _, expected := range []string{`"command": "php ${GORMQ_TEST_APP}/import.php"`, `"queue": "${GORMQ_TEST_QUEUE:?the queue of the import}"`, `"sleep_time": 30`} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Expected %s in the saved file:\n%s", expected, content)
+		}
+	}
+}
+
+func TestJobKiller_AddJob_Interpolation(t *testing.T) {
+	useRuntimeJobKiller(t)
+	t.Setenv("GORMQ_TEST_QUEUE", "refunds")
+	os.Unsetenv("GORMQ_TEST_UNSET")
+
+	jobs, err := jobKiller.addJob(`{"name": "refunds", "command": "true", "connection": "main", "queue": "${GORMQ_TEST_QUEUE}", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+
+	if err != nil || jobs[0].GetQueue() != "refunds" {
+		t.Fatalf("Expected the queue to be interpolated, got %v", err)
+	}
+	_, err = jobKiller.addJob(`{"name": "other", "command": "true", "connection": "main", "queue": "${GORMQ_TEST_UNSET}", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+	if err == nil || !strings.Contains(err.Error(), "queue: environment variable GORMQ_TEST_UNSET is not set") {
+		t.Errorf("Expected the unset variable to be refused, got %v", err)
+	}
+}
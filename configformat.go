@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat reads and writes a format of config file. Every format is
+// decoded into the same tree as JSON (*jsonObject, []any, json.Number,
+// string, bool and nil), so that the field names and the validation are the
+// same whatever the format.
+type configFormat struct {
+	name string
+	// decode parses the content of a config file
+	decode func(content []byte) (any, error)
+	// encode writes the tree. previous is the content of the file being
+	// replaced, if any, to keep its layout where the format allows it.
+	encode func(root any, previous []byte) ([]byte, error)
+}
+
+var (
+	jsonConfigFormat = &configFormat{name: "json", decode: decodeOrderedJSON, encode: encodeJSONConfig}
+	yamlConfigFormat = &configFormat{name: "yaml", decode: decodeYAMLConfig, encode: encodeYAMLConfig}
+	tomlConfigFormat = &configFormat{name: "toml", decode: decodeTOMLConfig, encode: encodeTOMLConfig}
+)
+
+// configFormatOf returns the format of the config file from its extension
+func configFormatOf(path string) (*configFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return jsonConfigFormat, nil
+	case ".yaml", ".yml":
+		return yamlConfigFormat, nil
+	case ".toml":
+		return tomlConfigFormat, nil
+	}
+	return nil, fmt.Errorf("unsupported config file extension %q (expected .json, .yaml, .yml or .toml)", filepath.Ext(path))
+}
+
+// convertConfig writes the config file input to output, in the format of
+// the extension of output. output must not exist yet.
+func convertConfig(input string, output string) error {
+	inputFormat, err := configFormatOf(input)
+	if err != nil {
+		return err
+	}
+	outputFormat, err := configFormatOf(output)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", input, err)
+	}
+	root, err := inputFormat.decode(content)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", input, err)
+	}
+	converted, err := outputFormat.encode(root, nil)
+	if err != nil {
+		return fmt.Errorf("failed to convert config file %s to %v: %w", input, outputFormat.name, err)
+	}
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(converted); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func encodeJSONConfig(root any, previous []byte) ([]byte, error) {
+	indent := "  "
+	if previous != nil {
+		indent = detectIndent(previous)
+	}
+	var buffer bytes.Buffer
+	if err := encodeOrderedJSON(&buffer, root, indent, 0); err != nil {
+		return nil, err
+	}
+	if previous == nil || bytes.HasSuffix(previous, []byte("\n")) {
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodeYAMLConfig(content []byte) (any, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		return nil, errors.New("the configuration is empty")
+	}
+	return yamlNodeValue(document.Content[0])
+}
+
+// yamlNodeValue converts a YAML node to the tree of a JSON config. Anchors,
+// aliases and merge keys (<<) are resolved.
+func yamlNodeValue(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return yamlNodeValue(node.Alias)
+	case yaml.MappingNode:
+		object := &jsonObject{values: make(map[string]any)}
+		var merged []*jsonObject
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, valueNode := node.Content[i], node.Content[i+1]
+			value, err := yamlNodeValue(valueNode)
+			if err != nil {
+				return nil, err
+			}
+			if key.Tag == "!!merge" {
+				switch value := value.(type) {
+				case *jsonObject:
+					merged = append(merged, value)
+				case []any:
+					for _, element := range value {
+						if elementObject, ok := element.(*jsonObject); ok {
+							merged = append(merged, elementObject)
+						}
+					}
+				default:
+					return nil, fmt.Errorf("line %d: << must merge a mapping", key.Line)
+				}
+				continue
+			}
+			object.set(key.Value, value)
+		}
+		// The keys of the mapping win over the merged ones
+		for _, mergedObject := range merged {
+			for _, key := range mergedObject.keys {
+				if _, found := object.values[key]; !found {
+					object.set(key, mergedObject.values[key])
+				}
+			}
+		}
+		return object, nil
+	case yaml.SequenceNode:
+		array := []any{}
+		for _, elementNode := range node.Content {
+			element, err := yamlNodeValue(elementNode)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, element)
+		}
+		return array, nil
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!str", "!!timestamp", "!!binary":
+			return node.Value, nil
+		case "!!null":
+			return nil, nil
+		}
+		var value any
+		if err := node.Decode(&value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		return configScalar(value, fmt.Sprintf("line %d", node.Line))
+	}
+	return nil, fmt.Errorf("line %d: unexpected YAML node", node.Line)
+}
+
+// configScalar converts a scalar decoded by a YAML or TOML parser, numbers
+// becoming json.Number as when decoding JSON
+func configScalar(value any, location string) (any, error) {
+	switch value := value.(type) {
+	case nil, string, bool:
+		return value, nil
+	case int:
+		return json.Number(strconv.Itoa(value)), nil
+	case int64:
+		return json.Number(strconv.FormatInt(value, 10)), nil
+	case uint64:
+		return json.Number(strconv.FormatUint(value, 10)), nil
+	case float64:
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return nil, fmt.Errorf("%v: %v can't be used in a config", location, value)
+		}
+		return json.Number(strconv.FormatFloat(value, 'g', -1, 64)), nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	case fmt.Stringer:
+		return value.String(), nil
+	}
+	return nil, fmt.Errorf("%v: unsupported value %v", location, value)
+}
+
+func encodeYAMLConfig(root any, previous []byte) ([]byte, error) {
+	var node *yaml.Node
+	var document yaml.Node
+	if previous != nil && yaml.Unmarshal(previous, &document) == nil && len(document.Content) > 0 {
+		// Change the previous file where it differs, to keep its comments,
+		// anchors and merge keys
+		if err := patchYAMLNode(document.Content[0], root); err != nil {
+			return nil, err
+		}
+		untagYAMLMergeKeys(&document)
+		node = &document
+	} else {
+		var err error
+		if node, err = yamlNodeOf(root); err != nil {
+			return nil, err
+		}
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func yamlNodeOf(value any) (*yaml.Node, error) {
+	switch value := value.(type) {
+	case *jsonObject:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, key := range value.keys {
+			valueNode, err := yamlNodeOf(value.values[key])
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, valueNode)
+		}
+		return node, nil
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, element := range value {
+			elementNode, err := yamlNodeOf(element)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, elementNode)
+		}
+		// Lists of scalars fit on one line, as groups usually are in JSON
+		node.Style = yaml.FlowStyle
+		for _, element := range value {
+			switch element.(type) {
+			case *jsonObject, []any:
+				node.Style = 0
+			}
+		}
+		return node, nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(value.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value.String()}, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(value)}, nil
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// untagYAMLMergeKeys drops the tag of the merge keys, which the encoder
+// would otherwise write as "!!merge <<"
+func untagYAMLMergeKeys(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!merge" {
+		node.Tag = ""
+	}
+	for _, child := range node.Content {
+		untagYAMLMergeKeys(child)
+	}
+}
+
+// patchYAMLNode changes the YAML tree to hold value, leaving alone the
+// parts that already hold it. Keys missing from a mapping are added after
+// its keys, and a key holding the value through a merge key is left to it.
+func patchYAMLNode(node *yaml.Node, value any) error {
+	current, err := yamlNodeValue(node)
+	if err != nil {
+		return err
+	}
+	if sameJSON(current, value) {
+		return nil
+	}
+	object, isObject := value.(*jsonObject)
+	array, isArray := value.([]any)
+	switch {
+	case node.Kind == yaml.MappingNode && isObject:
+		merged := current.(*jsonObject)
+		for _, key := range object.keys {
+			patched := false
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Tag != "!!merge" && node.Content[i].Value == key {
+					if err := patchYAMLNode(node.Content[i+1], object.values[key]); err != nil {
+						return err
+					}
+					patched = true
+				}
+			}
+			if patched {
+				continue
+			}
+			if mergedValue, found := merged.values[key]; found && sameJSON(mergedValue, object.values[key]) {
+				continue
+			}
+			valueNode, err := yamlNodeOf(object.values[key])
+			if err != nil {
+				return err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, valueNode)
+		}
+		return nil
+	case node.Kind == yaml.SequenceNode && isArray && len(array) >= len(node.Content):
+		for i, element := range array {
+			if i < len(node.Content) {
+				if err := patchYAMLNode(node.Content[i], element); err != nil {
+					return err
+				}
+				continue
+			}
+			elementNode, err := yamlNodeOf(element)
+			if err != nil {
+				return err
+			}
+			node.Content = append(node.Content, elementNode)
+		}
+		return nil
+	}
+	replacement, err := yamlNodeOf(value)
+	if err != nil {
+		return err
+	}
+	replacement.HeadComment, replacement.LineComment, replacement.FootComment = node.HeadComment, node.LineComment, node.FootComment
+	*node = *replacement
+	return nil
+}
+
+func decodeTOMLConfig(content []byte) (any, error) {
+	var values map[string]any
+	metadata, err := toml.Decode(string(content), &values)
+	if err != nil {
+		return nil, err
+	}
+	// TOML maps lose the order of the keys, the metadata has it. The keys
+	// of the tables of an array ([[jobs]]) are told apart by their index.
+	positions := make(map[string]int)
+	tables := make(map[string]int)
+	for position, key := range metadata.Keys() {
+		path := ""
+		for i := range key {
+			path = tomlPath(path, key[i])
+			if metadata.Type(key[:i+1]...) != "ArrayHash" {
+				continue
+			}
+			if i == len(key)-1 {
+				tables[path]++
+			}
+			if i < len(key)-1 {
+				path += fmt.Sprintf("[%d]", tables[path]-1)
+			}
+		}
+		if _, found := positions[path]; !found {
+			positions[path] = position
+		}
+	}
+	return tomlValue(values, "", positions)
+}
+
+func tomlPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "\x00" + key
+}
+
+func tomlValue(value any, path string, positions map[string]int) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		position := func(key string) int {
+			if position, found := positions[tomlPath(path, key)]; found {
+				return position
+			}
+			return math.MaxInt
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			if position(keys[i]) != position(keys[j]) {
+				return position(keys[i]) < position(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		object := &jsonObject{values: make(map[string]any)}
+		for _, key := range keys {
+			element, err := tomlValue(value[key], tomlPath(path, key), positions)
+			if err != nil {
+				return nil, err
+			}
+			object.set(key, element)
+		}
+		return object, nil
+	case []map[string]any:
+		array := []any{}
+		for i, element := range value {
+			converted, err := tomlValue(element, fmt.Sprintf("%v[%d]", path, i), positions)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, converted)
+		}
+		return array, nil
+	case []any:
+		array := []any{}
+		for _, element := range value {
+			converted, err := tomlValue(element, path, positions)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, converted)
+		}
+		return array, nil
+	}
+	return configScalar(value, strings.ReplaceAll(path, "\x00", "."))
+}
+
+// encodeTOMLConfig writes the tree as TOML: the values of the top level
+// first, then its objects as tables and its lists of objects as arrays of
+// tables. Deeper objects are written inline. TOML has no null, so keys set
+// to null are left out. The comments of a previous file are not kept.
+func encodeTOMLConfig(root any, previous []byte) ([]byte, error) {
+	object, ok := root.(*jsonObject)
+	if !ok {
+		return nil, errors.New("the configuration is not an object")
+	}
+	var buffer bytes.Buffer
+	if err := writeTOMLTable(&buffer, object, nil); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeTOMLTable(buffer *bytes.Buffer, object *jsonObject, header []string) error {
+	isTable := func(value any) bool {
+		_, ok := value.(*jsonObject)
+		return ok
+	}
+	isArrayOfTables := func(value any) bool {
+		array, ok := value.([]any)
+		if !ok || len(array) == 0 {
+			return false
+		}
+		for _, element := range array {
+			if !isTable(element) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, key := range object.keys {
+		value := object.values[key]
+		if value == nil || (header == nil && (isTable(value) || isArrayOfTables(value))) {
+			continue
+		}
+		buffer.WriteString(tomlKey(key) + " = ")
+		if err := writeTOMLValue(buffer, value); err != nil {
+			return fmt.Errorf("%v: %w", key, err)
+		}
+		buffer.WriteString("\n")
+	}
+	if header != nil {
+		return nil
+	}
+	for _, key := range object.keys {
+		value := object.values[key]
+		switch {
+		case isTable(value):
+			fmt.Fprintf(buffer, "\n[%v]\n", tomlKey(key))
+			if err := writeTOMLTable(buffer, value.(*jsonObject), []string{key}); err != nil {
+				return err
+			}
+		case isArrayOfTables(value):
+			for _, element := range value.([]any) {
+				fmt.Fprintf(buffer, "\n[[%v]]\n", tomlKey(key))
+				if err := writeTOMLTable(buffer, element.(*jsonObject), []string{key}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeTOMLValue(buffer *bytes.Buffer, value any) error {
+	switch value := value.(type) {
+	case *jsonObject:
+		buffer.WriteString("{")
+		written := 0
+		for _, key := range value.keys {
+			if value.values[key] == nil {
+				continue
+			}
+			if written > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString(" " + tomlKey(key) + " = ")
+			if err := writeTOMLValue(buffer, value.values[key]); err != nil {
+				return err
+			}
+			written++
+		}
+		if written > 0 {
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString("}")
+	case []any:
+		buffer.WriteString("[")
+		for i, element := range value {
+			if element == nil {
+				return errors.New("TOML lists can't hold null")
+			}
+			if i > 0 {
+				buffer.WriteString(", ")
+			}
+			if err := writeTOMLValue(buffer, element); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("]")
+	case json.Number:
+		// JSON numbers are valid TOML integers and floats
+		buffer.WriteString(value.String())
+	case string:
+		// and the escapes of JSON strings are valid in TOML basic strings
+		return encodeJSONScalar(buffer, value)
+	case bool:
+		buffer.WriteString(strconv.FormatBool(value))
+	default:
+		return fmt.Errorf("unsupported value %v", value)
+	}
+	return nil
+}
+
+// tomlKey quotes the key when it isn't a bare key
+func tomlKey(key string) string {
+	if key == "" {
+		return `""`
+	}
+	for _, character := range key {
+		if !(character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' ||
+			character >= '0' && character <= '9' || character == '_' || character == '-') {
+			var buffer bytes.Buffer
+			encodeJSONScalar(&buffer, key)
+			return buffer.String()
+		}
+	}
+	return key
+}
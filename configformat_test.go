@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const yamlTestConfig = `# Payments workers
+connections:
+  - name: main
+    endpoint: http://localhost:15672
+
+_defaults: &defaults
+  connection: main
+  sleep_time: 5
+  sleep_increment: 1
+  max_sleep: 60
+  min_messages: 1
+
+jobs:
+  - <<: *defaults
+    name: invoices # the busiest one
+    command: php invoices.php
+    queue: invoices
+    groups: [billing]
+  - <<: *defaults
+    name: refunds
+    command: php refunds.php
+    queue: refunds
+    sleep_time: 10
+`
+
+const tomlTestConfig = `max_concurrent = 2
+
+[[connections]]
+name = "main"
+endpoint = "http://localhost:15672"
+
+[[jobs]]
+name = "invoices"
+command = "php invoices.php"
+connection = "main"
+queue = "invoices"
+groups = ["billing"]
+sleep_time = 5
+sleep_increment = 1
+max_sleep = 60
+min_messages = 1
+
+[jobs.resource_limits]
+max_load = 4.5
+`
+
+func TestCreateConfig_YAML(t *testing.T) {
+	configuration, err := createConfig(writeTestConfig(t, testConfig{name: "config.yaml", content: yamlTestConfig}))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(configuration.Jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(configuration.Jobs))
+	}
+	invoices, refunds := configuration.Jobs[0], configuration.Jobs[1]
+	if invoices.Name != "invoices" || invoices.ConnectionName != "main" || invoices.SleepTime != 5 || !reflect.DeepEqual(invoices.Groups, []string{"billing"}) {
+		t.Errorf("Unexpected job: %+v", invoices)
+	}
+	if refunds.SleepTime != 10 || refunds.MaxSleep != 60 {
+		t.Errorf("Expected the keys of the job to win over the merged ones, got %+v", refunds)
+	}
+}
+
+func TestCreateConfig_TOML(t *testing.T) {
+	configuration, err := createConfig(writeTestConfig(t, testConfig{name: "config.toml", content: tomlTestConfig}))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if configuration.MaxConcurrent != 2 || len(configuration.Jobs) != 1 {
+		t.Fatalf("Unexpected configuration: %+v", configuration)
+	}
+	job := configuration.Jobs[0]
+	if job.Queue != "invoices" || job.ResourceLimits == nil || job.ResourceLimits.MaxLoad != 4.5 {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+}
+
+func TestCreateConfig_YAMLValidation(t *testing.T) {
+	content := strings.Replace(yamlTestConfig, "queue: refunds", "queue: refunds\n    max_sleeep: 30", 1)
+
+	_, err := createConfig(writeTestConfig(t, testConfig{name: "config.yml", content: content}))
+
+	if err == nil || !strings.Contains(err.Error(), "jobs[1].max_sleeep: unknown field") {
+		t.Errorf("Expected the unknown field to be reported with its path, got %v", err)
+	}
+}
+
+func TestCreateConfig_TOMLWrongType(t *testing.T) {
+	content := strings.Replace(tomlTestConfig, "sleep_time = 5", `sleep_time = "5"`, 1)
+
+	_, err := createConfig(writeTestConfig(t, testConfig{name: "config.toml", content: content}))
+
+	if err == nil || !strings.Contains(err.Error(), "jobs[0].sleep_time: expected a number") {
+		t.Errorf("Expected the string sleep_time to be refused, got %v", err)
+	}
+}
+
+func TestCreateConfig_UnsupportedExtension(t *testing.T) {
+	_, err := createConfig(writeTestConfig(t, testConfig{name: "config.ini", content: "jobs = []"}))
+
+	if err == nil || !strings.Contains(err.Error(), "unsupported config file extension") {
+		t.Errorf("Expected the extension to be refused, got %v", err)
+	}
+}
+
+func TestConvertConfig_RoundTrip(t *testing.T) {
+	original := writeTestConfig(t, testConfig{content: writerTestConfig})
+	dir := filepath.Dir(original)
+	steps := []string{"config.yaml", "config.toml", "config-back.json"}
+
+	input := original
+	for _, step := range steps {
+		output := filepath.Join(dir, step)
+		if err := convertConfig(input, output); err != nil {
+			t.Fatalf("Unexpected error converting to %v: %v", step, err)
+		}
+		input = output
+	}
+
+	expected, _ := decodeOrderedJSON([]byte(writerTestConfig))
+	converted, _ := os.ReadFile(input)
+	actual, err := decodeOrderedJSON(converted)
+	if err != nil || !sameJSON(expected, actual) {
+		t.Errorf("Expected the config to survive the conversions, got:\n%s", converted)
+	}
+}
+
+func TestConvertConfig_KeepsExistingOutput(t *testing.T) {
+	input := writeTestConfig(t, testConfig{name: "config.yaml", content: yamlTestConfig})
+	output := writeTestConfig(t, testConfig{name: "config.toml", content: "# mine"})
+
+	if err := convertConfig(input, output); err == nil {
+		t.Error("Expected an existing output file to be left alone")
+	}
+	if content, _ := os.ReadFile(output); string(content) != "# mine" {
+		t.Errorf("Expected the output file to be untouched, got %q", content)
+	}
+}
+
+func TestConfigSource_SaveJobs_YAMLKeepsLayout(t *testing.T) {
+	path := writeTestConfig(t, testConfig{name: "config.yaml", content: yamlTestConfig})
+	configuration, err := createConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	configuration.Jobs[0].SetSleepTime(30)
+
+	if _, err := configuration.source.saveJobs(configuration.Jobs[:1]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	for _, expected := range []string{"# Payments workers", "name: invoices # the busiest one", "_defaults: &defaults", "- <<: *defaults", "sleep_time: 30"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Expected %q in the saved file:\n%s", expected, content)
+		}
+	}
+	reloaded, err := createConfig(path)
+	if err != nil || reloaded.Jobs[0].SleepTime != 30 || reloaded.Jobs[1].SleepTime != 10 {
+		t.Errorf("Expected the saved file to load with the new value, got %v", err)
+	}
+}
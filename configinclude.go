@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// jobOrigin is where a job comes from: the file that defines it, its index
+// in the jobs of that file and the template it extends
+type jobOrigin struct {
+	File      string
+	Index     int // -1 for a job added with add-job
+	Extends   string
+	label     string      // file and JSON path of the job, for messages
+	inherited *jsonObject // values the job gets from the defaults and its templates
+}
+
+func (origin *jobOrigin) String() string {
+	if origin == nil {
+		return "unknown"
+	}
+	description := fmt.Sprintf("%v, jobs[%d]", origin.File, origin.Index)
+	if origin.Index < 0 {
+		description = "add-job"
+	}
+	if origin.Extends != "" {
+		description += ", extends " + origin.Extends
+	}
+	return description
+}
+
+// jobInheritance holds the defaults and the templates of the configuration
+type jobInheritance struct {
+	defaults  *jsonObject
+	templates map[string]*jsonObject
+}
+
+// expand returns the entry of a job with the values it inherits from the
+// defaults then from its templates (the template it extends last), and
+// those inherited values. The values of the job win.
+func (inheritance *jobInheritance) expand(entry *jsonObject) (*jsonObject, *jsonObject, error) {
+	inherited := &jsonObject{values: make(map[string]any)}
+	if inheritance != nil && inheritance.defaults != nil {
+		for _, key := range inheritance.defaults.keys {
+			inherited.set(key, inheritance.defaults.values[key])
+		}
+	}
+	var chain []*jsonObject
+	seen := make(map[string]bool)
+	extends, _ := entry.values["extends"].(string)
+	for extends != "" {
+		if seen[extends] {
+			return nil, nil, fmt.Errorf("templates extend each other in a cycle through %q", extends)
+		}
+		seen[extends] = true
+		var template *jsonObject
+		if inheritance != nil {
+			template = inheritance.templates[extends]
+		}
+		if template == nil {
+			return nil, nil, fmt.Errorf("unknown template %q", extends)
+		}
+		chain = append([]*jsonObject{template}, chain...)
+		extends, _ = template.values["extends"].(string)
+	}
+	for _, template := range chain {
+		for _, key := range template.keys {
+			if key != "extends" {
+				inherited.set(key, template.values[key])
+			}
+		}
+	}
+
+	expanded := &jsonObject{values: make(map[string]any)}
+	for _, key := range entry.keys {
+		expanded.set(key, entry.values[key])
+	}
+	for _, key := range inherited.keys {
+		if _, found := expanded.values[key]; !found {
+			expanded.set(key, inherited.values[key])
+		}
+	}
+	return expanded, inherited, nil
+}
+
+// configTree is a config file merged with the files it includes, its jobs
+// expanded with the values they inherit
+type configTree struct {
+	root        *jsonObject
+	included    map[string]string // checksum of the included files, by path
+	jobOrigins  []*jobOrigin      // of the jobs of root
+	labels      map[string]string // file and path of the included jobs and connections, by their path in root
+	inheritance *jobInheritance
+	vault       *VaultClient // nil without a vault block
+}
+
+// includableKeys are the keys an included file can set
+var includableKeys = []string{"connections", "jobs", "templates"}
+
+// loadConfigTree merges the files included by the config, then those of
+// configDir, into its connections, jobs and templates, and applies the
+// defaults and templates to the jobs. The environment variables are
+// interpolated, the encrypted values decrypted and the secret files and
+// Vault secrets read in every file. Problems are reported with the file they
+// are found in.
+func loadConfigTree(configFile string, root *jsonObject, configDir string) (*configTree, []ConfigProblem) {
+	tree := &configTree{
+		root:        &jsonObject{values: make(map[string]any)},
+		included:    make(map[string]string),
+		labels:      make(map[string]string),
+		inheritance: &jobInheritance{templates: make(map[string]*jsonObject)},
+	}
+	for _, key := range root.keys {
+		tree.root.set(key, root.values[key])
+	}
+	keys := &secretKeyLoader{path: keyFilePath(configFile)}
+	problems := interpolateConfig(root, "")
+	problems = append(problems, decryptConfig(root, "", keys)...)
+
+	type configPart struct {
+		file  string
+		label string // prefix of the paths in the file
+		root  *jsonObject
+	}
+	parts := []configPart{{file: configFile, root: root}}
+	paths, includeProblems := includedFiles(configFile, root, configDir)
+	problems = append(problems, includeProblems...)
+	for _, path := range paths {
+		label := displayPath(configFile, path) + ":"
+		content, err := os.ReadFile(path)
+		if err != nil {
+			problems = append(problems, ConfigProblem{label, fmt.Sprintf("failed to read included file: %v", err)})
+			continue
+		}
+		tree.included[path] = checksumOf(content)
+		format, err := configFormatOf(path)
+		if err != nil {
+			problems = append(problems, ConfigProblem{label, err.Error()})
+			continue
+		}
+		value, err := format.decode(content)
+		if err != nil {
+			problems = append(problems, ConfigProblem{label, fmt.Sprintf("failed to parse included file: %v", err)})
+			continue
+		}
+		fragment, ok := value.(*jsonObject)
+		if !ok {
+			problems = append(problems, ConfigProblem{label, "expected an object"})
+			continue
+		}
+		for _, problem := range checkJSONShape(fragment, reflect.TypeOf(ConfigFile{}), "") {
+			problems = append(problems, ConfigProblem{label + problem.Path, problem.Message})
+		}
+		for _, key := range fragment.keys {
+			if !strings.HasPrefix(key, "_") && !contains(includableKeys, key) {
+				problems = append(problems, ConfigProblem{label + key, "only connections, jobs and templates can be set in an included file"})
+			}
+		}
+		fragmentProblems := append(interpolateConfig(fragment, ""), decryptConfig(fragment, "", keys)...)
+		for _, problem := range fragmentProblems {
+			problems = append(problems, ConfigProblem{label + problem.Path, problem.Message})
+		}
+		parts = append(parts, configPart{file: path, label: label, root: fragment})
+	}
+
+	vaultBlock, hasVaultBlock := root.values["vault"].(*jsonObject)
+	if hasVaultBlock {
+		var vaultProblems []ConfigProblem
+		tree.vault, vaultProblems = createVaultClient(vaultBlock, configFile)
+		problems = append(problems, vaultProblems...)
+	}
+
+	var connections, jobs []any
+	for _, part := range parts {
+		partConnections, _ := part.root.values["connections"].([]any)
+		for i, connection := range partConnections {
+			if connectionObject, ok := connection.(*jsonObject); ok {
+				path := fmt.Sprintf("%vconnections[%d]", part.label, i)
+				problems = append(problems, readSecretFiles(connectionObject, path, part.file)...)
+				problems = append(problems, resolveVaultReferences(connectionObject, path, tree.vault, hasVaultBlock)...)
+			}
+			if part.label != "" {
+				tree.labels[fmt.Sprintf("connections[%d]", len(connections))] = fmt.Sprintf("%vconnections[%d]", part.label, i)
+			}
+			connections = append(connections, connection)
+		}
+		partJobs, _ := part.root.values["jobs"].([]any)
+		for i, job := range partJobs {
+			label := fmt.Sprintf("%vjobs[%d]", part.label, i)
+			if part.label != "" {
+				tree.labels[fmt.Sprintf("jobs[%d]", len(jobs))] = label
+			}
+			tree.jobOrigins = append(tree.jobOrigins, &jobOrigin{File: part.file, Index: i, label: label})
+			jobs = append(jobs, job)
+		}
+		templates, _ := part.root.values["templates"].(*jsonObject)
+		if templates == nil {
+			continue
+		}
+		for _, name := range templates.keys {
+			template, ok := templates.values[name].(*jsonObject)
+			if !ok {
+				continue
+			}
+			if _, found := tree.inheritance.templates[name]; found {
+				problems = append(problems, ConfigProblem{part.label + "templates." + name, fmt.Sprintf("template %q is defined more than once", name)})
+				continue
+			}
+			tree.inheritance.templates[name] = template
+		}
+	}
+	if connections != nil {
+		tree.root.set("connections", connections)
+	}
+
+	if defaults, ok := root.values["defaults"].(*jsonObject); ok {
+		tree.inheritance.defaults = defaults
+		for _, key := range []string{"name", "extends"} {
+			if _, found := defaults.values[key]; found {
+				problems = append(problems, ConfigProblem{"defaults." + key, fmt.Sprintf("%v can't be set in the defaults", key)})
+			}
+		}
+	}
+	for i, job := range jobs {
+		entry, ok := job.(*jsonObject)
+		if !ok {
+			continue
+		}
+		expanded, inherited, err := tree.inheritance.expand(entry)
+		if err != nil {
+			problems = append(problems, ConfigProblem{tree.jobOrigins[i].label + ".extends", err.Error()})
+			continue
+		}
+		jobs[i] = expanded
+		tree.jobOrigins[i].inherited = inherited
+		tree.jobOrigins[i].Extends, _ = entry.values["extends"].(string)
+	}
+	if jobs != nil {
+		tree.root.set("jobs", jobs)
+	}
+	return tree, problems
+}
+
+// includedFiles returns the files listed by the include directive of the
+// config, relative to its directory and with glob patterns, followed by the
+// config files of configDir in order of name
+func includedFiles(configFile string, root *jsonObject, configDir string) ([]string, []ConfigProblem) {
+	var paths []string
+	var problems []ConfigProblem
+	seen := map[string]bool{filepath.Clean(configFile): true}
+	add := func(path string) {
+		if !seen[filepath.Clean(path)] {
+			seen[filepath.Clean(path)] = true
+			paths = append(paths, path)
+		}
+	}
+
+	includes, _ := root.values["include"].([]any)
+	for i, include := range includes {
+		pattern, _ := include.(string)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			problems = append(problems, ConfigProblem{fmt.Sprintf("include[%d]", i), err.Error()})
+			continue
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			problems = append(problems, ConfigProblem{fmt.Sprintf("include[%d]", i), fmt.Sprintf("%v doesn't exist", pattern)})
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+
+	if configDir != "" {
+		entries, err := os.ReadDir(configDir)
+		if err != nil {
+			problems = append(problems, ConfigProblem{"", fmt.Sprintf("failed to read config dir: %v", err)})
+		}
+		for _, entry := range entries {
+			if _, err := configFormatOf(entry.Name()); err == nil && !entry.IsDir() {
+				add(filepath.Join(configDir, entry.Name()))
+			}
+		}
+	}
+	return paths, problems
+}
+
+// displayPath returns the path of an included file relative to the
+// directory of the config when it is in it
+func displayPath(configFile string, path string) string {
+	if relative, err := filepath.Rel(filepath.Dir(configFile), path); err == nil && !strings.HasPrefix(relative, "..") {
+		return relative
+	}
+	return path
+}
+
+// locate rewrites the paths of the problems found in the merged config to
+// the file and path the values come from
+func (tree *configTree) locate(problems []ConfigProblem) []ConfigProblem {
+	located := make([]ConfigProblem, 0, len(problems))
+	for _, problem := range problems {
+		prefix, rest, _ := strings.Cut(problem.Path, ".")
+		if label, found := tree.labels[prefix]; found {
+			problem.Path = label
+			if rest != "" {
+				problem.Path += "." + rest
+			}
+		}
+		located = append(located, problem)
+	}
+	return located
+}
+
+func contains(values []string, value string) bool {
+	for _, element := range values {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const includeTestConfig = `{
+    "include": ["teams/*.json"],
+    "connections": [{"name": "main", "endpoint": "http://localhost:15672"}],
+    "defaults": {
+        "connection": "main",
+        "sleep_time": 5,
+        "sleep_increment": 1,
+        "max_sleep": 60,
+        "min_messages": 1
+    },
+    "templates": {
+        "php": {"command": "php worker.php", "max_execution": 300},
+        "php-slow": {"extends": "php", "sleep_time": 30, "max_sleep": 300}
+    },
+    "jobs": [
+        {"name": "import", "command": "echo", "queue": "import"}
+    ]
+}
+`
+
+const includeTestFragment = `{
+    "jobs": [
+        {"name": "invoices", "extends": "php-slow", "queue": "invoices", "max_sleep": 600}
+    ]
+}
+`
+
+// includeTestFragmentName is the file of includeTestFragment, next to the
+// config
+const includeTestFragmentName = "teams/billing.json"
+
+func findConfiguredJob(t *testing.T, configuration ConfigFile, name string) *Job {
+	t.Helper()
+	for _, job := range configuration.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	t.Fatalf("Job %v not found", name)
+	return nil
+}
+
+func TestCreateConfig_DefaultsAndTemplates(t *testing.T) {
+	configPath := writeTestConfig(t, testConfig{content: includeTestConfig, files: map[string]string{includeTestFragmentName: includeTestFragment}})
+	fragmentPath := filepath.Join(filepath.Dir(configPath), includeTestFragmentName)
+
+	configuration, err := createConfig(configPath)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	importJob := findConfiguredJob(t, configuration, "import")
+	if importJob.ConnectionName != "main" || importJob.SleepTime != 5 || importJob.Command != "echo" {
+		t.Errorf("Expected the job to get the defaults, got %+v", importJob)
+	}
+	invoices := findConfiguredJob(t, configuration, "invoices")
+	if invoices.Command != "php worker.php" || invoices.MaxExecution != 300 || invoices.SleepTime != 30 || invoices.MaxSleep != 600 || invoices.SleepIncrement != 1 {
+		t.Errorf("Expected the job to get its templates over the defaults, and to keep its own values, got %+v", invoices)
+	}
+	if invoices.origin.File != fragmentPath || invoices.origin.Index != 0 || invoices.origin.Extends != "php-slow" {
+		t.Errorf("Unexpected origin: %v", invoices.origin)
+	}
+	if importJob.origin.String() != configPath+", jobs[0]" {
+		t.Errorf("Unexpected origin: %v", importJob.origin)
+	}
+}
+
+func TestCreateConfig_ConfigDir(t *testing.T) {
+	configPath := writeTestConfig(t, testConfig{content: strings.Replace(includeTestConfig, `"include": ["teams/*.json"],`, "", 1), files: map[string]string{includeTestFragmentName: includeTestFragment}})
+	previous := *configDir
+	*configDir = filepath.Join(filepath.Dir(configPath), "teams")
+	t.Cleanup(func() { *configDir = previous })
+
+	configuration, err := createConfig(configPath)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(configuration.Jobs) != 2 || findConfiguredJob(t, configuration, "invoices").Queue != "invoices" {
+		t.Errorf("Expected the jobs of the directory to be merged, got %v jobs", len(configuration.Jobs))
+	}
+}
+
+func TestCreateConfig_IncludeProblems(t *testing.T) {
+	tests := map[string]struct {
+		config   string
+		fragment string
+		expected string
+	}{
+		"problem in the fragment": {
+			includeTestConfig,
+			strings.Replace(includeTestFragment, `"max_sleep": 600`, `"max_sleep": 10`, 1),
+			"teams/billing.json:jobs[0].max_sleep: max_sleep can't be lower than sleep_time",
+		},
+		"unknown field in the fragment": {
+			includeTestConfig,
+			strings.Replace(includeTestFragment, `"queue"`, `"queu"`, 1),
+			"teams/billing.json:jobs[0].queu: unknown field",
+		},
+		"settings in the fragment": {
+			includeTestConfig,
+			`{"max_concurrent": 2}`,
+			"teams/billing.json:max_concurrent: only connections, jobs and templates",
+		},
+		"unknown template": {
+			includeTestConfig,
+			strings.Replace(includeTestFragment, `"php-slow"`, `"java"`, 1),
+			`teams/billing.json:jobs[0].extends: unknown template "java"`,
+		},
+		"template cycle": {
+			strings.Replace(includeTestConfig, `"command": "php worker.php"`, `"extends": "php-slow"`, 1),
+			includeTestFragment,
+			"cycle",
+		},
+		"missing include": {
+			strings.Replace(includeTestConfig, `"teams/*.json"`, `"teams/missing.json"`, 1),
+			includeTestFragment,
+			"include[0]: ",
+		},
+		"name in the defaults": {
+			strings.Replace(includeTestConfig, `"defaults": {`, `"defaults": {"name": "all",`, 1),
+			includeTestFragment,
+			"defaults.name: name can't be set in the defaults",
+		},
+	}
+	for description, test := range tests {
+		configPath := writeTestConfig(t, testConfig{content: test.config, files: map[string]string{includeTestFragmentName: test.fragment}})
+
+		_, err := createConfig(configPath)
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected %q, got %v", description, test.expected, err)
+		}
+	}
+}
+
+func TestConfigSource_SaveJobs_IncludedFile(t *testing.T) {
+	configPath := writeTestConfig(t, testConfig{content: includeTestConfig, files: map[string]string{includeTestFragmentName: includeTestFragment}})
+	fragmentPath := filepath.Join(filepath.Dir(configPath), includeTestFragmentName)
+	configuration, err := createConfig(configPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	findConfiguredJob(t, configuration, "invoices").SetMinMessages(10)
+
+	saved, err := configuration.source.saveJobs(configuration.Jobs)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(saved) != 1 || saved[0].Path != fragmentPath {
+		t.Errorf("Expected only the file of the job to be saved, got %v", saved)
+	}
+	content, _ := os.ReadFile(fragmentPath)
+	if !strings.Contains(string(content), `"min_messages": 10`) {
+		t.Errorf("Expected the change in the file of the job, got:\n%s", content)
+	}
+	if strings.Contains(string(content), "sleep_time") || strings.Contains(string(content), "command") {
+		t.Errorf("Expected the inherited values not to be written, got:\n%s", content)
+	}
+	if content, _ := os.ReadFile(configPath); string(content) != includeTestConfig {
+		t.Errorf("Expected the config file to be unchanged, got:\n%s", content)
+	}
+}
+
+func TestJobKiller_AddJob_Extends(t *testing.T) {
+	configuration, _ := loadTestConfig(t, testConfig{content: includeTestConfig, files: map[string]string{includeTestFragmentName: includeTestFragment}})
+	previous := configSource
+	configSource = configuration.source
+	t.Cleanup(func() { configSource = previous })
+	useRuntimeJobKiller(t)
+
+	jobs, err := jobKiller.addJob(`{"name": "refunds", "extends": "php", "queue": "refunds"}`)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	job := jobs[0]
+	if job.GetCommand() != "php worker.php" || job.SleepTime != 5 || job.origin.String() != "add-job, extends php" {
+		t.Errorf("Expected the added job to inherit, got %+v (%v)", job, job.origin)
+	}
+	if _, err := jobKiller.addJob(`{"name": "other", "extends": "java", "queue": "other"}`); err == nil {
+		t.Error("Expected an unknown template to be refused")
+	}
+}
+
+func TestCheckConfig_PreflightOfIncludedJob(t *testing.T) {
+	fragment := strings.Replace(includeTestFragment, `"queue": "invoices"`, `"queue": "invoices", "working_dir": "/no/such/dir"`, 1)
+	configPath := writeTestConfig(t, testConfig{content: includeTestConfig, files: map[string]string{includeTestFragmentName: fragment}})
+
+	if _, found := problemAt(checkConfig(configPath), "teams/billing.json:jobs[0].working_dir"); !found {
+		t.Errorf("Expected the problem to be located in the included file, got %v", checkConfig(configPath))
+	}
+}
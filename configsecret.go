@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Encrypted values of the config are written enc:<key id>:<base64 of the
+// nonce followed by the NaCl secretbox>, and decrypted at load time with the
+// key of the key file
+const encryptedPrefix = "enc:"
+
+const secretKeyFileName = "gormq.key"
+
+type secretKey struct {
+	key [32]byte
+}
+
+// keyFilePath returns the key file given with --secret-key-file, by default the
+// gormq.key file next to the config file
+func keyFilePath(configFile string) string {
+	if *secretKeyFile != "" {
+		return *secretKeyFile
+	}
+	return filepath.Join(filepath.Dir(configFile), secretKeyFileName)
+}
+
+func generateSecretKey() (*secretKey, error) {
+	key := &secretKey{}
+	if _, err := io.ReadFull(rand.Reader, key.key[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate a key: %w", err)
+	}
+	return key, nil
+}
+
+// readSecretKey reads a key file: the key encoded in base64 on one line
+func readSecretKey(path string) (*secretKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("key file %v doesn't hold a 32 bytes key in base64", path)
+	}
+	key := &secretKey{}
+	copy(key.key[:], decoded)
+	return key, nil
+}
+
+// writeSecretKey writes the key file, readable by its owner only
+func writeSecretKey(path string, key *secretKey) error {
+	content := base64.StdEncoding.EncodeToString(key.key[:]) + "\n"
+	return writeFileAtomically(path, []byte(content), 0600)
+}
+
+// id tells the keys apart, without giving anything away about them
+func (key *secretKey) id() string {
+	sum := sha256.Sum256(append([]byte("gormq key id "), key.key[:]...))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (key *secretKey) encrypt(plaintext string) (string, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", fmt.Errorf("failed to generate a nonce: %w", err)
+	}
+	sealed := secretbox.Seal(nonce[:], []byte(plaintext), &nonce, &key.key)
+	return encryptedPrefix + key.id() + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (key *secretKey) decrypt(value string) (string, error) {
+	id, encoded, found := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !found {
+		return "", errors.New("malformed encrypted value (expected enc:<key id>:<data>)")
+	}
+	if id != key.id() {
+		return "", fmt.Errorf("encrypted with key %v, the key file holds key %v", id, key.id())
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < 24+secretbox.Overhead {
+		return "", errors.New("malformed encrypted value")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	plaintext, ok := secretbox.Open(nil, sealed[24:], &nonce, &key.key)
+	if !ok {
+		return "", errors.New("the value is corrupted or wasn't encrypted with this key")
+	}
+	return string(plaintext), nil
+}
+
+func isEncrypted(value any) bool {
+	text, ok := value.(string)
+	return ok && strings.HasPrefix(text, encryptedPrefix)
+}
+
+// secretKeyLoader reads the key file the first time an encrypted value
+// needs it, so that configs without encrypted values don't need one
+type secretKeyLoader struct {
+	path   string
+	key    *secretKey
+	err    error
+	loaded bool
+}
+
+func (loader *secretKeyLoader) get() (*secretKey, error) {
+	if !loader.loaded {
+		loader.key, loader.err = readSecretKey(loader.path)
+		loader.loaded = true
+	}
+	return loader.key, loader.err
+}
+
+// decryptConfig decrypts, in place, the encrypted strings of the config
+// tree but the ones under comment keys
+func decryptConfig(value any, path string, loader *secretKeyLoader) []ConfigProblem {
+	var problems []ConfigProblem
+	decryptElement := func(element any, elementPath string) any {
+		if !isEncrypted(element) {
+			problems = append(problems, decryptConfig(element, elementPath, loader)...)
+			return element
+		}
+		key, err := loader.get()
+		if err != nil {
+			problems = append(problems, ConfigProblem{elementPath, fmt.Sprintf("can't decrypt: %v", err)})
+			return element
+		}
+		plaintext, err := key.decrypt(element.(string))
+		if err != nil {
+			problems = append(problems, ConfigProblem{elementPath, fmt.Sprintf("can't decrypt: %v", err)})
+			return element
+		}
+		return plaintext
+	}
+	switch value := value.(type) {
+	case *jsonObject:
+		for _, key := range value.keys {
+			if !strings.HasPrefix(key, "_") {
+				value.values[key] = decryptElement(value.values[key], joinPath(path, key))
+			}
+		}
+	case []any:
+		for i := range value {
+			value[i] = decryptElement(value[i], fmt.Sprintf("%v[%d]", path, i))
+		}
+	}
+	return problems
+}
+
+// resolvedJSON returns a copy of a value of the config file as loaded: its
+// environment variables interpolated and its encrypted strings decrypted.
+// What can't be resolved is kept as it is.
+func resolvedJSON(value any, loader *secretKeyLoader) any {
+	resolved := interpolatedJSON(value)
+	if isEncrypted(resolved) {
+		wrapper := []any{resolved}
+		if len(decryptConfig(wrapper, "", loader)) == 0 {
+			return wrapper[0]
+		}
+		return resolved
+	}
+	decryptConfig(resolved, "", loader)
+	return resolved
+}
+
+// encryptValue encrypts a value for the config, creating the key file when
+// there is none yet. It tells whether it created it.
+func encryptValue(configFile string, plaintext string) (string, bool, error) {
+	path := keyFilePath(configFile)
+	key, err := readSecretKey(path)
+	created := false
+	if errors.Is(err, os.ErrNotExist) {
+		if key, err = generateSecretKey(); err != nil {
+			return "", false, err
+		}
+		if err := writeSecretKey(path, key); err != nil {
+			return "", false, fmt.Errorf("failed to write key file %v: %w", path, err)
+		}
+		created = true
+	} else if err != nil {
+		return "", false, err
+	}
+	encrypted, err := key.encrypt(plaintext)
+	return encrypted, created, err
+}
+
+// rotateKey encrypts the values of the config file and of the files it
+// includes with a new key, which replaces the one of the key file. The
+// previous key file is kept as <key file>.bak-<timestamp>. It returns the
+// config files rewritten.
+func rotateKey(configFile string) ([]string, error) {
+	keyPath := keyFilePath(configFile)
+	oldKey, err := readSecretKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := generateSecretKey()
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := configFormatOf(configFile)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", configFile, err)
+	}
+	root, err := format.decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", configFile, err)
+	}
+	files := []string{configFile}
+	if object, ok := interpolatedJSON(root).(*jsonObject); ok {
+		included, problems := includedFiles(configFile, object, *configDir)
+		if len(problems) > 0 {
+			return nil, ConfigErrors(problems)
+		}
+		files = append(files, included...)
+	}
+
+	// Every value is encrypted again before anything is written, so that a
+	// value that can't be decrypted leaves everything as it was
+	type rewrite struct {
+		path     string
+		previous []byte
+		updated  []byte
+		perm     os.FileMode
+	}
+	var rewrites []rewrite
+	var problems []ConfigProblem
+	for _, path := range files {
+		label := ""
+		if path != configFile {
+			label = displayPath(configFile, path) + ":"
+		}
+		fileFormat, err := configFormatOf(path)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+		tree, err := fileFormat.decode(previous)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		count := 0
+		reencrypt := func(value string, valuePath string) string {
+			plaintext, err := oldKey.decrypt(value)
+			if err == nil {
+				value, err = newKey.encrypt(plaintext)
+			}
+			if err != nil {
+				problems = append(problems, ConfigProblem{label + valuePath, fmt.Sprintf("can't decrypt: %v", err)})
+			}
+			count++
+			return value
+		}
+		replaceEncrypted(tree, "", reencrypt)
+		if count == 0 {
+			continue
+		}
+		updated, err := fileFormat.encode(tree, previous)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, rewrite{path: path, previous: previous, updated: updated})
+	}
+	if len(problems) > 0 {
+		return nil, ConfigErrors(problems)
+	}
+
+	// The config files are written first and the key file last, in one
+	// rename. If a step fails, the config files already written get their
+	// previous content back, so that the values always match the key file.
+	timestamp := time.Now().Format("20060102150405")
+	var written []string
+	var done []rewrite
+	restore := func(cause error) error {
+		for _, file := range done {
+			if err := writeFileAtomically(file.path, file.previous, file.perm); err != nil {
+				return fmt.Errorf("%w; restoring %s failed too, restore it from %s.bak-%s: %v", cause, file.path, file.path, timestamp, err)
+			}
+		}
+		return cause
+	}
+	for _, file := range rewrites {
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return nil, restore(err)
+		}
+		file.perm = info.Mode().Perm()
+		if err := os.WriteFile(file.path+".bak-"+timestamp, file.previous, file.perm); err != nil {
+			return nil, restore(fmt.Errorf("failed to back up config file %s: %w", file.path, err))
+		}
+		if err := writeFileAtomically(file.path, file.updated, file.perm); err != nil {
+			return nil, restore(fmt.Errorf("failed to write config file %s: %w", file.path, err))
+		}
+		done = append(done, file)
+		written = append(written, file.path)
+	}
+	keyContent, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, restore(fmt.Errorf("failed to read key file %v: %w", keyPath, err))
+	}
+	if err := os.WriteFile(keyPath+".bak-"+timestamp, keyContent, 0600); err != nil {
+		return nil, restore(fmt.Errorf("failed to back up key file %v: %w", keyPath, err))
+	}
+	if err := writeSecretKey(keyPath, newKey); err != nil {
+		return nil, restore(fmt.Errorf("failed to write key file %v: %w", keyPath, err))
+	}
+	return written, nil
+}
+
+// replaceEncrypted replaces, in place, the encrypted strings of the tree
+// with what replace returns for them
+func replaceEncrypted(value any, path string, replace func(value string, path string) string) {
+	switch value := value.(type) {
+	case *jsonObject:
+		for _, key := range value.keys {
+			if isEncrypted(value.values[key]) {
+				value.values[key] = replace(value.values[key].(string), joinPath(path, key))
+			} else if !strings.HasPrefix(key, "_") {
+				replaceEncrypted(value.values[key], joinPath(path, key), replace)
+			}
+		}
+	case []any:
+		for i := range value {
+			elementPath := fmt.Sprintf("%v[%d]", path, i)
+			if isEncrypted(value[i]) {
+				value[i] = replace(value[i].(string), elementPath)
+			} else {
+				replaceEncrypted(value[i], elementPath, replace)
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretKey_EncryptDecrypt(t *testing.T) {
+	key, _ := generateSecretKey()
+	otherKey, _ := generateSecretKey()
+
+	encrypted, err := key.encrypt("s3cret")
+
+	if err != nil || !strings.HasPrefix(encrypted, "enc:"+key.id()+":") {
+		t.Fatalf("Unexpected encrypted value %q (%v)", encrypted, err)
+	}
+	if plaintext, err := key.decrypt(encrypted); err != nil || plaintext != "s3cret" {
+		t.Errorf("Expected s3cret, got %q (%v)", plaintext, err)
+	}
+	if again, _ := key.encrypt("s3cret"); again == encrypted {
+		t.Error("Expected every encryption to use a new nonce")
+	}
+	if _, err := otherKey.decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "encrypted with key "+key.id()) {
+		t.Errorf("Expected the other key to be named, got %v", err)
+	}
+	tampered := encrypted[:len(encrypted)-4] + "AAA="
+	for _, value := range []string{"enc:nokey", "enc:" + key.id() + ":!!", tampered} {
+		if _, err := key.decrypt(value); err == nil {
+			t.Errorf("Expected %q to be refused", value)
+		}
+	}
+}
+
+// secretTestConfig returns a config with an encrypted password and queue,
+// and the key of its key file
+func secretTestConfig(t *testing.T) (testConfig, *secretKey) {
+	t.Helper()
+	key, err := generateSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := key.encrypt("s3cret")
+	queue, _ := key.encrypt("imports")
+	return testConfig{
+		connection: map[string]any{"username": "worker", "password": password},
+		job:        map[string]any{"name": "import", "queue": queue},
+		root:       map[string]any{},
+		files:      map[string]string{secretKeyFileName: base64.StdEncoding.EncodeToString(key.key[:]) + "\n"},
+	}, key
+}
+
+func TestCreateConfig_EncryptedValues(t *testing.T) {
+	config, _ := secretTestConfig(t)
+
+	configuration, err := createConfig(writeTestConfig(t, config))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if configuration.ConnectionConfigs[0].Password != "s3cret" || configuration.Jobs[0].Queue != "imports" {
+		t.Errorf("Expected the values to be decrypted, got %q and %q", configuration.ConnectionConfigs[0].Password, configuration.Jobs[0].Queue)
+	}
+}
+
+func TestCreateConfig_DecryptionErrors(t *testing.T) {
+	config, _ := secretTestConfig(t)
+	path := writeTestConfig(t, config)
+	otherKey, _ := generateSecretKey()
+	writeSecretKey(filepath.Join(filepath.Dir(path), secretKeyFileName), otherKey)
+
+	_, err := createConfig(path)
+
+	for _, expected := range []string{"connections[0].password: can't decrypt: encrypted with key", "jobs[0].queue: can't decrypt"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q, got %v", expected, err)
+		}
+	}
+
+	os.Remove(filepath.Join(filepath.Dir(path), secretKeyFileName))
+	if _, err := createConfig(path); err == nil || !strings.Contains(err.Error(), "connections[0].password: can't decrypt: failed to read key file") {
+		t.Errorf("Expected the missing key file to be reported, got %v", err)
+	}
+}
+
+func TestEncryptValue_CreatesKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	encrypted, created, err := encryptValue(path, "s3cret")
+
+	if err != nil || !created {
+		t.Fatalf("Expected the key file to be created, got %v", err)
+	}
+	keyPath := filepath.Join(filepath.Dir(path), secretKeyFileName)
+	info, err := os.Stat(keyPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a key file readable by its owner only, got %v (%v)", info, err)
+	}
+	key, _ := readSecretKey(keyPath)
+	if plaintext, err := key.decrypt(encrypted); err != nil || plaintext != "s3cret" {
+		t.Errorf("Expected the value to be encrypted with the key file, got %q (%v)", plaintext, err)
+	}
+	if again, created, _ := encryptValue(path, "s3cret"); created || !strings.HasPrefix(again, "enc:"+key.id()+":") {
+		t.Errorf("Expected the existing key to be used, got %q", again)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	config, oldKey := secretTestConfig(t)
+	token, _ := oldKey.encrypt("t0ken")
+	config.root["include"] = []string{"teams/*.json"}
+	config.files["teams/billing.json"] = `{"connections": [{"name": "billing", "endpoint": "http://localhost:15672", "username": "billing", "password": "` + token + `"}]}`
+	config.files["teams/plain.json"] = `{"templates": {}}`
+	path := writeTestConfig(t, config)
+	dir := filepath.Dir(path)
+	fragmentPath := filepath.Join(dir, "teams", "billing.json")
+
+	written, err := rotateKey(path)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(written) != 2 || written[0] != path || written[1] != fragmentPath {
+		t.Errorf("Expected the files with encrypted values to be written, got %v", written)
+	}
+	newKey, _ := readSecretKey(filepath.Join(dir, secretKeyFileName))
+	if newKey.id() == oldKey.id() {
+		t.Fatal("Expected a new key")
+	}
+	if content, _ := os.ReadFile(path); strings.Contains(string(content), "enc:"+oldKey.id()) || !strings.Contains(string(content), "enc:"+newKey.id()) {
+		t.Errorf("Expected the values to be encrypted with the new key, got:\n%s", content)
+	}
+	configuration, err := createConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if configuration.ConnectionConfigs[0].Password != "s3cret" || configuration.ConnectionConfigs[1].Password != "t0ken" {
+		t.Errorf("Expected the same values after the rotation, got %+v", configuration.ConnectionConfigs)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, secretKeyFileName+".bak-*"))
+	if len(backups) != 1 {
+		t.Errorf("Expected the previous key file to be kept, got %v", backups)
+	}
+}
+
+func TestRotateKey_KeepsEverythingOnError(t *testing.T) {
+	config, _ := secretTestConfig(t)
+	otherKey, _ := generateSecretKey()
+	config.connection["username"], _ = otherKey.encrypt("x")
+	path := writeTestConfig(t, config)
+	content, _ := os.ReadFile(path)
+	keyContent, _ := os.ReadFile(filepath.Join(filepath.Dir(path), secretKeyFileName))
+
+	_, err := rotateKey(path)
+
+	if err == nil || !strings.Contains(err.Error(), "connections[0].username: can't decrypt") {
+		t.Errorf("Expected the value that can't be decrypted to be named, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(content) {
+		t.Error("Expected the config file to be unchanged")
+	}
+	if after, _ := os.ReadFile(filepath.Join(filepath.Dir(path), secretKeyFileName)); string(after) != string(keyContent) {
+		t.Error("Expected the key file to be unchanged")
+	}
+}
+
+func TestRotateKey_RestoresFilesOnWriteError(t *testing.T) {
+	config, oldKey := secretTestConfig(t)
+	token, _ := oldKey.encrypt("t0ken")
+	fragment := `{"connections": [{"name": "billing", "endpoint": "http://localhost:15672", "username": "billing", "password": "` + token + `"}]}`
+	config.root["include"] = []string{"teams/*.json"}
+	config.files["teams/billing.json"] = fragment
+	path := writeTestConfig(t, config)
+	dir := filepath.Dir(path)
+	fragmentPath := filepath.Join(dir, "teams", "billing.json")
+	content, _ := os.ReadFile(path)
+	keyContent, _ := os.ReadFile(filepath.Join(dir, secretKeyFileName))
+	// The backup of the fragment can't be written, after the config file was
+	now := time.Now()
+	for seconds := 0; seconds < 3; seconds++ {
+		os.Mkdir(fragmentPath+".bak-"+now.Add(time.Duration(seconds)*time.Second).Format("20060102150405"), 0755)
+	}
+
+	_, err := rotateKey(path)
+
+	if err == nil || !strings.Contains(err.Error(), "failed to back up config file "+fragmentPath) {
+		t.Fatalf("Expected the failed backup to be reported, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(content) {
+		t.Errorf("Expected the config file to be restored, got:\n%s", after)
+	}
+	if after, _ := os.ReadFile(fragmentPath); string(after) != string(fragment) {
+		t.Error("Expected the fragment to be unchanged")
+	}
+	if after, _ := os.ReadFile(filepath.Join(dir, secretKeyFileName)); string(after) != string(keyContent) {
+		t.Error("Expected the key file to be unchanged")
+	}
+	if _, err := createConfig(path); err != nil {
+		t.Errorf("Expected the config to load with the key file, got %v", err)
+	}
+}
+
+func TestConfigSource_SaveJobs_KeepsEncryptedValues(t *testing.T) {
+	config, _ := secretTestConfig(t)
+	configuration, path := loadTestConfig(t, config)
+	before, _ := os.ReadFile(path)
+	configuration.Jobs[0].SetSleepTime(30)
+
+	if _, err := configuration.source.saveJobs(configuration.Jobs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), `"imports"`) || !strings.Contains(string(content), `"sleep_time": 30`) {
+		t.Errorf("Expected the queue to stay encrypted, got:\n%s", content)
+	}
+	queue := strings.Split(strings.Split(string(before), `"queue": "`)[1], `"`)[0]
+	if !strings.Contains(string(content), queue) {
+		t.Errorf("Expected the encrypted queue to be left as written, got:\n%s", content)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigSource is the config file the jobs were loaded from, with the
+// checksum of its content at that time
+type ConfigSource struct {
+	Path        string
+	Checksum    string
+	Included    map[string]string // checksum of the included files, by path
+	inheritance *jobInheritance
+	mu          sync.Mutex // serialises the writes to the files
+}
+
+// SavedFile is a config file written by saveJobs
+type SavedFile struct {
+	Path       string
+	BackupPath string
+}
+
+var configSource *ConfigSource
+
+func checksumOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// getRuntimeConfig returns the fields of the job that can be changed at
+// runtime, by their name in the config file
+func (job *Job) getRuntimeConfig() map[string]any {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return map[string]any{
+		"min_messages":          job.MinMessages,
+		"sleep_time":            job.SleepTime,
+		"sleep_increment":       job.SleepIncrement,
+		"max_sleep":             job.MaxSleep,
+		"max_execution":         job.MaxExecution,
+		"command":               job.Command,
+		"working_dir":           job.WorkingDir,
+		"user":                  job.UserId,
+		"queue":                 job.Queue,
+		"connection":            job.ConnectionName,
+		"groups":                job.Groups,
+		"error_log_path":        job.ErrorLogPath,
+		"error_log_max_kb_size": job.ErrorLogMaxKBSize,
+		"error_log_max_files":   job.ErrorLogMaxFiles,
+	}
+}
+
+// saveJobs writes the runtime values of the jobs back into the files that
+// define them, after copying each to a timestamped backup. Jobs added with
+// add-job are appended to the jobs of the config file. Spawned copies of a
+// job share its entry, which gets the values of the first copy, and values
+// equal to the ones the job inherits from the defaults or its template are
+// not written. A file is left alone if it changed on disk since it was
+// loaded or saved. It returns the files that changed.
+func (source *ConfigSource) saveJobs(jobs []*Job) ([]SavedFile, error) {
+	if source == nil {
+		return nil, errors.New("no config file loaded")
+	}
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	jobsByFile := make(map[string][]*Job)
+	for _, job := range jobs {
+		path := source.Path
+		if job.origin != nil && job.origin.Index >= 0 {
+			path = job.origin.File
+		}
+		jobsByFile[path] = append(jobsByFile[path], job)
+	}
+	paths := make([]string, 0, len(jobsByFile))
+	for path := range jobsByFile {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	secrets := &secretKeyLoader{path: keyFilePath(source.Path)}
+	var saved []SavedFile
+	for _, path := range paths {
+		checksum := source.Checksum
+		if path != source.Path {
+			checksum = source.Included[path]
+		}
+		backupPath, newChecksum, err := saveJobsToFile(path, checksum, jobsByFile[path], secrets)
+		if err != nil {
+			return saved, err
+		}
+		if backupPath == "" {
+			continue
+		}
+		if path == source.Path {
+			source.Checksum = newChecksum
+		} else {
+			source.Included[path] = newChecksum
+		}
+		saved = append(saved, SavedFile{Path: path, BackupPath: backupPath})
+	}
+	return saved, nil
+}
+
+// saveJobsToFile writes the jobs in the config file at path, checking first
+// that its content still has the checksum. It returns the path of the
+// backup and the new checksum, no backup meaning that the file already had
+// the values of the jobs. Encrypted values are compared to the values of
+// the jobs once decrypted with the key of secrets.
+func saveJobsToFile(path string, checksum string, jobs []*Job, secrets *secretKeyLoader) (string, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if checksumOf(content) != checksum {
+		return "", "", fmt.Errorf("config file %s changed on disk since it was loaded, not overwriting it", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", err
+	}
+	format, err := configFormatOf(path)
+	if err != nil {
+		return "", "", err
+	}
+	root, err := format.decode(content)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	entries, err := jobEntriesOf(root)
+	if err != nil {
+		return "", "", fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	sortedJobs := append([]*Job{}, jobs...)
+	sort.Slice(sortedJobs, func(i, j int) bool { return sortedJobs[i].Name < sortedJobs[j].Name })
+	// The values written for each job, by base name
+	written := make(map[string]map[string]any)
+	for _, job := range sortedJobs {
+		baseName := job.getBaseName()
+		if written[baseName] != nil {
+			// A later copy of a spawned job, sharing the entry of the first
+			continue
+		}
+		entry, found := entries[baseName]
+		if !found && job.definition != nil {
+			// Added with add-job
+			entry, err = appendJobEntry(root, job.definition)
+			if err != nil {
+				return "", "", fmt.Errorf("job %q: %w", baseName, err)
+			}
+			entries[baseName], found = entry, true
+		}
+		if !found {
+			return "", "", fmt.Errorf("job %q not found in config file %s", baseName, path)
+		}
+		var inherited *jsonObject
+		if job.origin != nil {
+			inherited = job.origin.inherited
+		}
+		config := job.getRuntimeConfig()
+		if err := entry.merge(config, inherited, secrets); err != nil {
+			return "", "", fmt.Errorf("job %q: %w", baseName, err)
+		}
+		written[baseName] = config
+	}
+
+	if original, err := format.decode(content); err == nil && sameJSON(original, root) {
+		// Nothing to change
+		clearSavedOverrides(jobs, written)
+		return "", checksum, nil
+	}
+	updated, err := format.encode(root, content)
+	if err != nil {
+		return "", "", err
+	}
+	backupPath, err := writeBackup(path, content, info.Mode().Perm())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to back up config file %s: %w", path, err)
+	}
+	if err := writeFileAtomically(path, updated, info.Mode().Perm()); err != nil {
+		return "", "", fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+	clearSavedOverrides(jobs, written)
+	return backupPath, checksumOf(updated), nil
+}
+
+// clearSavedOverrides forgets the overrides of the jobs once the config
+// file has their values. A copy of a spawned job tuned apart from the first
+// one keeps the overrides the file doesn't have.
+func clearSavedOverrides(jobs []*Job, written map[string]map[string]any) {
+	for _, job := range jobs {
+		config, values := job.getRuntimeConfig(), written[job.getBaseName()]
+		stateStore.clearOverrides(job.Name, func(property string) bool {
+			value, found := values[property]
+			return found && reflect.DeepEqual(value, config[property])
+		})
+	}
+}
+
+// writeBackup writes the content to a new <path>.bak-<timestamp>-<random>
+// file, so that two saves in the same second never share a backup
+func writeBackup(path string, content []byte, perm os.FileMode) (string, error) {
+	backupFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".bak-"+time.Now().Format("20060102150405")+"-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = backupFile.Write(content)
+	if closeErr := backupFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(backupFile.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(backupFile.Name())
+		return "", err
+	}
+	return backupFile.Name(), nil
+}
+
+// writeFileAtomically writes to a temporary file then renames it over path,
+// so that a crash never leaves a truncated file
+func writeFileAtomically(path string, content []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// jsonObject is a JSON object that keeps the order of its keys, so that the
+// config file can be rewritten without reshuffling it or losing its _
+// comment keys
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func (object *jsonObject) set(key string, value any) {
+	if _, found := object.values[key]; !found {
+		object.keys = append(object.keys, key)
+	}
+	object.values[key] = value
+}
+
+// merge sets the values in the object. Values equal to the ones already
+// there are left as written. Values missing from the object are not added
+// when equal to the inherited ones, or when zero and not inherited.
+func (object *jsonObject) merge(values map[string]any, inherited *jsonObject, secrets *secretKeyLoader) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		content, err := json.Marshal(values[key])
+		if err != nil {
+			return err
+		}
+		newValue, err := decodeOrderedJSON(content)
+		if err != nil {
+			return err
+		}
+		// A value written with environment variables or encrypted is kept
+		// while it gives the same value
+		current, found := object.values[key]
+		if found && (sameJSON(current, newValue) || sameJSON(resolvedJSON(current, secrets), newValue)) {
+			continue
+		}
+		if !found {
+			var inheritedValue any
+			isInherited := false
+			if inherited != nil {
+				inheritedValue, isInherited = inherited.values[key]
+			}
+			if isInherited && sameJSON(inheritedValue, newValue) || !isInherited && isZeroJSON(newValue) {
+				continue
+			}
+		}
+		object.set(key, newValue)
+	}
+	return nil
+}
+
+// jobEntriesOf returns the objects of the jobs array of the config, by name
+func jobEntriesOf(root any) (map[string]*jsonObject, error) {
+	object, ok := root.(*jsonObject)
+	if !ok {
+		return nil, errors.New("the configuration is not a JSON object")
+	}
+	jobs, ok := object.values["jobs"].([]any)
+	if !ok {
+		return nil, errors.New("the configuration has no jobs array")
+	}
+	entries := make(map[string]*jsonObject)
+	for _, value := range jobs {
+		if entry, ok := value.(*jsonObject); ok {
+			if name, ok := entry.values["name"].(string); ok {
+				entries[name] = entry
+			}
+		}
+	}
+	return entries, nil
+}
+
+// appendJobEntry adds the JSON definition of a job to the jobs of the config
+func appendJobEntry(root any, definition []byte) (*jsonObject, error) {
+	value, err := decodeOrderedJSON(definition)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := value.(*jsonObject)
+	if !ok {
+		return nil, errors.New("the job definition is not a JSON object")
+	}
+	object := root.(*jsonObject)
+	object.values["jobs"] = append(object.values["jobs"].([]any), entry)
+	return entry, nil
+}
+
+func decodeOrderedJSON(content []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	value, err := decodeOrderedValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the configuration")
+	}
+	return value, nil
+}
+
+func decodeOrderedValue(decoder *json.Decoder) (any, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delimiter, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+	switch delimiter {
+	case '{':
+		object := &jsonObject{values: make(map[string]any)}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object.set(keyToken.(string), value)
+		}
+		_, err = decoder.Token()
+		return object, err
+	case '[':
+		array := []any{}
+		for decoder.More() {
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = decoder.Token()
+		return array, err
+	}
+	return nil, fmt.Errorf("unexpected %v", delimiter)
+}
+
+func encodeOrderedJSON(buffer *bytes.Buffer, value any, indent string, depth int) error {
+	switch value := value.(type) {
+	case *jsonObject:
+		if len(value.keys) == 0 {
+			buffer.WriteString("{}")
+			return nil
+		}
+		buffer.WriteString("{\n")
+		for i, key := range value.keys {
+			buffer.WriteString(strings.Repeat(indent, depth+1))
+			if err := encodeJSONScalar(buffer, key); err != nil {
+				return err
+			}
+			buffer.WriteString(": ")
+			if err := encodeOrderedJSON(buffer, value.values[key], indent, depth+1); err != nil {
+				return err
+			}
+			if i < len(value.keys)-1 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString("\n")
+		}
+		buffer.WriteString(strings.Repeat(indent, depth) + "}")
+	case []any:
+		if len(value) == 0 {
+			buffer.WriteString("[]")
+			return nil
+		}
+		buffer.WriteString("[\n")
+		for i, element := range value {
+			buffer.WriteString(strings.Repeat(indent, depth+1))
+			if err := encodeOrderedJSON(buffer, element, indent, depth+1); err != nil {
+				return err
+			}
+			if i < len(value)-1 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString("\n")
+		}
+		buffer.WriteString(strings.Repeat(indent, depth) + "]")
+	default:
+		return encodeJSONScalar(buffer, value)
+	}
+	return nil
+}
+
+func encodeJSONScalar(buffer *bytes.Buffer, value any) error {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	buffer.Write(bytes.TrimRight(encoded.Bytes(), "\n"))
+	return nil
+}
+
+func sameJSON(a any, b any) bool {
+	var encodedA, encodedB bytes.Buffer
+	if encodeOrderedJSON(&encodedA, a, "", 0) != nil || encodeOrderedJSON(&encodedB, b, "", 0) != nil {
+		return false
+	}
+	if numberA, ok := a.(json.Number); ok {
+		if numberB, ok := b.(json.Number); ok {
+			floatA, errA := numberA.Float64()
+			floatB, errB := numberB.Float64()
+			return errA == nil && errB == nil && floatA == floatB
+		}
+	}
+	return bytes.Equal(encodedA.Bytes(), encodedB.Bytes())
+}
+
+func isZeroJSON(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case json.Number:
+		number, err := value.Float64()
+		return err == nil && number == 0
+	case string:
+		return value == ""
+	case bool:
+		return !value
+	case []any:
+		return len(value) == 0
+	case *jsonObject:
+		return len(value.keys) == 0
+	}
+	return false
+}
+
+// detectIndent returns the indentation of the first indented line of the
+// content, to write the file back the way it was
+func detectIndent(content []byte) string {
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const writerTestConfig = `{
+    "connections": [
+        {"name": "main", "endpoint": "http://localhost:15672", "_team": "payments"}
+    ],
+    "jobs": [
+        {
+            "name": "job1",
+            "command": "echo a && echo b",
+            "connection": "main",
+            "queue": "first",
+            "sleep_time": 10,
+            "sleep_increment": 0,
+            "max_sleep": 60,
+            "min_messages": 0,
+            "_comment": "kept as is"
+        },
+        {
+            "name": "job2",
+            "command": "echo",
+            "connection": "main",
+            "queue": "second",
+            "sleep_time": 5,
+            "sleep_increment": 0,
+            "max_sleep": 60,
+            "min_messages": 0,
+            "spawn": 2
+        }
+    ]
+}
+`
+
+func TestConfigSource_SaveJobs(t *testing.T) {
+	configuration, path := loadTestConfig(t, testConfig{content: writerTestConfig})
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	job := configuration.Jobs[0]
+	job.SetSleepTime(30)
+	job.SetMinMessages(4)
+
+	saved, err := configuration.source.saveJobs([]*Job{job})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backupPath := saved[0].BackupPath
+
+	content, _ := os.ReadFile(path)
+	expected := strings.Replace(writerTestConfig, `"sleep_time": 10,`, `"sleep_time": 30,`, 1)
+	expected = strings.Replace(expected, `"min_messages": 0,`, `"min_messages": 4,`, 1)
+	expected = strings.Replace(expected, `{"name": "main", "endpoint": "http://localhost:15672", "_team": "payments"}`, `{
+            "name": "main",
+            "endpoint": "http://localhost:15672",
+            "_team": "payments"
+        }`, 1)
+	if string(content) != expected {
+		t.Errorf("Unexpected config file:\n%s", content)
+	}
+	backup, err := os.ReadFile(backupPath)
+	if err != nil || string(backup) != writerTestConfig {
+		t.Errorf("Expected the backup to hold the previous file, got %q (%v)", backup, err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the permissions to be kept, got %v", info.Mode().Perm())
+	}
+
+	reloaded, err := createConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	if reloaded.Jobs[0].SleepTime != 30 || reloaded.Jobs[0].MinMessages != 4 {
+		t.Errorf("Expected the saved values to be loaded, got %+v", reloaded.Jobs[0])
+	}
+}
+
+func TestConfigSource_SaveJobs_SpawnedJobs(t *testing.T) {
+	configuration, path := loadTestConfig(t, testConfig{content: writerTestConfig})
+	for _, job := range configuration.Jobs {
+		if job.Name == "job2_0" {
+			job.SetSleepTime(8)
+		}
+	}
+
+	if _, err := configuration.source.saveJobs(configuration.Jobs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	reloaded, _ := createConfig(path)
+	for _, job := range reloaded.Jobs {
+		if job.getBaseName() == "job2" && job.SleepTime != 8 {
+			t.Errorf("Expected %v to have sleep_time 8, got %d", job.Name, job.SleepTime)
+		}
+	}
+}
+
+func TestConfigSource_SaveJobs_ClearsOverridesOnceWritten(t *testing.T) {
+	store := useStateStore(t)
+	configuration, _ := loadTestConfig(t, testConfig{content: writerTestConfig})
+	for _, job := range configuration.Jobs {
+		store.recordOverride(job.Name, "sleep_time", "8")
+	}
+
+	// The unknown job fails the save after job1 was merged
+	if _, err := configuration.source.saveJobs([]*Job{configuration.Jobs[0], createTestJob("other", nil)}); err == nil {
+		t.Fatal("Expected an error for a job missing from the file")
+	}
+	if store.Jobs["job1"].Overrides == nil {
+		t.Error("Expected the overrides to be kept when the file isn't written")
+	}
+
+	if _, err := configuration.source.saveJobs(configuration.Jobs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, job := range configuration.Jobs {
+		if store.Jobs[job.Name].Overrides != nil {
+			t.Errorf("Expected the overrides of %v to be cleared, got %v", job.Name, store.Jobs[job.Name].Overrides)
+		}
+	}
+}
+
+func TestConfigSource_SaveJobs_KeepsOverridesOfCopiesTunedApart(t *testing.T) {
+	store := useStateStore(t)
+	configuration, _ := loadTestConfig(t, testConfig{content: writerTestConfig})
+	for _, job := range configuration.Jobs {
+		switch job.Name {
+		case "job2_0":
+			job.SetSleepTime(8)
+			store.recordOverride(job.Name, "sleep_time", "8")
+		case "job2_1":
+			job.SetSleepTime(9)
+			job.SetMinMessages(3)
+			store.recordOverride(job.Name, "sleep_time", "9")
+			store.recordOverride(job.Name, "min_messages", "3")
+			store.recordOverride(job.Name, "max_sleep", "60")
+		}
+	}
+
+	if _, err := configuration.source.saveJobs(configuration.Jobs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if overrides := store.Jobs["job2_0"].Overrides; overrides != nil {
+		t.Errorf("Expected the overrides of the copy written to be cleared, got %v", overrides)
+	}
+	if overrides := store.Jobs["job2_1"].Overrides; len(overrides) != 2 || overrides["sleep_time"] != "9" || overrides["min_messages"] != "3" {
+		t.Errorf("Expected the values the file doesn't have to be kept, got %v", overrides)
+	}
+}
+
+func TestConfigSource_SaveJobs_BackupsAreNotOverwritten(t *testing.T) {
+	configuration, _ := loadTestConfig(t, testConfig{content: writerTestConfig})
+	job := configuration.Jobs[0]
+
+	var backups []string
+	for _, sleepTime := range []int{20, 30} {
+		job.SetSleepTime(sleepTime)
+		saved, err := configuration.source.saveJobs([]*Job{job})
+		if err != nil || len(saved) != 1 {
+			t.Fatalf("Unexpected result: %v (%v)", saved, err)
+		}
+		backups = append(backups, saved[0].BackupPath)
+	}
+
+	if backups[0] == backups[1] {
+		t.Fatalf("Expected two backups, got %v", backups)
+	}
+	if first, err := os.ReadFile(backups[0]); err != nil || string(first) != writerTestConfig {
+		t.Errorf("Expected the first backup to hold the original file, got %q (%v)", first, err)
+	}
+}
+
+func TestConfigSource_SaveJobs_ChangedOnDisk(t *testing.T) {
+	configuration, path := loadTestConfig(t, testConfig{content: writerTestConfig})
+	edited := strings.Replace(writerTestConfig, `"sleep_time": 5`, `"sleep_time": 6`, 1)
+	os.WriteFile(path, []byte(edited), 0640)
+
+	_, err := configuration.source.saveJobs(configuration.Jobs)
+
+	if err == nil || !strings.Contains(err.Error(), "changed on disk") {
+		t.Errorf("Expected the write to be refused, got %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if string(content) != edited {
+		t.Error("Expected the file on disk to be left alone")
+	}
+}
+
+func TestConfigSource_SaveJobs_UnknownJob(t *testing.T) {
+	configuration, _ := loadTestConfig(t, testConfig{content: writerTestConfig})
+
+	_, err := configuration.source.saveJobs([]*Job{createTestJob("other", nil)})
+
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected an error for a job missing from the file, got %v", err)
+	}
+}
+
+func TestCreateResponse_UpdateJobPersist(t *testing.T) {
+	configuration, path := loadTestConfig(t, testConfig{content: writerTestConfig})
+	previous := configSource
+	configSource = configuration.source
+	t.Cleanup(func() { configSource = previous })
+	jobKiller = JobKiller{Jobs: configuration.Jobs}
+
+	response := createResponse("update-job job1 max_sleep 120 --persist")
+
+	if !strings.Contains(response, "saved to "+path) {
+		t.Errorf("Unexpected response: %s", response)
+	}
+	reloaded, _ := createConfig(path)
+	if reloaded.Jobs[0].MaxSleep != 120 {
+		t.Errorf("Expected max_sleep 120 in the file, got %d", reloaded.Jobs[0].MaxSleep)
+	}
+
+	response = createResponse("update-job job1 max_sleep 60")
+
+	if !strings.Contains(response, "updated successfully") {
+		t.Errorf("Unexpected response: %s", response)
+	}
+	if reloaded, _ := createConfig(path); reloaded.Jobs[0].MaxSleep != 120 {
+		t.Error("Expected the file to change only with --persist")
+	}
+}
+
+func TestConfigSource_SaveJobs_AddedJob(t *testing.T) {
+	configuration, path := loadTestConfig(t, testConfig{content: writerTestConfig})
+	added := createTestJob("added", nil)
+	added.Command = "echo"
+	added.SleepTime = 15
+	added.MaxSleep = 60
+	added.Queue = "added"
+	added.ConnectionName = "main"
+	added.definition = []byte(`{"name": "added", "command": "echo", "connection": "main", "queue": "added",
+		"sleep_time": 10, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+
+	if _, err := configuration.source.saveJobs(append(configuration.Jobs, added)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	reloaded, err := createConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	var found *Job
+	for _, job := range reloaded.Jobs {
+		if job.Name == "added" {
+			found = job
+		}
+	}
+	if found == nil || found.SleepTime != 15 || found.ConnectionName != "main" {
+		t.Errorf("Expected the added job to be appended with its running values, got %+v", found)
+	}
+}
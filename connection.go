@@ -1,28 +1,113 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
 )
 
 type ConnectionConfig struct {
-	Name     string `json:"name"`
-	Endpoint string `json:"endpoint"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Vhost    string `json:"vhost"`
+	Name               string   `json:"name"`
+	Type               string   `json:"type"`
+	Endpoint           string   `json:"endpoint"`
+	Endpoints          []string `json:"endpoints"`
+	EndpointSelection  string   `json:"endpoint_selection"`
+	Username           string   `json:"username"`
+	Password           string   `json:"password"`
+	Vhost              string   `json:"vhost"`
+	AmqpEndpoint       string   `json:"amqp_endpoint"`
+	CaFile             string   `json:"ca_file"`
+	CertFile           string   `json:"cert_file"`
+	KeyFile            string   `json:"key_file"`
+	ServerName         string   `json:"server_name"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	Region             string   `json:"region"`
+	AccessKeyId        string   `json:"access_key_id"`
+	SecretAccessKey    string   `json:"secret_access_key"`
+	BreakerThreshold   int      `json:"breaker_threshold"`
+	BreakerBackoff     int      `json:"breaker_backoff"`
+	BreakerMaxBackoff  int      `json:"breaker_max_backoff"`
+	WatchAlarms        bool     `json:"watch_alarms"`
+	AlarmCheckInterval int      `json:"alarm_check_interval"`
+	AlarmPauseGroups   []string `json:"alarm_pause_groups"`
 }
 
-func (connectionConfig *ConnectionConfig) replaceEnvVariables() *ConnectionConfig {
-	connectionConfig.Username = replaceEnvVar(connectionConfig.Username)
-	connectionConfig.Password = replaceEnvVar(connectionConfig.Password)
-	return connectionConfig
+func (connectionConfig *ConnectionConfig) getCredentials() ConnectionCredentials {
+	return ConnectionCredentials{
+		Username:        connectionConfig.Username,
+		Password:        connectionConfig.Password,
+		AccessKeyId:     connectionConfig.AccessKeyId,
+		SecretAccessKey: connectionConfig.SecretAccessKey,
+	}
+}
+
+// getType returns the broker type of the connection, defaulting to RabbitMQ
+func (connectionConfig *ConnectionConfig) getType() string {
+	if connectionConfig.Type == "" {
+		return CONNECTION_TYPE_RABBITMQ
+	}
+	return strings.ToLower(connectionConfig.Type)
+}
+
+// getEndpoints returns every endpoint of the connection: the endpoints list
+// when set, the single endpoint otherwise
+func (connectionConfig *ConnectionConfig) getEndpoints() []string {
+	if len(connectionConfig.Endpoints) > 0 {
+		return connectionConfig.Endpoints
+	}
+	return []string{connectionConfig.Endpoint}
+}
+
+func (connectionConfig *ConnectionConfig) getEndpointSelection() string {
+	if connectionConfig.EndpointSelection == "" {
+		return ENDPOINT_SELECTION_PRIORITY
+	}
+	return connectionConfig.EndpointSelection
+}
+
+func (connectionConfig *ConnectionConfig) hasTLSConfig() bool {
+	return connectionConfig.CaFile != "" || connectionConfig.CertFile != "" || connectionConfig.KeyFile != "" ||
+		connectionConfig.ServerName != "" || connectionConfig.InsecureSkipVerify
 }
 
-func replaceEnvVar(envVarName string) string {
-	if strings.HasPrefix(envVarName, "${") && strings.HasSuffix(envVarName, "}") {
-		var trimmedValue string = strings.TrimLeft(strings.TrimRight(envVarName, "}"), "${")
-		return os.Getenv(trimmedValue)
+// getTLSConfig builds the TLS configuration shared by every protocol of the
+// connection. It returns nil when the connection has no TLS settings, so
+// that the system defaults apply.
+func (connectionConfig *ConnectionConfig) getTLSConfig() (*tls.Config, error) {
+	if !connectionConfig.hasTLSConfig() {
+		return nil, nil
 	}
-	return envVarName
+	tlsConfig := &tls.Config{
+		ServerName:         connectionConfig.ServerName,
+		InsecureSkipVerify: connectionConfig.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if connectionConfig.CaFile != "" {
+		caContent, err := os.ReadFile(connectionConfig.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caContent) {
+			return nil, fmt.Errorf("ca_file %v contains no PEM certificate", connectionConfig.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if connectionConfig.CertFile != "" || connectionConfig.KeyFile != "" {
+		if connectionConfig.CertFile == "" || connectionConfig.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(connectionConfig.CertFile, connectionConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
 }
@@ -1,134 +1,150 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestReplaceEnvVar_WithValidEnvVar(t *testing.T) {
-	// Set up a test environment variable
-	os.Setenv("TEST_VAR", "test_value")
-	defer os.Unsetenv("TEST_VAR")
-
-	result := replaceEnvVar("${TEST_VAR}")
-	if result != "test_value" {
-		t.Errorf("Expected 'test_value', got '%s'", result)
-	}
-}
-
-func TestReplaceEnvVar_WithUnsetEnvVar(t *testing.T) {
-	// Ensure the variable is not set
-	os.Unsetenv("UNSET_VAR")
-
-	result := replaceEnvVar("${UNSET_VAR}")
-	if result != "" {
-		t.Errorf("Expected empty string for unset variable, got '%s'", result)
-	}
+type testCertificates struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	caPool     *x509.CertPool
+	serverCert tls.Certificate
 }
 
-func TestReplaceEnvVar_WithPlainString(t *testing.T) {
-	result := replaceEnvVar("plain_string")
-	if result != "plain_string" {
-		t.Errorf("Expected 'plain_string', got '%s'", result)
+// createTestCertificates writes a CA, plus a client certificate signed by it,
+// to PEM files and returns a server certificate for "rabbit.internal"
+func createTestCertificates(t *testing.T) testCertificates {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create certificate: %v", err)
+		}
+		return der, key
+	}
+	writePEM := func(name string, blockType string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content}), 0600); err != nil {
+			t.Fatalf("Failed to write %v: %v", name, err)
+		}
+		return path
+	}
+
+	clientDER, clientKey := issue(2, "supervisor", x509.ExtKeyUsageClientAuth)
+	clientKeyDER, _ := x509.MarshalECPrivateKey(clientKey)
+	serverDER, serverKey := issue(3, "rabbit.internal", x509.ExtKeyUsageServerAuth)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return testCertificates{
+		caFile:     writePEM("ca.pem", "CERTIFICATE", caDER),
+		certFile:   writePEM("client.pem", "CERTIFICATE", clientDER),
+		keyFile:    writePEM("client-key.pem", "EC PRIVATE KEY", clientKeyDER),
+		caPool:     pool,
+		serverCert: tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey},
 	}
 }
 
-func TestReplaceEnvVar_WithEmptyString(t *testing.T) {
-	result := replaceEnvVar("")
-	if result != "" {
-		t.Errorf("Expected empty string, got '%s'", result)
-	}
-}
+func TestConnectionConfig_GetTLSConfig_None(t *testing.T) {
+	config := &ConnectionConfig{Name: "plain", Endpoint: "http://localhost:15672"}
 
-func TestReplaceEnvVar_WithPartialFormat(t *testing.T) {
-	// Test with only prefix
-	result := replaceEnvVar("${INCOMPLETE")
-	if result != "${INCOMPLETE" {
-		t.Errorf("Expected '${INCOMPLETE', got '%s'", result)
-	}
+	tlsConfig, err := config.getTLSConfig()
 
-	// Test with only suffix
-	result = replaceEnvVar("INCOMPLETE}")
-	if result != "INCOMPLETE}" {
-		t.Errorf("Expected 'INCOMPLETE}', got '%s'", result)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
-}
-
-func TestReplaceEnvVar_WithNestedBraces(t *testing.T) {
-	os.Setenv("NESTED", "value")
-	defer os.Unsetenv("NESTED")
-
-	// Input "${${NESTED}}" is processed as:
-	// 1. HasPrefix("${") and HasSuffix("}") → true
-	// 2. TrimRight("${${NESTED}}", "}") → "${${NESTED}"
-	// 3. TrimLeft("${${NESTED}", "${") → "NESTED" (removes all $, { chars from left)
-	// 4. os.Getenv("NESTED") → "value"
-	result := replaceEnvVar("${${NESTED}}")
-	if result != "value" {
-		t.Errorf("Expected 'value' for nested format (trims to 'NESTED'), got '%s'", result)
+	if tlsConfig != nil {
+		t.Error("Expected nil TLS config without TLS settings")
 	}
 }
 
-func TestConnectionConfig_ReplaceEnvVariables(t *testing.T) {
-	os.Setenv("TEST_USER", "myuser")
-	os.Setenv("TEST_PASS", "mypassword")
-	defer os.Unsetenv("TEST_USER")
-	defer os.Unsetenv("TEST_PASS")
-
+func TestConnectionConfig_GetTLSConfig_Full(t *testing.T) {
+	certificates := createTestCertificates(t)
 	config := &ConnectionConfig{
-		Name:     "test_connection",
-		Endpoint: "http://localhost:15672",
-		Username: "${TEST_USER}",
-		Password: "${TEST_PASS}",
-		Vhost:    "/",
+		Name:       "secure",
+		CaFile:     certificates.caFile,
+		CertFile:   certificates.certFile,
+		KeyFile:    certificates.keyFile,
+		ServerName: "rabbit.internal",
 	}
 
-	result := config.replaceEnvVariables()
+	tlsConfig, err := config.getTLSConfig()
 
-	if result.Username != "myuser" {
-		t.Errorf("Expected username 'myuser', got '%s'", result.Username)
-	}
-	if result.Password != "mypassword" {
-		t.Errorf("Expected password 'mypassword', got '%s'", result.Password)
-	}
-	// Other fields should remain unchanged
-	if result.Name != "test_connection" {
-		t.Errorf("Expected name 'test_connection', got '%s'", result.Name)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	if result.Endpoint != "http://localhost:15672" {
-		t.Errorf("Expected endpoint 'http://localhost:15672', got '%s'", result.Endpoint)
+	if tlsConfig.RootCAs == nil {
+		t.Error("Expected custom root CAs")
 	}
-}
-
-func TestConnectionConfig_ReplaceEnvVariables_WithPlainValues(t *testing.T) {
-	config := &ConnectionConfig{
-		Name:     "test_connection",
-		Endpoint: "http://localhost:15672",
-		Username: "plainuser",
-		Password: "plainpass",
-		Vhost:    "/",
+	if len(tlsConfig.Certificates) != 1 {
+		t.Errorf("Expected 1 client certificate, got %d", len(tlsConfig.Certificates))
 	}
-
-	result := config.replaceEnvVariables()
-
-	if result.Username != "plainuser" {
-		t.Errorf("Expected username 'plainuser', got '%s'", result.Username)
+	if tlsConfig.ServerName != "rabbit.internal" {
+		t.Errorf("Expected server name 'rabbit.internal', got '%s'", tlsConfig.ServerName)
 	}
-	if result.Password != "plainpass" {
-		t.Errorf("Expected password 'plainpass', got '%s'", result.Password)
+	if tlsConfig.InsecureSkipVerify {
+		t.Error("Expected certificates to be verified")
 	}
 }
 
-func TestConnectionConfig_ReplaceEnvVariables_ReturnsSamePointer(t *testing.T) {
-	config := &ConnectionConfig{
-		Name:     "test",
-		Username: "user",
-		Password: "pass",
-	}
-
-	result := config.replaceEnvVariables()
-
-	if result != config {
-		t.Error("Expected replaceEnvVariables to return the same pointer")
+func TestConnectionConfig_GetTLSConfig_Errors(t *testing.T) {
+	certificates := createTestCertificates(t)
+	tests := []struct {
+		name   string
+		config ConnectionConfig
+	}{
+		{"missing ca file", ConnectionConfig{CaFile: "/nonexistent/ca.pem"}},
+		{"ca file without certificates", ConnectionConfig{CaFile: certificates.keyFile}},
+		{"cert without key", ConnectionConfig{CertFile: certificates.certFile}},
+		{"key without cert", ConnectionConfig{KeyFile: certificates.keyFile}},
+		{"mismatched pair", ConnectionConfig{CertFile: certificates.caFile, KeyFile: certificates.keyFile}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.config.getTLSConfig(); err == nil {
+				t.Errorf("Expected error for %s", tt.name)
+			}
+		})
 	}
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const ENDPOINT_SELECTION_PRIORITY = "priority"
+const ENDPOINT_SELECTION_ROUND_ROBIN = "round_robin"
+
+// ENDPOINT_RETRY_INTERVAL is how long an endpoint that failed is skipped
+// before being tried again
+const ENDPOINT_RETRY_INTERVAL = 30 * time.Second
+
+type EndpointState struct {
+	Url       string
+	Healthy   bool
+	Failures  int
+	LastError string
+	retryAt   time.Time
+}
+
+// ConnectionState is the runtime state of a connection, shared by every job
+// using it
+type ConnectionState struct {
+	Name      string
+	Selection string
+	Endpoints []*EndpointState
+	Current   string
+	next      int
+	breaker   *CircuitBreaker
+	health    ConnectionHealth
+	refreshed *ConnectionCredentials // credentials read again from Vault
+	mu        sync.Mutex             // protects every field but breaker
+}
+
+// ConnectionCredentials are the credentials a client of a connection
+// authenticates with
+type ConnectionCredentials struct {
+	Username        string
+	Password        string
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+// ConnectionHealth is what was observed the last time the broker was called
+type ConnectionHealth struct {
+	Checked     bool
+	Reachable   bool
+	LastCheck   time.Time
+	LastLatency time.Duration
+	LastError   string
+	LastErrorAt time.Time
+	Version     string
+}
+
+type ConnectionRegistry struct {
+	states map[string]*ConnectionState
+	mu     sync.Mutex // protects states
+}
+
+var connectionRegistry = createConnectionRegistry()
+
+func createConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{states: make(map[string]*ConnectionState)}
+}
+
+// register returns the state of the connection, creating it the first time
+// one of its jobs starts
+func (registry *ConnectionRegistry) register(connectionConfig ConnectionConfig) *ConnectionState {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	state, found := registry.states[connectionConfig.Name]
+	if !found {
+		state = createConnectionState(connectionConfig)
+		registry.states[connectionConfig.Name] = state
+	}
+	return state
+}
+
+func (registry *ConnectionRegistry) list() []*ConnectionState {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	states := make([]*ConnectionState, 0, len(registry.states))
+	for _, state := range registry.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// returnStatus lists the node each connection is currently using. It is
+// empty until a job has started on a connection
+func (registry *ConnectionRegistry) returnStatus() string {
+	states := registry.list()
+	if len(states) == 0 {
+		return ""
+	}
+	var b bytes.Buffer
+	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
+	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", "Connection", "State", "Node", "Endpoints up")
+	for _, state := range states {
+		current := state.getCurrent()
+		if current == "" {
+			current = "-"
+		}
+		healthy, total := state.countHealthy()
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v/%v\n", state.Name, state.getStatusName(), current, healthy, total)
+	}
+	writer.Flush()
+	return b.String()
+}
+
+func createConnectionState(connectionConfig ConnectionConfig) *ConnectionState {
+	state := ConnectionState{
+		Name:      connectionConfig.Name,
+		Selection: connectionConfig.getEndpointSelection(),
+		breaker:   createCircuitBreaker(connectionConfig),
+	}
+	for _, endpoint := range connectionConfig.getEndpoints() {
+		state.Endpoints = append(state.Endpoints, &EndpointState{Url: endpoint, Healthy: true})
+	}
+	return &state
+}
+
+// candidates returns the endpoints in the order they should be tried.
+// Healthy endpoints, and failed ones due for a retry, come first: by
+// configuration order with priority selection (so that the connection fails
+// back to the first endpoint once it recovers) or rotating with round robin.
+// Endpoints still waiting for their retry are kept as a last resort.
+func (state *ConnectionState) candidates() []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := time.Now()
+	var available, waiting []string
+	count := len(state.Endpoints)
+	start := 0
+	if state.Selection == ENDPOINT_SELECTION_ROUND_ROBIN && count > 0 {
+		start = state.next % count
+		state.next = (state.next + 1) % count
+	}
+	for i := 0; i < count; i++ {
+		endpoint := state.Endpoints[(start+i)%count]
+		if endpoint.Healthy || !now.Before(endpoint.retryAt) {
+			available = append(available, endpoint.Url)
+		} else {
+			waiting = append(waiting, endpoint.Url)
+		}
+	}
+	return append(available, waiting...)
+}
+
+func (state *ConnectionState) findEndpoint(url string) *EndpointState {
+	for _, endpoint := range state.Endpoints {
+		if endpoint.Url == url {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+func (state *ConnectionState) markSuccess(url string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if endpoint := state.findEndpoint(url); endpoint != nil {
+		if !endpoint.Healthy {
+			log.Printf("Connection %q: endpoint %v is reachable again\n", state.Name, url)
+		}
+		endpoint.Healthy = true
+		endpoint.Failures = 0
+		endpoint.LastError = ""
+	}
+	if state.Current != url {
+		if state.Current != "" && len(state.Endpoints) > 1 {
+			log.Printf("Connection %q: switching from %v to %v\n", state.Name, state.Current, url)
+		}
+		state.Current = url
+	}
+}
+
+func (state *ConnectionState) markFailure(url string, err error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	endpoint := state.findEndpoint(url)
+	if endpoint == nil {
+		return
+	}
+	if endpoint.Healthy {
+		log.Printf("Connection %q: endpoint %v is unreachable: %v\n", state.Name, url, err)
+	}
+	endpoint.Healthy = false
+	endpoint.Failures++
+	endpoint.LastError = err.Error()
+	endpoint.retryAt = time.Now().Add(ENDPOINT_RETRY_INTERVAL)
+	if state.Current == url {
+		state.Current = ""
+	}
+}
+
+// getStatusName returns DEGRADED while the circuit breaker of the connection
+// keeps its jobs from polling, OK otherwise
+func (state *ConnectionState) getStatusName() string {
+	if state.breaker.isDegraded() {
+		return "DEGRADED"
+	}
+	return "OK"
+}
+
+// recordCheck stores the outcome of a call to the broker. reachable is false
+// only for broker failures: a job error (e.g. a missing queue) still proves
+// that the broker answers.
+func (state *ConnectionState) recordCheck(latency time.Duration, reachable bool, err error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.health.Checked = true
+	state.health.Reachable = reachable
+	state.health.LastCheck = time.Now()
+	state.health.LastLatency = latency
+	if err != nil {
+		state.health.LastError = err.Error()
+		state.health.LastErrorAt = state.health.LastCheck
+	}
+}
+
+func (state *ConnectionState) setVersion(version string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.health.Version = version
+}
+
+func (state *ConnectionState) getHealth() ConnectionHealth {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.health
+}
+
+// refreshCredentials replaces the credentials of the clients of the
+// connection, which use them from their next call
+func (state *ConnectionState) refreshCredentials(credentials ConnectionCredentials) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.refreshed = &credentials
+}
+
+// getCredentials returns the credentials refreshed last, the ones of the
+// client when they were never refreshed
+func (state *ConnectionState) getCredentials(configured ConnectionCredentials) ConnectionCredentials {
+	if state == nil {
+		return configured
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.refreshed == nil {
+		return configured
+	}
+	return *state.refreshed
+}
+
+func (state *ConnectionState) getCurrent() string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.Current
+}
+
+// countHealthy returns the number of healthy endpoints and the total
+func (state *ConnectionState) countHealthy() (int, int) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	healthy := 0
+	for _, endpoint := range state.Endpoints {
+		if endpoint.Healthy {
+			healthy++
+		}
+	}
+	return healthy, len(state.Endpoints)
+}
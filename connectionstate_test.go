@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionConfig_GetEndpoints(t *testing.T) {
+	single := ConnectionConfig{Endpoint: "http://a:15672"}
+	if got := single.getEndpoints(); !reflect.DeepEqual(got, []string{"http://a:15672"}) {
+		t.Errorf("Expected the single endpoint, got %v", got)
+	}
+
+	cluster := ConnectionConfig{Endpoint: "http://a:15672", Endpoints: []string{"http://b:15672", "http://c:15672"}}
+	if got := cluster.getEndpoints(); !reflect.DeepEqual(got, []string{"http://b:15672", "http://c:15672"}) {
+		t.Errorf("Expected the endpoints list, got %v", got)
+	}
+}
+
+func TestConnectionState_Candidates_Priority(t *testing.T) {
+	state := createConnectionState(ConnectionConfig{Name: "main", Endpoints: []string{"a", "b", "c"}})
+
+	if got := state.candidates(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Expected configuration order, got %v", got)
+	}
+
+	state.markFailure("a", errors.New("connection refused"))
+	if got := state.candidates(); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+		t.Errorf("Expected the failed endpoint last, got %v", got)
+	}
+
+	// Once due for a retry, the first endpoint is tried first again
+	state.Endpoints[0].retryAt = time.Now().Add(-time.Second)
+	if got := state.candidates(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Expected fail back to the first endpoint, got %v", got)
+	}
+}
+
+func TestConnectionState_Candidates_RoundRobin(t *testing.T) {
+	state := createConnectionState(ConnectionConfig{
+		Name:              "main",
+		Endpoints:         []string{"a", "b", "c"},
+		EndpointSelection: ENDPOINT_SELECTION_ROUND_ROBIN,
+	})
+
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		firsts = append(firsts, state.candidates()[0])
+	}
+	if !reflect.DeepEqual(firsts, []string{"a", "b", "c", "a"}) {
+		t.Errorf("Expected endpoints to rotate, got %v", firsts)
+	}
+
+	state.markFailure("b", errors.New("connection refused"))
+	if got := state.candidates(); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+		t.Errorf("Expected the failed endpoint last, got %v", got)
+	}
+}
+
+func TestConnectionState_MarkSuccessAndFailure(t *testing.T) {
+	state := createConnectionState(ConnectionConfig{Name: "main", Endpoints: []string{"a", "b"}})
+
+	state.markSuccess("a")
+	if state.getCurrent() != "a" {
+		t.Errorf("Expected current node a, got %q", state.getCurrent())
+	}
+
+	state.markFailure("a", errors.New("connection refused"))
+	state.markFailure("a", errors.New("connection refused"))
+	if state.getCurrent() != "" {
+		t.Errorf("Expected no current node, got %q", state.getCurrent())
+	}
+	if state.Endpoints[0].Failures != 2 || state.Endpoints[0].LastError != "connection refused" {
+		t.Errorf("Expected failures to be tracked, got %+v", state.Endpoints[0])
+	}
+	if healthy, total := state.countHealthy(); healthy != 1 || total != 2 {
+		t.Errorf("Expected 1/2 healthy endpoints, got %d/%d", healthy, total)
+	}
+
+	state.markSuccess("b")
+	state.markSuccess("a")
+	if state.getCurrent() != "a" || !state.Endpoints[0].Healthy || state.Endpoints[0].Failures != 0 {
+		t.Errorf("Expected endpoint a to recover, got %+v", state.Endpoints[0])
+	}
+}
+
+func TestConnectionRegistry_Register(t *testing.T) {
+	registry := createConnectionRegistry()
+
+	first := registry.register(ConnectionConfig{Name: "main", Endpoint: "a"})
+	second := registry.register(ConnectionConfig{Name: "main", Endpoint: "a"})
+	registry.register(ConnectionConfig{Name: "backup", Endpoint: "b"})
+
+	if first != second {
+		t.Error("Expected jobs on the same connection to share its state")
+	}
+	states := registry.list()
+	if len(states) != 2 || states[0].Name != "backup" || states[1].Name != "main" {
+		t.Errorf("Expected states sorted by name, got %v", states)
+	}
+}
+
+func TestConnectionRegistry_ReturnStatus(t *testing.T) {
+	registry := createConnectionRegistry()
+	if registry.returnStatus() != "" {
+		t.Error("Expected empty status without connections")
+	}
+
+	state := registry.register(ConnectionConfig{Name: "main", Endpoints: []string{"http://a:15672", "http://b:15672"}})
+	state.markFailure("http://a:15672", errors.New("connection refused"))
+	state.markSuccess("http://b:15672")
+
+	status := registry.returnStatus()
+	if !strings.Contains(status, "main") || !strings.Contains(status, "http://b:15672") || !strings.Contains(status, "1/2") {
+		t.Errorf("Expected current node and healthy endpoints in status, got:\n%s", status)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const CONNECTION_TYPE_RABBITMQ = "rabbitmq"
+const CONNECTION_TYPE_NATS = "nats"
+const CONNECTION_TYPE_SQS = "sqs"
+
+// QueueConnector is implemented by every broker a job can poll for pending messages
+type QueueConnector interface {
+	getQueueInfo(job *Job) (*QueueInfo, error)
+	Close()
+}
+
+func createConnector(connectionConfig ConnectionConfig) (QueueConnector, error) {
+	tlsConfig, err := connectionConfig.getTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("connection %q has invalid TLS settings: %w", connectionConfig.Name, err)
+	}
+	switch connectionConfig.getType() {
+	case CONNECTION_TYPE_RABBITMQ:
+		client := createClient(connectionConfig.Endpoint, connectionConfig.Username, connectionConfig.Password)
+		client.cluster = connectionRegistry.register(connectionConfig)
+		if tlsConfig != nil {
+			client.Transport = createHTTPTransport(tlsConfig)
+		}
+		return client, nil
+	case CONNECTION_TYPE_NATS:
+		client := createNatsClient(connectionConfig)
+		client.cluster = connectionRegistry.register(connectionConfig)
+		client.TLSConfig = tlsConfig
+		return client, nil
+	case CONNECTION_TYPE_SQS:
+		client, err := createSqsClient(connectionConfig, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		connectionRegistry.register(connectionConfig)
+		return client, nil
+	default:
+		return nil, fmt.Errorf("connection %q has unsupported type %q", connectionConfig.Name, connectionConfig.Type)
+	}
+}
+
+// probeConnection asks the management API of a RabbitMQ connection for its
+// overview, refreshing the health and version of the connection. Other types
+// are only checked by the polls of their jobs.
+func probeConnection(connectionConfig ConnectionConfig) {
+	if connectionConfig.getType() != CONNECTION_TYPE_RABBITMQ {
+		return
+	}
+	connector, err := createConnector(connectionConfig)
+	if err != nil {
+		return
+	}
+	client := connector.(*Client)
+	started := time.Now()
+	overview, err := client.getOverview()
+	client.cluster.recordCheck(time.Since(started), err == nil || !isBrokerFailure(err), err)
+	if err == nil {
+		client.cluster.setVersion(overview.RabbitmqVersion)
+	}
+}
+
+// createHTTPTransport returns the default HTTP transport using tlsConfig
+func createHTTPTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+// sqsAuthErrorCodes are the errors of SQS refusing the credentials of the
+// connection
+var sqsAuthErrorCodes = []string{"InvalidClientTokenId", "UnrecognizedClientException", "SignatureDoesNotMatch", "InvalidAccessKeyId", "ExpiredToken", "ExpiredTokenException"}
+
+// isBrokerFailure tells apart errors meaning that the broker can't be used
+// from the ones about a single job (e.g. a missing queue), which must not
+// trip the circuit breaker of the connection. Refused credentials fail
+// every job of the connection, as an unreachable broker does.
+func isBrokerFailure(err error) bool {
+	if isAuthFailure(err) {
+		return true
+	}
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return isNodeFailure(err)
+	}
+	var apiError smithy.APIError
+	if errors.As(err, &apiError) {
+		return apiError.ErrorFault() != smithy.FaultClient
+	}
+	if errors.Is(err, errNatsJobIncomplete) || errors.Is(err, jetstream.ErrStreamNotFound) || errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return false
+	}
+	return true
+}
+
+// isAuthFailure tells whether the broker refused the credentials of the
+// connection
+func isAuthFailure(err error) bool {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode == http.StatusUnauthorized || statusError.StatusCode == http.StatusForbidden
+	}
+	var apiError smithy.APIError
+	return errors.As(err, &apiError) && contains(sqsAuthErrorCodes, apiError.ErrorCode())
+}
+
+// getMessages returns the number of messages waiting for the job, and false
+// when they couldn't be counted. Broker failures go through the circuit
+// breaker of the connection: while it is open the broker isn't polled at
+// all, and only the first failure is logged by the job.
+func getMessages(connector QueueConnector, job *Job) (int, bool) {
+	if *testMode {
+		return 1, true
+	}
+	state := connectionRegistry.register(job.GetConnectionConfig())
+	breaker := state.breaker
+	if !breaker.allow() {
+		return 0, false
+	}
+	started := time.Now()
+	q, err := connector.getQueueInfo(job)
+	brokerFailure := err != nil && isBrokerFailure(err)
+	state.recordCheck(time.Since(started), !brokerFailure, err)
+	if brokerFailure {
+		if breaker.recordFailure(err) {
+			job.logConnectionError(err)
+		}
+		return 0, false
+	}
+	breaker.recordSuccess()
+	if err != nil {
+		job.logConnectionError(err)
+		return 0, false
+	}
+	job.recordQueueInfo(q)
+
+	return q.Messages, true
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+type fakeConnector struct {
+	queueInfo *QueueInfo
+	err       error
+	calls     int
+}
+
+func (connector *fakeConnector) getQueueInfo(job *Job) (*QueueInfo, error) {
+	connector.calls++
+	return connector.queueInfo, connector.err
+}
+
+func (connector *fakeConnector) Close() {}
+
+func TestCreateConnector_DefaultsToRabbitMQ(t *testing.T) {
+	connector, err := createConnector(ConnectionConfig{Name: "main", Endpoint: "http://localhost:15672"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := connector.(*Client); !ok {
+		t.Errorf("Expected a RabbitMQ client, got %T", connector)
+	}
+}
+
+func TestCreateConnector_Nats(t *testing.T) {
+	connector, err := createConnector(ConnectionConfig{Name: "edge", Type: "NATS", Endpoint: "nats://localhost:4222"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := connector.(*NatsClient); !ok {
+		t.Errorf("Expected a NATS client, got %T", connector)
+	}
+}
+
+func TestCreateConnector_Sqs(t *testing.T) {
+	connector, err := createConnector(ConnectionConfig{Name: "hybrid", Type: "sqs", Region: "eu-west-1", Endpoint: "http://localhost:9324"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := connector.(*SqsClient); !ok {
+		t.Errorf("Expected an SQS client, got %T", connector)
+	}
+}
+
+func TestCreateConnector_SqsWithoutRegion(t *testing.T) {
+	connector, err := createConnector(ConnectionConfig{Name: "hybrid", Type: "sqs"})
+	if err == nil {
+		t.Error("Expected error for SQS connection without region")
+	}
+	if connector != nil {
+		t.Error("Expected nil connector for SQS connection without region")
+	}
+}
+
+func TestCreateConnector_UnsupportedType(t *testing.T) {
+	connector, err := createConnector(ConnectionConfig{Name: "other", Type: "kafka"})
+	if err == nil {
+		t.Error("Expected error for unsupported connection type")
+	}
+	if connector != nil {
+		t.Error("Expected nil connector for unsupported connection type")
+	}
+}
+
+func TestGetMessages_Success(t *testing.T) {
+	connector := &fakeConnector{queueInfo: &QueueInfo{Messages: 7}}
+
+	messages, execute := getMessages(connector, &Job{Name: "job1"})
+
+	if !execute {
+		t.Error("Expected execute to be true")
+	}
+	if messages != 7 {
+		t.Errorf("Expected 7 messages, got %d", messages)
+	}
+}
+
+func TestGetMessages_ErrorIsLogged(t *testing.T) {
+	tmpDir := t.TempDir() + "/"
+	job := &Job{
+		Name:             "nats_job",
+		Stream:           "EDGE",
+		Consumer:         "ingest",
+		ErrorLogPath:     tmpDir,
+		ConnectionConfig: ConnectionConfig{Type: CONNECTION_TYPE_NATS},
+	}
+	connector := &fakeConnector{err: errors.New("nats: no servers available for connection")}
+
+	messages, execute := getMessages(connector, job)
+
+	if execute {
+		t.Error("Expected execute to be false")
+	}
+	if messages != 0 {
+		t.Errorf("Expected 0 messages, got %d", messages)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(tmpDir, "nats_job"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one log file, got %v (%v)", entries, err)
+	}
+	content, _ := os.ReadFile(filepath.Join(tmpDir, "nats_job", entries[0].Name()))
+	if !strings.Contains(string(content), "consumer: ingest on stream: EDGE") {
+		t.Errorf("Expected log to describe the consumer, got: %s", content)
+	}
+	if !strings.Contains(string(content), "no servers available") {
+		t.Errorf("Expected log to contain the error, got: %s", content)
+	}
+}
+
+func TestJob_DescribeQueue(t *testing.T) {
+	rabbitJob := &Job{Queue: "work", ConnectionConfig: ConnectionConfig{Vhost: "/"}}
+	if got := rabbitJob.describeQueue(); got != "queue: work on vhost: /" {
+		t.Errorf("Unexpected description %q", got)
+	}
+
+	natsJob := &Job{Stream: "EDGE", Consumer: "ingest", ConnectionConfig: ConnectionConfig{Type: "nats"}}
+	if got := natsJob.describeQueue(); got != "consumer: ingest on stream: EDGE" {
+		t.Errorf("Unexpected description %q", got)
+	}
+}
+
+func countLogLines(t *testing.T, dir string, text string) int {
+	t.Helper()
+	entries, _ := os.ReadDir(dir)
+	count := 0
+	for _, entry := range entries {
+		content, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		count += strings.Count(string(content), text)
+	}
+	return count
+}
+
+func TestGetMessages_CircuitBreaker(t *testing.T) {
+	tmpDir := t.TempDir() + "/"
+	connectionConfig := ConnectionConfig{Name: "breaker_test", BreakerThreshold: 3, BreakerBackoff: 60}
+	job := &Job{Name: "breaker_job", Queue: "work", ErrorLogPath: tmpDir, ConnectionConfig: connectionConfig}
+	connector := &fakeConnector{err: errors.New("connection refused")}
+
+	for i := 0; i < 10; i++ {
+		if _, execute := getMessages(connector, job); execute {
+			t.Fatal("Expected execute to be false")
+		}
+	}
+
+	if connector.calls != 3 {
+		t.Errorf("Expected the broker to be polled 3 times before the breaker opens, got %d", connector.calls)
+	}
+	if got := countLogLines(t, filepath.Join(tmpDir, "breaker_job"), "connection refused"); got != 1 {
+		t.Errorf("Expected the failure to be logged once, got %d times", got)
+	}
+	state := connectionRegistry.register(connectionConfig)
+	if state.getStatusName() != "DEGRADED" {
+		t.Errorf("Expected DEGRADED connection, got %v", state.getStatusName())
+	}
+}
+
+func TestGetMessages_RefusedCredentialsTripBreaker(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	tmpDir := t.TempDir() + "/"
+	connectionConfig := ConnectionConfig{Name: "unauthorized_test", Endpoint: server.URL, Username: "guest", Password: "rotated", BreakerThreshold: 3, BreakerBackoff: 60}
+	jobs := []*Job{
+		{Name: "unauthorized_job1", Queue: "first", ErrorLogPath: tmpDir, ConnectionConfig: connectionConfig},
+		{Name: "unauthorized_job2", Queue: "second", ErrorLogPath: tmpDir, ConnectionConfig: connectionConfig},
+	}
+	connector, _ := createConnector(connectionConfig)
+
+	for i := 0; i < 5; i++ {
+		for _, job := range jobs {
+			if _, execute := getMessages(connector, job); execute {
+				t.Fatal("Expected execute to be false")
+			}
+		}
+	}
+
+	if requests != 3 {
+		t.Errorf("Expected the broker to be polled 3 times before the breaker opens, got %d", requests)
+	}
+	logged := countLogLines(t, filepath.Join(tmpDir, "unauthorized_job1"), "refused the credentials") + countLogLines(t, filepath.Join(tmpDir, "unauthorized_job2"), "refused the credentials")
+	if logged != 1 {
+		t.Errorf("Expected the refused credentials to be logged once, got %d times", logged)
+	}
+	if state := connectionRegistry.register(connectionConfig); state.getStatusName() != "DEGRADED" {
+		t.Errorf("Expected DEGRADED connection, got %v", state.getStatusName())
+	}
+}
+
+func TestGetMessages_JobErrorsDontTripBreaker(t *testing.T) {
+	tmpDir := t.TempDir() + "/"
+	connectionConfig := ConnectionConfig{Name: "job_error_test", BreakerThreshold: 1}
+	job := &Job{Name: "missing_queue_job", Queue: "missing", ErrorLogPath: tmpDir, ConnectionConfig: connectionConfig}
+	connector := &fakeConnector{err: &StatusError{StatusCode: 404, Vhost: "/", QueueName: "missing"}}
+
+	getMessages(connector, job)
+	getMessages(connector, job)
+
+	if connector.calls != 2 {
+		t.Errorf("Expected the broker to keep being polled, got %d calls", connector.calls)
+	}
+	if connectionRegistry.register(connectionConfig).getStatusName() != "OK" {
+		t.Error("Expected a missing queue not to degrade the connection")
+	}
+}
+
+func TestIsBrokerFailure(t *testing.T) {
+	if !isBrokerFailure(errors.New("dial tcp: connection refused")) {
+		t.Error("Expected a transport error to be a broker failure")
+	}
+	if !isBrokerFailure(&StatusError{StatusCode: 503}) {
+		t.Error("Expected a 503 to be a broker failure")
+	}
+	if isBrokerFailure(&StatusError{StatusCode: 404}) {
+		t.Error("Expected a 404 not to be a broker failure")
+	}
+	if !isBrokerFailure(&StatusError{StatusCode: 401, Vhost: "/", QueueName: "work"}) || !isBrokerFailure(&StatusError{StatusCode: 403}) {
+		t.Error("Expected refused credentials to be a broker failure")
+	}
+	if !isBrokerFailure(&smithy.GenericAPIError{Code: "InvalidClientTokenId", Fault: smithy.FaultClient}) {
+		t.Error("Expected an SQS token refused to be a broker failure")
+	}
+	if isBrokerFailure(errNatsJobIncomplete) {
+		t.Error("Expected an incomplete NATS job not to be a broker failure")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"unicode/utf8"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DELIVERY_STDIN = "stdin"
+const DELIVERY_FILE = "file"
+
+// DELIVERY_FILE_ENV is the environment variable holding the path of the
+// delivery file when a job uses DELIVERY_FILE
+const DELIVERY_FILE_ENV = "GORMQ_DELIVERY_FILE"
+
+// DeliveredMessage is what the command reads for every message, one JSON
+// object per line
+type DeliveredMessage struct {
+	Exchange      string                 `json:"exchange"`
+	RoutingKey    string                 `json:"routing_key"`
+	Redelivered   bool                   `json:"redelivered"`
+	MessageId     string                 `json:"message_id,omitempty"`
+	CorrelationId string                 `json:"correlation_id,omitempty"`
+	ContentType   string                 `json:"content_type,omitempty"`
+	Headers       map[string]interface{} `json:"headers"`
+	Body          string                 `json:"body"`
+	BodyEncoding  string                 `json:"body_encoding,omitempty"`
+}
+
+type DeliveryBatch struct {
+	deliveries []amqp.Delivery
+	payload    []byte
+	file       string
+}
+
+type DeliveryClient struct {
+	client  *AmqpClient
+	channel *amqp.Channel
+	mu      sync.Mutex // protects channel
+}
+
+func createDeliveryClient(connectionConfig ConnectionConfig) *DeliveryClient {
+	client := DeliveryClient{
+		client: createAmqpClient(connectionConfig),
+	}
+
+	return &client
+}
+
+// getChannel returns the open channel, opening it again (on a new connection
+// if needed) when it has been closed
+func (client *DeliveryClient) getChannel() (*amqp.Channel, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.channel == nil || client.channel.IsClosed() {
+		connection, err := client.client.getConnection()
+		if err != nil {
+			return nil, err
+		}
+		channel, err := connection.Channel()
+		if err != nil {
+			return nil, err
+		}
+		client.channel = channel
+	}
+	return client.channel, nil
+}
+
+// fetch takes up to batchSize messages from the queue without acking them
+func (client *DeliveryClient) fetch(queue string, batchSize int) ([]amqp.Delivery, error) {
+	channel, err := client.getChannel()
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []amqp.Delivery
+	for len(deliveries) < batchSize {
+		delivery, ok, err := channel.Get(queue, false)
+		if err != nil {
+			// Messages already taken are requeued by the broker with the closed channel
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (client *DeliveryClient) Close() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.client.Close()
+	client.channel = nil
+}
+
+// createDeliveryBatch serializes the deliveries and, for DELIVERY_FILE,
+// writes them to a temporary file readable by the user running the command
+func createDeliveryBatch(deliveries []amqp.Delivery, mode string, uid uint32, gid uint32) (*DeliveryBatch, error) {
+	var payload bytes.Buffer
+	encoder := json.NewEncoder(&payload)
+	for _, delivery := range deliveries {
+		if err := encoder.Encode(newDeliveredMessage(delivery)); err != nil {
+			return nil, err
+		}
+	}
+	batch := DeliveryBatch{deliveries: deliveries, payload: payload.Bytes()}
+
+	if mode == DELIVERY_FILE {
+		file, err := os.CreateTemp("", "gormq-delivery-*.jsonl")
+		if err != nil {
+			return nil, err
+		}
+		batch.file = file.Name()
+		_, err = file.Write(batch.payload)
+		file.Close()
+		if err == nil && uid != 0 {
+			err = os.Chown(batch.file, int(uid), int(gid))
+		}
+		if err != nil {
+			os.Remove(batch.file)
+			return nil, err
+		}
+	}
+
+	return &batch, nil
+}
+
+func newDeliveredMessage(delivery amqp.Delivery) DeliveredMessage {
+	message := DeliveredMessage{
+		Exchange:      delivery.Exchange,
+		RoutingKey:    delivery.RoutingKey,
+		Redelivered:   delivery.Redelivered,
+		MessageId:     delivery.MessageId,
+		CorrelationId: delivery.CorrelationId,
+		ContentType:   delivery.ContentType,
+		Headers:       map[string]interface{}(delivery.Headers),
+	}
+	if message.Headers == nil {
+		message.Headers = map[string]interface{}{}
+	}
+	if utf8.Valid(delivery.Body) {
+		message.Body = string(delivery.Body)
+	} else {
+		message.Body = base64.StdEncoding.EncodeToString(delivery.Body)
+		message.BodyEncoding = "base64"
+	}
+	return message
+}
+
+// attach hands the batch to the command, either on stdin or through the
+// path in DELIVERY_FILE_ENV
+func (batch *DeliveryBatch) attach(cmd *exec.Cmd) {
+	if batch.file != "" {
+		cmd.Env = append(os.Environ(), DELIVERY_FILE_ENV+"="+batch.file)
+		return
+	}
+	cmd.Stdin = bytes.NewReader(batch.payload)
+}
+
+// settle acks the whole batch when the command succeeded, otherwise it
+// nacks it so that the messages are requeued
+func (batch *DeliveryBatch) settle(success bool) error {
+	var errs []error
+	for _, delivery := range batch.deliveries {
+		var err error
+		if success {
+			err = delivery.Ack(false)
+		} else {
+			err = delivery.Nack(false, true)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if batch.file != "" {
+		os.Remove(batch.file)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not settle %d of %d messages: %w", len(errs), len(batch.deliveries), errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type fakeAcknowledger struct {
+	acked   []uint64
+	nacked  []uint64
+	requeue bool
+	err     error
+}
+
+func (acknowledger *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	acknowledger.acked = append(acknowledger.acked, tag)
+	return acknowledger.err
+}
+
+func (acknowledger *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	acknowledger.nacked = append(acknowledger.nacked, tag)
+	acknowledger.requeue = requeue
+	return acknowledger.err
+}
+
+func (acknowledger *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return acknowledger.Nack(tag, false, requeue)
+}
+
+func createTestDeliveries(acknowledger amqp.Acknowledger) []amqp.Delivery {
+	return []amqp.Delivery{
+		{
+			Acknowledger: acknowledger,
+			DeliveryTag:  1,
+			Exchange:     "orders",
+			RoutingKey:   "orders.created",
+			MessageId:    "m-1",
+			Headers:      amqp.Table{"tenant": "acme"},
+			Body:         []byte(`{"id": 1}`),
+		},
+		{
+			Acknowledger: acknowledger,
+			DeliveryTag:  2,
+			RoutingKey:   "orders.created",
+			Redelivered:  true,
+			Body:         []byte{0xff, 0xfe},
+		},
+	}
+}
+
+func TestCreateDeliveryBatch_Stdin(t *testing.T) {
+	batch, err := createDeliveryBatch(createTestDeliveries(&fakeAcknowledger{}), DELIVERY_STDIN, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if batch.file != "" {
+		t.Errorf("Expected no delivery file for stdin, got %q", batch.file)
+	}
+
+	var messages []DeliveredMessage
+	scanner := bufio.NewScanner(bytes.NewReader(batch.payload))
+	for scanner.Scan() {
+		var message DeliveredMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatalf("Expected one JSON object per line: %v", err)
+		}
+		messages = append(messages, message)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].Body != `{"id": 1}` || messages[0].BodyEncoding != "" {
+		t.Errorf("Unexpected first body %q (%q)", messages[0].Body, messages[0].BodyEncoding)
+	}
+	if messages[0].Headers["tenant"] != "acme" {
+		t.Errorf("Expected tenant header, got %v", messages[0].Headers)
+	}
+	if messages[0].MessageId != "m-1" || messages[0].Exchange != "orders" {
+		t.Errorf("Unexpected properties %+v", messages[0])
+	}
+	if messages[1].BodyEncoding != "base64" || messages[1].Body != "//4=" {
+		t.Errorf("Expected base64 body for binary payload, got %q (%q)", messages[1].Body, messages[1].BodyEncoding)
+	}
+	if !messages[1].Redelivered {
+		t.Error("Expected second message to be flagged as redelivered")
+	}
+}
+
+func TestDeliveryBatch_Attach_Stdin(t *testing.T) {
+	batch, err := createDeliveryBatch(createTestDeliveries(&fakeAcknowledger{}), DELIVERY_STDIN, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cmd := exec.Command("cat")
+	batch.attach(cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(output, batch.payload) {
+		t.Errorf("Expected command to read the payload on stdin, got %q", output)
+	}
+}
+
+func TestDeliveryBatch_Attach_File(t *testing.T) {
+	batch, err := createDeliveryBatch(createTestDeliveries(&fakeAcknowledger{}), DELIVERY_FILE, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.Remove(batch.file)
+
+	cmd := exec.Command("sh", "-c", "cat \"$"+DELIVERY_FILE_ENV+"\"")
+	batch.attach(cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(output, batch.payload) {
+		t.Errorf("Expected command to read the payload from the file, got %q", output)
+	}
+	if cmd.Stdin != nil {
+		t.Error("Expected stdin to be left alone for file delivery")
+	}
+}
+
+func TestDeliveryBatch_Settle_Success(t *testing.T) {
+	acknowledger := &fakeAcknowledger{}
+	batch, _ := createDeliveryBatch(createTestDeliveries(acknowledger), DELIVERY_FILE, 0, 0)
+
+	if err := batch.settle(true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(acknowledger.acked) != 2 || len(acknowledger.nacked) != 0 {
+		t.Errorf("Expected 2 acks, got acked %v nacked %v", acknowledger.acked, acknowledger.nacked)
+	}
+	if _, err := os.Stat(batch.file); !os.IsNotExist(err) {
+		t.Error("Expected delivery file to be removed after settling")
+	}
+}
+
+func TestDeliveryBatch_Settle_FailureRequeues(t *testing.T) {
+	acknowledger := &fakeAcknowledger{}
+	batch, _ := createDeliveryBatch(createTestDeliveries(acknowledger), DELIVERY_STDIN, 0, 0)
+
+	if err := batch.settle(false); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(acknowledger.nacked) != 2 || len(acknowledger.acked) != 0 {
+		t.Errorf("Expected 2 nacks, got acked %v nacked %v", acknowledger.acked, acknowledger.nacked)
+	}
+	if !acknowledger.requeue {
+		t.Error("Expected nacked messages to be requeued")
+	}
+}
+
+func TestDeliveryBatch_Settle_Error(t *testing.T) {
+	acknowledger := &fakeAcknowledger{err: errors.New("channel closed")}
+	batch, _ := createDeliveryBatch(createTestDeliveries(acknowledger), DELIVERY_STDIN, 0, 0)
+
+	err := batch.settle(true)
+	if err == nil || !strings.Contains(err.Error(), "2 of 2") {
+		t.Errorf("Expected error naming the unsettled messages, got %v", err)
+	}
+}
+
+func TestJob_GetBatchSize(t *testing.T) {
+	if got := (&Job{}).getBatchSize(); got != 1 {
+		t.Errorf("Expected default batch size 1, got %d", got)
+	}
+	if got := (&Job{BatchSize: 10}).getBatchSize(); got != 10 {
+		t.Errorf("Expected batch size 10, got %d", got)
+	}
+}
+
+func TestDialAmqp_RequiresEndpoint(t *testing.T) {
+	_, err := dialAmqp(ConnectionConfig{Name: "main"})
+	if err == nil {
+		t.Error("Expected error for connection without amqp_endpoint")
+	}
+}
+
+func TestDeliveryClient_Fetch_ConnectionRefused(t *testing.T) {
+	client := createDeliveryClient(ConnectionConfig{Name: "main", AmqpEndpoint: "amqp://localhost:59996"})
+	defer client.Close()
+
+	deliveries, err := client.fetch("work", 5)
+	if err == nil {
+		t.Error("Expected error for connection refused")
+	}
+	if deliveries != nil {
+		t.Error("Expected no deliveries for connection refused")
+	}
+}
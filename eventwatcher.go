@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const EVENT_MODE_CONSUMER = "consumer"
+
+// EventWatcher wakes a sleeping job as soon as a message shows up in its
+// queue. For each sleep it opens a channel on the AMQP connection of the job
+// with a consumer of prefetch 1, and closes it as soon as a message is
+// delivered or the sleep ends. Closing the channel requeues the message that
+// woke the job, so that no message is held while the command runs. Polling
+// keeps working when the broker can't be reached.
+type EventWatcher struct {
+	job       *Job
+	client    *AmqpClient
+	lastError string
+}
+
+func createEventWatcher(job *Job) *EventWatcher {
+	watcher := EventWatcher{
+		job:    job,
+		client: createAmqpClient(job.GetConnectionConfig()),
+	}
+
+	return &watcher
+}
+
+// run waits for the job to go to sleep, then for a message to wake it up
+// before the sleep ends
+func (watcher *EventWatcher) run(ctx context.Context) {
+	for {
+		var sleepContext context.Context
+		select {
+		case <-ctx.Done():
+			return
+		case sleepContext = <-watcher.job.sleepStarted:
+		}
+		if sleepContext.Err() != nil {
+			// The sleep ended before the watcher got to it
+			continue
+		}
+		err := watcher.waitForMessage(ctx, sleepContext)
+		if ctx.Err() != nil {
+			return
+		}
+		if sleepContext.Err() != nil {
+			continue
+		}
+		watcher.reportError(err)
+		if err == nil {
+			watcher.job.wakeUp()
+		}
+	}
+}
+
+// waitForMessage consumes from the queue on a channel of its own until a
+// message is delivered or the sleep ends, then closes the channel
+func (watcher *EventWatcher) waitForMessage(ctx context.Context, sleepContext context.Context) error {
+	connection, err := watcher.client.getConnection()
+	if err != nil {
+		return err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err := channel.Qos(1, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := channel.Consume(watcher.job.GetQueue(), "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sleepContext.Done():
+		return sleepContext.Err()
+	case _, ok := <-deliveries:
+		if !ok {
+			return errors.New("consumer closed by the broker")
+		}
+		return nil
+	}
+}
+
+// reportError logs in the job output only when the watcher starts failing or
+// recovers, so that a broker outage doesn't log once per sleep
+func (watcher *EventWatcher) reportError(err error) {
+	current := ""
+	if err != nil {
+		current = err.Error()
+	}
+	if current == watcher.lastError {
+		return
+	}
+	if err != nil {
+		watcher.job.logOutput([]string{fmt.Sprintf("Event mode unavailable for %v, falling back to polling - Error: %v", watcher.job.describeQueue(), err)})
+	} else {
+		watcher.job.logOutput([]string{fmt.Sprintf("Event mode restored for %v", watcher.job.describeQueue())})
+	}
+	watcher.lastError = current
+}
+
+func (watcher *EventWatcher) Close() {
+	watcher.client.Close()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJob_SleepUntilWoken_WakeUp(t *testing.T) {
+	job := createTestJob("job1", nil)
+	job.SetCurrentSleepTime(60)
+
+	go func() {
+		for !job.wakeUp() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	woken := job.sleepUntilWoken(false)
+
+	if !woken {
+		t.Error("Expected sleep to be reported as woken")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Expected sleep to be interrupted")
+	}
+}
+
+func TestJob_SleepUntilWoken_Timeout(t *testing.T) {
+	job := createTestJob("job1", nil)
+	job.SetCurrentSleepTime(0)
+
+	if job.sleepUntilWoken(false) {
+		t.Error("Expected a plain timeout not to be reported as woken")
+	}
+	if job.wakeUp() {
+		t.Error("Expected wakeUp to do nothing when the job isn't sleeping")
+	}
+}
+
+func TestJob_SleepUntilWoken_Killed(t *testing.T) {
+	job := createTestJob("job1", nil)
+	job.SetCurrentSleepTime(60)
+	job.OwnContextCancel()
+
+	if job.sleepUntilWoken(false) {
+		t.Error("Expected a cancelled job not to be reported as woken")
+	}
+}
+
+func TestJob_SleepUntilWoken_Notify(t *testing.T) {
+	job := createTestJob("job1", nil)
+	job.sleepStarted = make(chan context.Context, 1)
+	job.SetCurrentSleepTime(0)
+
+	job.sleepUntilWoken(false)
+	select {
+	case <-job.sleepStarted:
+		t.Error("Expected no notification without notify")
+	default:
+	}
+
+	job.sleepUntilWoken(true)
+	job.sleepUntilWoken(true)
+	select {
+	case sleepContext := <-job.sleepStarted:
+		if sleepContext.Err() == nil {
+			t.Error("Expected the context of the sleep to be done when it ends")
+		}
+	default:
+		t.Error("Expected a notification with notify")
+	}
+}
+
+func TestEventWatcher_Run_SkipsEndedSleeps(t *testing.T) {
+	tmpDir := t.TempDir() + "/"
+	job := createTestJob("event_job", nil)
+	job.Queue = "work"
+	job.ErrorLogPath = tmpDir
+	job.ConnectionConfig = ConnectionConfig{Name: "main", AmqpEndpoint: "amqp://localhost:59995", Vhost: "/"}
+	job.sleepStarted = make(chan context.Context, 1)
+	job.SetCurrentSleepTime(0)
+	job.sleepUntilWoken(true)
+
+	watcher := createEventWatcher(job)
+	defer watcher.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		watcher.run(ctx)
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-stopped
+
+	// The sleep was over before the watcher took it: no consumer was opened
+	if entries, _ := os.ReadDir(filepath.Join(tmpDir, "event_job")); len(entries) != 0 {
+		t.Errorf("Expected no attempt to consume, got %v", entries)
+	}
+}
+
+func TestEventWatcher_Run_BrokerUnavailable(t *testing.T) {
+	tmpDir := t.TempDir() + "/"
+	job := createTestJob("event_job", nil)
+	job.Queue = "work"
+	job.ErrorLogPath = tmpDir
+	job.ConnectionConfig = ConnectionConfig{Name: "main", AmqpEndpoint: "amqp://localhost:59995", Vhost: "/"}
+	job.sleepStarted = make(chan context.Context, 1)
+	job.SetCurrentSleepTime(1)
+
+	watcher := createEventWatcher(job)
+	defer watcher.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.run(ctx)
+
+	// The job sleeps its whole sleep time: polling is the fallback
+	start := time.Now()
+	woken := job.sleepUntilWoken(true)
+	if woken {
+		t.Error("Expected no wake-up without a broker")
+	}
+	if time.Since(start) < 900*time.Millisecond {
+		t.Error("Expected the job to sleep its full sleep time")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(tmpDir, "event_job"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one log file, got %v (%v)", entries, err)
+	}
+	content, _ := os.ReadFile(filepath.Join(tmpDir, "event_job", entries[0].Name()))
+	if !strings.Contains(string(content), "falling back to polling") {
+		t.Errorf("Expected fallback to be logged, got: %s", content)
+	}
+}
+
+func TestEventWatcher_ReportError_OncePerTransition(t *testing.T) {
+	tmpDir := t.TempDir() + "/"
+	job := createTestJob("event_job", nil)
+	job.Queue = "work"
+	job.ErrorLogPath = tmpDir
+	watcher := createEventWatcher(job)
+
+	watcher.reportError(nil)
+	watcher.reportError(errors.New("connection refused"))
+	watcher.reportError(errors.New("connection refused"))
+	watcher.reportError(errors.New("connection refused"))
+	watcher.reportError(nil)
+	watcher.reportError(nil)
+
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, "event_job"))
+	if len(entries) != 1 {
+		t.Fatalf("Expected one log file, got %v", entries)
+	}
+	content, _ := os.ReadFile(filepath.Join(tmpDir, "event_job", entries[0].Name()))
+	if got := strings.Count(string(content), "falling back to polling"); got != 1 {
+		t.Errorf("Expected the failure to be logged once, got %d times", got)
+	}
+	if got := strings.Count(string(content), "Event mode restored"); got != 1 {
+		t.Errorf("Expected the recovery to be logged once, got %d times", got)
+	}
+}
+
+func TestEventWatcher_Run_StopsWithContext(t *testing.T) {
+	job := createTestJob("event_job", nil)
+	job.sleepStarted = make(chan context.Context, 1)
+	watcher := createEventWatcher(job)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		watcher.run(ctx)
+		close(stopped)
+	}()
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected watcher to stop when its context is cancelled")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sources of the host readings, variables so that tests can replace them
+var procLoadAvgPath = "/proc/loadavg"
+var procMemInfoPath = "/proc/meminfo"
+
+// ResourceLimits holds back the launch of a job while the host is
+// overloaded. Zero values disable a limit.
+type ResourceLimits struct {
+	MaxLoad              float64 `json:"max_load"`
+	MinAvailableMemoryMB int     `json:"min_available_memory_mb"`
+	MinFreeDiskMB        int     `json:"min_free_disk_mb"`
+}
+
+// override returns the limits with the ones set in jobLimits replacing them
+func (limits ResourceLimits) override(jobLimits *ResourceLimits) ResourceLimits {
+	if jobLimits == nil {
+		return limits
+	}
+	if jobLimits.MaxLoad != 0 {
+		limits.MaxLoad = jobLimits.MaxLoad
+	}
+	if jobLimits.MinAvailableMemoryMB != 0 {
+		limits.MinAvailableMemoryMB = jobLimits.MinAvailableMemoryMB
+	}
+	if jobLimits.MinFreeDiskMB != 0 {
+		limits.MinFreeDiskMB = jobLimits.MinFreeDiskMB
+	}
+	return limits
+}
+
+func (limits ResourceLimits) validate() error {
+	if limits.MaxLoad < 0 || limits.MinAvailableMemoryMB < 0 || limits.MinFreeDiskMB < 0 {
+		return errors.New("resource limits can't be negative")
+	}
+	return nil
+}
+
+// check returns why the host is too busy to launch a job in dir, empty when
+// it isn't
+func (limits ResourceLimits) check(dir string) (string, error) {
+	if limits.MaxLoad > 0 {
+		load, err := readLoadAverage()
+		if err != nil {
+			return "", err
+		}
+		if load > limits.MaxLoad {
+			return fmt.Sprintf("load average %.2f above %.2f", load, limits.MaxLoad), nil
+		}
+	}
+	if limits.MinAvailableMemoryMB > 0 {
+		available, err := readAvailableMemoryMB()
+		if err != nil {
+			return "", err
+		}
+		if available < limits.MinAvailableMemoryMB {
+			return fmt.Sprintf("available memory %vMB below %vMB", available, limits.MinAvailableMemoryMB), nil
+		}
+	}
+	if limits.MinFreeDiskMB > 0 {
+		if dir == "" {
+			dir = "."
+		}
+		free, err := readFreeDiskMB(dir)
+		if err != nil {
+			return "", err
+		}
+		if free < limits.MinFreeDiskMB {
+			return fmt.Sprintf("free disk on %v %vMB below %vMB", dir, free, limits.MinFreeDiskMB), nil
+		}
+	}
+	return "", nil
+}
+
+// readLoadAverage returns the load average of the last minute
+func readLoadAverage() (float64, error) {
+	content, err := os.ReadFile(procLoadAvgPath)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%v is empty", procLoadAvgPath)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func readAvailableMemoryMB() (int, error) {
+	file, err := os.Open(procMemInfoPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kilobytes, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable in %v: %w", procMemInfoPath, err)
+			}
+			return kilobytes / 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable missing from %v", procMemInfoPath)
+}
+
+func readFreeDiskMB(dir string) (int, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int(stat.Bavail * uint64(stat.Bsize) / (1024 * 1024)), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useFakeProc points the host readings to files holding loadavg and meminfo
+func useFakeProc(t *testing.T, loadavg string, meminfo string) {
+	t.Helper()
+	dir := t.TempDir()
+	loadAvgPath := filepath.Join(dir, "loadavg")
+	memInfoPath := filepath.Join(dir, "meminfo")
+	os.WriteFile(loadAvgPath, []byte(loadavg), 0644)
+	os.WriteFile(memInfoPath, []byte(meminfo), 0644)
+
+	previousLoadAvgPath, previousMemInfoPath := procLoadAvgPath, procMemInfoPath
+	procLoadAvgPath, procMemInfoPath = loadAvgPath, memInfoPath
+	t.Cleanup(func() {
+		procLoadAvgPath, procMemInfoPath = previousLoadAvgPath, previousMemInfoPath
+	})
+}
+
+const testMemInfo = `MemTotal:       16318864 kB
+MemFree:          512000 kB
+MemAvailable:    2097152 kB
+SwapTotal:       2097148 kB
+`
+
+func TestResourceLimits_Override(t *testing.T) {
+	global := ResourceLimits{MaxLoad: 8, MinAvailableMemoryMB: 512}
+
+	if got := global.override(nil); got != global {
+		t.Errorf("Expected global limits without job limits, got %+v", got)
+	}
+	got := global.override(&ResourceLimits{MaxLoad: 2, MinFreeDiskMB: 100})
+	if got != (ResourceLimits{MaxLoad: 2, MinAvailableMemoryMB: 512, MinFreeDiskMB: 100}) {
+		t.Errorf("Expected job limits to override the global ones, got %+v", got)
+	}
+}
+
+func TestResourceLimits_Check(t *testing.T) {
+	useFakeProc(t, "3.50 2.10 1.00 2/345 6789\n", testMemInfo)
+
+	reason, err := ResourceLimits{}.check("")
+	if err != nil || reason != "" {
+		t.Errorf("Expected no limit to hold back, got %q (%v)", reason, err)
+	}
+
+	reason, _ = ResourceLimits{MaxLoad: 4}.check("")
+	if reason != "" {
+		t.Errorf("Expected load under the limit, got %q", reason)
+	}
+	reason, _ = ResourceLimits{MaxLoad: 3}.check("")
+	if !strings.Contains(reason, "load average 3.50") {
+		t.Errorf("Expected load to hold back, got %q", reason)
+	}
+
+	reason, _ = ResourceLimits{MinAvailableMemoryMB: 2048}.check("")
+	if reason != "" {
+		t.Errorf("Expected 2048MB available to be enough, got %q", reason)
+	}
+	reason, _ = ResourceLimits{MinAvailableMemoryMB: 4096}.check("")
+	if !strings.Contains(reason, "available memory 2048MB") {
+		t.Errorf("Expected memory to hold back, got %q", reason)
+	}
+
+	reason, _ = ResourceLimits{MinFreeDiskMB: 1 << 30}.check(t.TempDir())
+	if !strings.Contains(reason, "free disk") {
+		t.Errorf("Expected disk to hold back, got %q", reason)
+	}
+	reason, _ = ResourceLimits{MinFreeDiskMB: 1}.check(t.TempDir())
+	if reason != "" {
+		t.Errorf("Expected 1MB free disk to be enough, got %q", reason)
+	}
+}
+
+func TestResourceLimits_Check_Unreadable(t *testing.T) {
+	useFakeProc(t, "", "MemTotal: 100 kB\n")
+
+	if _, err := (ResourceLimits{MaxLoad: 1}).check(""); err == nil {
+		t.Error("Expected error for empty loadavg")
+	}
+	if _, err := (ResourceLimits{MinAvailableMemoryMB: 1}).check(""); err == nil {
+		t.Error("Expected error for meminfo without MemAvailable")
+	}
+	if _, err := (ResourceLimits{MinFreeDiskMB: 1}).check("/nonexistent/dir"); err == nil {
+		t.Error("Expected error for missing directory")
+	}
+}
+
+func TestJob_IsThrottled(t *testing.T) {
+	useFakeProc(t, "12.00 10.00 8.00 2/345 6789\n", testMemInfo)
+	job := createTestJob("job1", nil)
+	job.resourceLimits = ResourceLimits{MaxLoad: 4}
+
+	if !job.isThrottled() {
+		t.Error("Expected the job to be throttled")
+	}
+	job.SetStatus(STATUS_THROTTLED)
+	if job.getStatusName() != "THROTTLED" {
+		t.Errorf("Expected THROTTLED status, got %v", job.getStatusName())
+	}
+
+	job.resourceLimits = ResourceLimits{MaxLoad: 16}
+	if job.isThrottled() {
+		t.Error("Expected the job not to be throttled any more")
+	}
+	if job.getThrottleReason() != "" {
+		t.Errorf("Expected reason to be cleared, got %q", job.getThrottleReason())
+	}
+}
+
+func TestJob_IsThrottled_UnreadableHost(t *testing.T) {
+	useFakeProc(t, "", testMemInfo)
+	job := createTestJob("job1", nil)
+	job.resourceLimits = ResourceLimits{MaxLoad: 4}
+
+	if job.isThrottled() {
+		t.Error("Expected the job not to be held back when the host can't be read")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,22 +19,34 @@ import (
 )
 
 type Job struct {
-	Name              string   `json:"name"`
-	Groups            []string `json:"groups"`
-	SleepTime         int      `json:"sleep_time"`
-	SleepIncrement    int      `json:"sleep_increment"`
-	MaxSleep          int      `json:"max_sleep"`
-	MinMessages       int      `json:"min_messages"`
-	WorkingDir        string   `json:"working_dir"`
-	UserId            string   `json:"user"`
-	Command           string   `json:"command"`
-	Spawn             int      `json:"spawn"`
-	ConnectionName    string   `json:"connection"`
-	Queue             string   `json:"queue"`
-	ErrorLogPath      string   `json:"error_log_path"`
-	ErrorLogMaxKBSize float64  `json:"error_log_max_kb_size"`
-	ErrorLogMaxFiles  int      `json:"error_log_max_files"`
-	MaxExecution      int64    `json:"max_execution"`
+	Name              string          `json:"name"`
+	Groups            []string        `json:"groups"`
+	SleepTime         int             `json:"sleep_time"`
+	SleepIncrement    int             `json:"sleep_increment"`
+	MaxSleep          int             `json:"max_sleep"`
+	MinMessages       int             `json:"min_messages"`
+	WorkingDir        string          `json:"working_dir"`
+	UserId            string          `json:"user"`
+	Command           string          `json:"command"`
+	Spawn             int             `json:"spawn"`
+	ConnectionName    string          `json:"connection"`
+	Queue             string          `json:"queue"`
+	Stream            string          `json:"stream"`
+	Consumer          string          `json:"consumer"`
+	Delivery          string          `json:"delivery"`
+	BatchSize         int             `json:"batch_size"`
+	EventMode         string          `json:"event_mode"`
+	ErrorLogPath      string          `json:"error_log_path"`
+	ErrorLogMaxKBSize float64         `json:"error_log_max_kb_size"`
+	ErrorLogMaxFiles  int             `json:"error_log_max_files"`
+	MaxExecution      int64           `json:"max_execution"`
+	PauseOnAlarm      bool            `json:"pause_on_alarm"`
+	ResourceLimits    *ResourceLimits `json:"resource_limits"`
+	Priority          int             `json:"priority"`
+	ConflictsWith     []string        `json:"conflicts_with"`
+	After             []string        `json:"after"`
+	OnSuccess         bool            `json:"on_success"`
+	Extends           string          `json:"extends"`
 	PID               int
 	MainPid           int
 	CurrentSleepTime  int
@@ -45,6 +58,24 @@ type Job struct {
 	StartedAt         int64
 	OwnContext        context.Context
 	OwnContextCancel  context.CancelFunc
+	wakeUpSleep       context.CancelFunc
+	sleepStarted      chan context.Context // the context of each sleep, for the event watcher
+	lastQueueInfo     *QueueInfo
+	lastPollAt        time.Time
+	alarmPauses       map[string]string // alarm raised, by connection name
+	resourceLimits    ResourceLimits    // global limits overridden by the job ones
+	throttleReason    string
+	baseName          string // name in the configuration, before spawning
+	pendingRun        *RunRequest
+	lastRunId         string
+	runCounter        int
+	loopDone          chan struct{} // closed when the loop started by start ends
+	pauseInfo         *PauseInfo
+	restartPending    bool // the loop is restarted when it ends
+	loopWaitGroup     *sync.WaitGroup
+	definition        []byte // JSON of a job added with add-job
+	origin            *jobOrigin
+	resourceError     string
 	mu                sync.RWMutex // protects concurrent access to mutable fields
 }
 
@@ -52,6 +83,9 @@ const STATUS_SLEEP = 0
 const STATUS_RUNNING = 1
 const STATUS_PAUSED = 2
 const STATUS_TERMINATED = 3
+const STATUS_THROTTLED = 4
+const STATUS_QUEUED = 5
+const STATUS_BLOCKED = 6
 
 // Thread-safe getters and setters for mutable fields
 
@@ -79,6 +113,103 @@ func (job *Job) SetPause(pause bool) {
 	job.Pause = pause
 }
 
+// setAlarmPause records the alarm raised by a connection, an empty alarm
+// meaning that it cleared. The job stays paused while any alarm is raised.
+func (job *Job) setAlarmPause(connectionName string, alarm string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if alarm == "" {
+		delete(job.alarmPauses, connectionName)
+		return
+	}
+	if job.alarmPauses == nil {
+		job.alarmPauses = make(map[string]string)
+	}
+	job.alarmPauses[connectionName] = alarm
+}
+
+// isThrottled checks the resource limits of the job against the host,
+// logging when the job starts and stops being held back. The job isn't held
+// back when the host can't be read.
+func (job *Job) isThrottled() bool {
+	job.mu.RLock()
+	limits := job.resourceLimits
+	workingDir := job.WorkingDir
+	job.mu.RUnlock()
+
+	reason, err := limits.check(workingDir)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if err != nil {
+		if err.Error() != job.resourceError {
+			log.Printf("For job: \"%v\" can't check host resources, launching anyway: %v\n", job.Name, err)
+		}
+		job.resourceError = err.Error()
+	} else {
+		job.resourceError = ""
+	}
+	if reason != "" && job.throttleReason == "" {
+		log.Printf("For job: \"%v\" launch held back: %v\n", job.Name, reason)
+	} else if reason == "" && job.throttleReason != "" {
+		log.Printf("For job: \"%v\" host resources available again\n", job.Name)
+	}
+	job.throttleReason = reason
+	return reason != ""
+}
+
+func (job *Job) getThrottleReason() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.throttleReason
+}
+
+// getAlarmReason describes the alarms keeping the job paused
+func (job *Job) getAlarmReason() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	var reasons []string
+	for connectionName, alarm := range job.alarmPauses {
+		reasons = append(reasons, fmt.Sprintf("%v (connection %q)", alarm, connectionName))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ", ")
+}
+
+func (job *Job) isAlarmPaused() bool {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return len(job.alarmPauses) > 0
+}
+
+// pause pauses the job and saves why and by whom in the state file
+func (job *Job) pause(info PauseInfo) {
+	info.At = time.Now()
+	job.setPauseInfo(&info)
+	stateStore.recordPause(job.Name, &info)
+}
+
+func (job *Job) unpause() {
+	job.mu.Lock()
+	job.Pause = false
+	job.pauseInfo = nil
+	job.mu.Unlock()
+	stateStore.recordPause(job.Name, nil)
+}
+
+func (job *Job) setPauseInfo(info *PauseInfo) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Pause = true
+	job.pauseInfo = info
+}
+
+func (job *Job) getPauseInfo() *PauseInfo {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.pauseInfo
+}
+
 func (job *Job) GetStop() bool {
 	job.mu.RLock()
 	defer job.mu.RUnlock()
@@ -163,6 +294,21 @@ func (job *Job) GetMaxSleep() int {
 	return job.MaxSleep
 }
 
+// getBaseName returns the name of the job in the configuration, shared by
+// its spawned copies
+func (job *Job) getBaseName() string {
+	if job.baseName == "" {
+		return job.Name
+	}
+	return job.baseName
+}
+
+func (job *Job) GetPriority() int {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.Priority
+}
+
 func (job *Job) GetMaxExecution() int64 {
 	job.mu.RLock()
 	defer job.mu.RUnlock()
@@ -205,6 +351,115 @@ func (job *Job) SetMaxExecution(maxExecution int64) {
 	job.MaxExecution = maxExecution
 }
 
+func (job *Job) GetCommand() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.Command
+}
+
+func (job *Job) SetCommand(command string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Command = command
+}
+
+func (job *Job) GetWorkingDir() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.WorkingDir
+}
+
+func (job *Job) SetWorkingDir(workingDir string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.WorkingDir = workingDir
+}
+
+func (job *Job) GetUserId() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.UserId
+}
+
+func (job *Job) SetUserId(userId string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.UserId = userId
+}
+
+func (job *Job) GetQueue() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.Queue
+}
+
+func (job *Job) SetQueue(queue string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Queue = queue
+}
+
+func (job *Job) GetGroups() []string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.Groups
+}
+
+func (job *Job) SetGroups(groups []string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Groups = groups
+}
+
+func (job *Job) GetConnectionConfig() ConnectionConfig {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.ConnectionConfig
+}
+
+func (job *Job) SetConnection(connectionConfig ConnectionConfig) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.ConnectionName = connectionConfig.Name
+	job.ConnectionConfig = connectionConfig
+}
+
+func (job *Job) GetErrorLogPath() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.ErrorLogPath
+}
+
+func (job *Job) SetErrorLogPath(errorLogPath string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.ErrorLogPath = errorLogPath
+}
+
+func (job *Job) GetErrorLogMaxKBSize() float64 {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.ErrorLogMaxKBSize
+}
+
+func (job *Job) SetErrorLogMaxKBSize(errorLogMaxKBSize float64) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.ErrorLogMaxKBSize = errorLogMaxKBSize
+}
+
+func (job *Job) GetErrorLogMaxFiles() int {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.ErrorLogMaxFiles
+}
+
+func (job *Job) SetErrorLogMaxFiles(errorLogMaxFiles int) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.ErrorLogMaxFiles = errorLogMaxFiles
+}
+
 func (job *Job) getStatus() map[string]interface{} {
 	job.mu.RLock()
 	defer job.mu.RUnlock()
@@ -228,9 +483,18 @@ func (job *Job) getStatusNameLocked() string {
 	case STATUS_RUNNING:
 		return "RUNNING"
 	case STATUS_PAUSED:
+		if !job.Pause && len(job.alarmPauses) > 0 {
+			return "PAUSED (ALARM)"
+		}
 		return "PAUSED"
 	case STATUS_TERMINATED:
 		return "TERMINATED"
+	case STATUS_THROTTLED:
+		return "THROTTLED"
+	case STATUS_QUEUED:
+		return "QUEUED"
+	case STATUS_BLOCKED:
+		return "BLOCKED"
 	default:
 		return "UNKNOWN"
 	}
@@ -245,17 +509,58 @@ func (job *Job) getStatusName() string {
 func (job *Job) executeCommand(wg *sync.WaitGroup) {
 	defer wg.Done()
 	log.Println("Starting Job: " + job.Name)
-	rmqc := createClient(job.ConnectionConfig.Endpoint, job.ConnectionConfig.Username, job.ConnectionConfig.Password)
+	connector, err := createConnector(job.GetConnectionConfig())
+	if err != nil {
+		log.Printf("For job: \"%v\" %v. Cannot be executed\n", job.Name, err)
+		job.SetStatus(STATUS_TERMINATED)
+		return
+	}
+	defer connector.Close()
+	var deliveryClient *DeliveryClient
+	if job.Delivery != "" {
+		if job.Delivery != DELIVERY_STDIN && job.Delivery != DELIVERY_FILE {
+			log.Printf("For job: \"%v\" delivery \"%v\" is not supported. Cannot be executed\n", job.Name, job.Delivery)
+			job.SetStatus(STATUS_TERMINATED)
+			return
+		}
+		deliveryClient = createDeliveryClient(job.GetConnectionConfig())
+		defer deliveryClient.Close()
+	}
+	if job.EventMode != "" {
+		if job.EventMode != EVENT_MODE_CONSUMER {
+			log.Printf("For job: \"%v\" event mode \"%v\" is not supported. Cannot be executed\n", job.Name, job.EventMode)
+			job.SetStatus(STATUS_TERMINATED)
+			return
+		}
+		job.sleepStarted = make(chan context.Context, 1)
+		eventWatcher := createEventWatcher(job)
+		watchContext, stopWatching := context.WithCancel(job.OwnContext)
+		go eventWatcher.run(watchContext)
+		defer eventWatcher.Close()
+		defer stopWatching()
+	}
 	runningUserId, err := job.returnUserId()
 	if err != nil {
-		log.Printf("For job: \"%v\" could not recover user \"%v\". Cannot be executed\n", job.Name, job.UserId)
+		log.Printf("For job: \"%v\" could not recover user \"%v\". Cannot be executed\n", job.Name, job.GetUserId())
 		job.SetStop(true)
 	}
 	runningUserMainGroup, runningUserGroups, err := job.returnUserGroups()
 	if err != nil {
-		log.Printf("For job: \"%v\" could not recover groups for user \"%v\". Cannot be executed\n", job.Name, job.UserId)
+		log.Printf("For job: \"%v\" could not recover groups for user \"%v\". Cannot be executed\n", job.Name, job.GetUserId())
 		job.SetStop(true)
 	}
+	var slot *Slot
+	started, succeeded := false, false
+	defer func() {
+		if slot != nil {
+			slots.release(slot)
+		}
+		if started {
+			jobRelations.finish(job, false, false)
+		}
+	}()
+	woken := false
+	savedSleepTime := job.GetCurrentSleepTime()
 LOOP:
 	for {
 		if job.GetStop() {
@@ -264,7 +569,8 @@ LOOP:
 		if !job.checkIfStillActive(job.MainPid) {
 			break LOOP
 		}
-		if job.GetPause() {
+		// A run requested with run-now goes through a pause
+		if (job.GetPause() || job.isAlarmPaused()) && !job.hasRunRequest() {
 			if job.GetStatus() != STATUS_PAUSED {
 				job.SetStatus(STATUS_PAUSED)
 				job.SetCurrentSleepTime(job.GetSleepTime())
@@ -273,11 +579,54 @@ LOOP:
 			continue
 		}
 		job.SetStatus(STATUS_SLEEP)
-		queueMessages, execute := rmqc.getMessages(job)
+		request := job.takeRunRequest()
+		// Why a requested run didn't execute, recorded in the history
+		skipReason := "the queue could not be polled"
+		queueMessages, execute := getMessages(connector, job)
+		minMessages := job.GetMinMessages()
+		if request != nil && request.IgnoreThreshold {
+			execute, minMessages = true, 0
+		}
+		if execute && minMessages > queueMessages {
+			skipReason = fmt.Sprintf("%d messages in queue, below min_messages %d", queueMessages, minMessages)
+		}
+		if execute && minMessages <= queueMessages && job.isThrottled() {
+			// Retried after the normal sleep
+			job.SetStatus(STATUS_THROTTLED)
+			execute = false
+			skipReason = "held back: " + job.getThrottleReason()
+		}
+		if execute && minMessages <= queueMessages {
+			var blockedReason string
+			if started, blockedReason = jobRelations.tryStart(job); !started {
+				// Retried after the normal sleep
+				job.SetStatus(STATUS_BLOCKED)
+				execute = false
+				skipReason = "blocked: " + blockedReason
+			}
+		}
+		if execute && minMessages <= queueMessages {
+			job.SetStatus(STATUS_QUEUED)
+			slot, err = slots.acquire(job.OwnContext, job.GetGroups(), job.GetPriority())
+			if err != nil {
+				job.skipRun(request, "the job was stopped")
+				break LOOP
+			}
+		}
+		var batch *DeliveryBatch
+		if execute && deliveryClient != nil && minMessages <= queueMessages {
+			batch, execute = job.fetchDelivery(deliveryClient, runningUserId, runningUserMainGroup)
+			skipReason = "no message to deliver"
+		}
+		executed := false
 		if execute {
-			if job.GetMinMessages() <= queueMessages {
+			if minMessages <= queueMessages {
+				executed = true
+				runId := job.startRun(request)
+				runStartedAt := time.Now()
 				job.SetStatus(STATUS_RUNNING)
-				stringCommand := strings.Fields(job.Command)
+				command := job.GetCommand()
+				stringCommand := strings.Fields(command)
 				app, minusApp := stringCommand[0], stringCommand[1:]
 				commandContext := context.Background()
 				var cancelCommandContext context.CancelFunc
@@ -287,10 +636,10 @@ LOOP:
 					defer cancelCommandContext()
 				}
 				cmd := exec.CommandContext(commandContext, app, minusApp...)
-				if job.WorkingDir != "" {
-					absolutePath, error := filepath.Abs(job.WorkingDir)
+				if workingDir := job.GetWorkingDir(); workingDir != "" {
+					absolutePath, error := filepath.Abs(workingDir)
 					if error != nil {
-						log.Printf("For job: \"%v\" the directory \"%v\" does not exists. Cannot be executed\n", job.Name, job.WorkingDir)
+						log.Printf("For job: \"%v\" the directory \"%v\" does not exists. Cannot be executed\n", job.Name, workingDir)
 						break LOOP
 					}
 					cmd.Dir = absolutePath
@@ -304,27 +653,46 @@ LOOP:
 						NoSetGroups: false,
 					}
 				}
+				if batch != nil {
+					batch.attach(cmd)
+				}
 				job.SetCmdExecutable(cmd)
 				stdout, _ := cmd.StdoutPipe()
 				stderr, _ := cmd.StderrPipe()
 				startErr := cmd.Start()
 				if startErr != nil {
-					log.Printf("For job: \"%v\" the command: \"%v\" cannot be executed. Output: %v\n", job.Name, job.Command, startErr)
+					log.Printf("For job: \"%v\" the command: \"%v\" cannot be executed. Output: %v\n", job.Name, command, startErr)
+					if batch != nil {
+						job.settleDelivery(batch, false)
+					}
 					break LOOP
 				}
 				now := time.Now()
 				job.SetStartedAt(now.Unix())
 				job.SetPID(cmd.Process.Pid)
-				if job.ErrorLogPath != "" {
+				if job.GetErrorLogPath() != "" {
 					scanner := bufio.NewScanner(io.MultiReader(stdout, stderr))
 					var output []string
 					scanner.Split(bufio.ScanWords)
 					for scanner.Scan() {
 						output = append(output, scanner.Text())
 					}
-					job.logOutput(output)
+					if len(output) > 0 {
+						job.logOutput(append([]string{"[run " + runId + "]"}, output...))
+					}
+				}
+				waitErr := cmd.Wait()
+				succeeded = waitErr == nil && commandContext.Err() == nil
+				stateStore.recordRun(job.Name, RunRecord{
+					RunId:     runId,
+					StartedAt: runStartedAt,
+					EndedAt:   time.Now(),
+					ExitCode:  cmd.ProcessState.ExitCode(),
+					Success:   succeeded,
+				})
+				if batch != nil {
+					job.settleDelivery(batch, succeeded)
 				}
-				cmd.Wait()
 				if commandContext.Err() == context.DeadlineExceeded {
 					var deadlineOutput []string
 					job.logOutput(append(deadlineOutput, fmt.Sprintf("Job \"%v\" exceeded max execution time of %v seconds. Process Killed.", job.Name, maxExecution)))
@@ -335,7 +703,20 @@ LOOP:
 				job.SetCurrentSleepTime(job.GetSleepTime())
 			}
 		}
-		job.Sleep(job.OwnContext)
+		if !executed {
+			job.skipRun(request, skipReason)
+		}
+		if slot != nil {
+			slots.release(slot)
+			slot = nil
+		}
+		if started {
+			jobRelations.finish(job, executed, succeeded)
+			started, succeeded = false, false
+		}
+		// A wake-up that didn't lead to an execution (e.g. less than MinMessages
+		// in queue) is followed by a plain polling sleep, not to wake up in a loop
+		woken = job.sleepUntilWoken(!woken || executed)
 		currentSleep := job.GetCurrentSleepTime()
 		sleepIncrement := job.GetSleepIncrement()
 		maxSleep := job.GetMaxSleep()
@@ -344,14 +725,89 @@ LOOP:
 			newSleepTime = maxSleep
 		}
 		job.SetCurrentSleepTime(newSleepTime)
+		if newSleepTime != savedSleepTime {
+			stateStore.recordSleepTime(job.Name, newSleepTime)
+			savedSleepTime = newSleepTime
+		}
 	}
+	job.skipRun(job.takeRunRequest(), "the job was stopped")
 	job.SetStatus(STATUS_TERMINATED)
 	log.Println("Ending Job: " + job.Name)
 }
 
+func (job *Job) getBatchSize() int {
+	if job.BatchSize < 1 {
+		return 1
+	}
+	return job.BatchSize
+}
+
+// fetchDelivery takes the messages handed to the command. The command is not
+// executed when nothing could be fetched (e.g. another consumer was faster)
+func (job *Job) fetchDelivery(client *DeliveryClient, uid uint32, gid uint32) (*DeliveryBatch, bool) {
+	deliveries, err := client.fetch(job.GetQueue(), job.getBatchSize())
+	if err != nil {
+		job.logOutput([]string{fmt.Sprintf("Can't fetch messages for delivery from %v - Error: %v", job.describeQueue(), err)})
+		return nil, false
+	}
+	if len(deliveries) == 0 {
+		return nil, false
+	}
+	batch, err := createDeliveryBatch(deliveries, job.Delivery, uid, gid)
+	if err != nil {
+		job.logOutput([]string{fmt.Sprintf("Can't prepare delivery of %d messages - Error: %v", len(deliveries), err)})
+		for _, delivery := range deliveries {
+			delivery.Nack(false, true)
+		}
+		return nil, false
+	}
+	return batch, true
+}
+
+func (job *Job) settleDelivery(batch *DeliveryBatch, success bool) {
+	err := batch.settle(success)
+	if err != nil {
+		job.logOutput([]string{fmt.Sprintf("Can't settle delivered messages from %v - Error: %v", job.describeQueue(), err)})
+	}
+}
+
+func (job *Job) recordQueueInfo(queueInfo *QueueInfo) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.lastQueueInfo = queueInfo
+	job.lastPollAt = time.Now()
+}
+
+// getLastQueueInfo returns what the last successful poll observed, nil when
+// the queue hasn't been polled yet
+func (job *Job) getLastQueueInfo() (*QueueInfo, time.Time) {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.lastQueueInfo, job.lastPollAt
+}
+
+func (job *Job) logConnectionError(err error) {
+	var arrayOutput []string
+	output := fmt.Sprintf("Can't connect to %v - Error: %v", job.describeQueue(), err)
+	arrayOutput = append(arrayOutput, output)
+	job.logOutput(arrayOutput)
+}
+
+// describeQueue names what the job polls, in the terms of its connection type
+func (job *Job) describeQueue() string {
+	connectionConfig := job.GetConnectionConfig()
+	switch connectionConfig.getType() {
+	case CONNECTION_TYPE_NATS:
+		return fmt.Sprintf("consumer: %v on stream: %v", job.Consumer, job.Stream)
+	case CONNECTION_TYPE_SQS:
+		return fmt.Sprintf("queue: %v in region: %v", job.GetQueue(), connectionConfig.Region)
+	}
+	return fmt.Sprintf("queue: %v on vhost: %v", job.GetQueue(), connectionConfig.Vhost)
+}
+
 func (job *Job) logFolder() (string, error) {
-	if job.ErrorLogPath != "" {
-		logFolder := job.ErrorLogPath + job.Name
+	if errorLogPath := job.GetErrorLogPath(); errorLogPath != "" {
+		logFolder := errorLogPath + job.Name
 		if _, err := os.Stat(logFolder); os.IsNotExist(err) {
 			err := os.Mkdir(logFolder, 0760)
 			if err != nil {
@@ -386,7 +842,7 @@ func (job *Job) getLogFile(logFolder string) (*os.File, error) {
 			return filesArray[i] < filesArray[j]
 		})
 		loggingFileName := filesArray[len(filesArray)-1]
-		if job.ErrorLogMaxFiles >= 1 && job.ErrorLogMaxFiles < len(filesArray) {
+		if maxFiles := job.GetErrorLogMaxFiles(); maxFiles >= 1 && maxFiles < len(filesArray) {
 			err := os.Remove(logFolder + "/" + filesArray[0])
 			if err != nil {
 				log.Println("Can't remove file")
@@ -400,14 +856,14 @@ func (job *Job) getLogFile(logFolder string) (*os.File, error) {
 			log.Printf("Can't open log file %v\n", logFolder+"/"+loggingFileName)
 		}
 
-		if job.ErrorLogMaxKBSize > 0 {
+		if maxKBSize := job.GetErrorLogMaxKBSize(); maxKBSize > 0 {
 			logFileStats, err := os.Stat(logFile.Name())
 			if err != nil {
 				log.Println("Can't get stats of log file")
 				return nil, err
 			}
 
-			if float64(logFileStats.Size()) >= (job.ErrorLogMaxKBSize * 1024) {
+			if float64(logFileStats.Size()) >= (maxKBSize * 1024) {
 				logName := strconv.FormatInt(now.Unix(), 10) + "_log.txt"
 				newLogPath := logFolder + "/" + logName
 				logFile, err = os.Create(newLogPath)
@@ -432,7 +888,7 @@ func (job *Job) getLogFile(logFolder string) (*os.File, error) {
 }
 
 func (job *Job) logOutput(output []string) {
-	if job.ErrorLogPath != "" {
+	if job.GetErrorLogPath() != "" {
 		now := time.Now()
 		formatted := fmt.Sprintf("%d-%02d-%02dT%02d:%02d:%02d",
 			now.Year(), now.Month(), now.Day(),
@@ -486,8 +942,65 @@ func (job *Job) Sleep(ctx context.Context) error {
 	}
 }
 
-func (job *Job) clone(numberItem int) Job {
-	newJob := Job{
+// sleepUntilWoken sleeps like Sleep, unless wakeUp is called in the meantime.
+// With notify the event watcher, if any, is told that the job sleeps and
+// stops watching when the sleep ends. It returns true when the sleep was cut short by wakeUp
+func (job *Job) sleepUntilWoken(notify bool) bool {
+	sleepContext, wakeUp := context.WithCancel(job.OwnContext)
+	defer wakeUp()
+	job.mu.Lock()
+	job.wakeUpSleep = wakeUp
+	if job.pendingRun != nil || job.Stop {
+		// Requested while the job was busy
+		wakeUp()
+	}
+	job.mu.Unlock()
+	if notify {
+		job.notifySleeping(sleepContext)
+	}
+
+	job.Sleep(sleepContext)
+
+	job.mu.Lock()
+	job.wakeUpSleep = nil
+	job.mu.Unlock()
+	return sleepContext.Err() != nil && job.OwnContext.Err() == nil
+}
+
+// wakeUp interrupts the current sleep of the job, if it is sleeping
+func (job *Job) wakeUp() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.wakeUpSleep == nil {
+		return false
+	}
+	job.wakeUpSleep()
+	job.wakeUpSleep = nil
+	return true
+}
+
+// notifySleeping tells the event watcher, if any, that the job is about to
+// sleep until the context is done. The notice of a previous sleep the
+// watcher didn't take yet is replaced.
+func (job *Job) notifySleeping(sleepContext context.Context) {
+	if job.sleepStarted == nil {
+		return
+	}
+	for {
+		select {
+		case job.sleepStarted <- sleepContext:
+			return
+		default:
+		}
+		select {
+		case <-job.sleepStarted:
+		default:
+		}
+	}
+}
+
+func (job *Job) clone(numberItem int) *Job {
+	newJob := &Job{
 		Name:              job.Name + "_" + strconv.Itoa(numberItem),
 		Groups:            job.Groups,
 		SleepTime:         job.SleepTime,
@@ -500,10 +1013,25 @@ func (job *Job) clone(numberItem int) Job {
 		Spawn:             1,
 		ConnectionName:    job.ConnectionName,
 		Queue:             job.Queue,
+		Stream:            job.Stream,
+		Consumer:          job.Consumer,
+		Delivery:          job.Delivery,
+		BatchSize:         job.BatchSize,
+		EventMode:         job.EventMode,
 		ErrorLogPath:      job.ErrorLogPath,
 		ErrorLogMaxKBSize: job.ErrorLogMaxKBSize,
 		ErrorLogMaxFiles:  job.ErrorLogMaxFiles,
 		MaxExecution:      job.MaxExecution,
+		PauseOnAlarm:      job.PauseOnAlarm,
+		ResourceLimits:    job.ResourceLimits,
+		Priority:          job.Priority,
+		ConflictsWith:     job.ConflictsWith,
+		After:             job.After,
+		OnSuccess:         job.OnSuccess,
+		Extends:           job.Extends,
+		baseName:          job.getBaseName(),
+		origin:            job.origin,
+		resourceLimits:    job.resourceLimits,
 		// mu is zero-initialized automatically (new mutex)
 	}
 
@@ -553,67 +1081,193 @@ func (job *Job) returnUserGroups() (uint32, []uint32, error) {
 }
 
 func (job *Job) updateProperties(properties []string) error {
+	apply, restart, err := job.propertyChange(properties)
+	if err != nil {
+		return err
+	}
+	return job.applyChange(apply, restart)
+}
+
+// propertyChange reads the new value of a property, as update-job gives it.
+// It returns the change to make on the job and whether the loop must restart
+// to use it.
+func (job *Job) propertyChange(properties []string) (func(target *Job), bool, error) {
 	if len(properties) < 2 {
-		return errors.New("updateProperties requires at least 2 arguments: property name and value")
+		return nil, false, errors.New("updateProperties requires at least 2 arguments: property name and value")
 	}
+	var apply func(target *Job)
+	restart := false
 	propertyToUpdate := properties[0]
 	switch propertyToUpdate {
 	case "min_messages":
 		newMinMessages, err := strconv.Atoi(properties[1])
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		if newMinMessages < 0 {
-			return errors.New("You cannot set a negative value")
+			return nil, false, errors.New("You cannot set a negative value")
 		}
-		job.SetMinMessages(newMinMessages)
+		apply = func(target *Job) { target.MinMessages = newMinMessages }
 	case "sleep_time":
 		newSleepTime, err := strconv.Atoi(properties[1])
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		if newSleepTime < 0 {
-			return errors.New("You cannot set a negative value")
+			return nil, false, errors.New("You cannot set a negative value")
 		}
-		job.SetSleepTime(newSleepTime)
+		apply = func(target *Job) { target.SleepTime = newSleepTime }
 	case "sleep_increment":
 		newSleepIncrement, err := strconv.Atoi(properties[1])
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		if newSleepIncrement < 0 {
-			return errors.New("You cannot set a negative value")
+			return nil, false, errors.New("You cannot set a negative value")
 		}
-		job.SetSleepIncrement(newSleepIncrement)
+		apply = func(target *Job) { target.SleepIncrement = newSleepIncrement }
 	case "max_sleep":
 		newMaxSleep, err := strconv.Atoi(properties[1])
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		if newMaxSleep < 0 {
-			return errors.New("You cannot set a negative value")
+			return nil, false, errors.New("You cannot set a negative value")
 		}
-		job.SetMaxSleep(newMaxSleep)
+		apply = func(target *Job) { target.MaxSleep = newMaxSleep }
 	case "spawn":
-		newSpawn, err := strconv.Atoi(properties[1])
-		if err != nil {
-			return err
-		}
-		if newSpawn <= 0 {
-			return errors.New("You cannot set a negative value or 0")
-		}
-		job.SetSpawn(newSpawn)
+		// The copies of a job are made when the config file is loaded
+		return nil, false, errors.New("spawn can't be changed at runtime, it needs a restart: change it in the config file and restart the supervisor")
 	case "max_execution":
 		newMaxExecution, err := strconv.Atoi(properties[1])
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		if newMaxExecution < 0 {
-			return errors.New("You cannot set a negative value")
+			return nil, false, errors.New("You cannot set a negative value")
+		}
+		apply = func(target *Job) { target.MaxExecution = int64(newMaxExecution) }
+	case "command":
+		newCommand := strings.Join(properties[1:], " ")
+		if err := validateCommand(newCommand); err != nil {
+			return nil, false, err
+		}
+		apply = func(target *Job) { target.Command = newCommand }
+	case "working_dir":
+		if err := validateWorkingDir(properties[1]); err != nil {
+			return nil, false, err
+		}
+		apply = func(target *Job) { target.WorkingDir = properties[1] }
+	case "user":
+		if err := validateUser(properties[1]); err != nil {
+			return nil, false, err
+		}
+		apply = func(target *Job) { target.UserId = properties[1] }
+		restart = true
+	case "queue":
+		if err := validateQueue(properties[1]); err != nil {
+			return nil, false, err
 		}
-		job.SetMaxExecution(int64(newMaxExecution))
+		apply = func(target *Job) { target.Queue = properties[1] }
+		// The event watcher consumes from the queue it started with
+		restart = job.EventMode != ""
+	case "connection":
+		connectionConfig, err := jobKiller.getConnectionByName(properties[1])
+		if err != nil {
+			return nil, false, err
+		}
+		apply = func(target *Job) {
+			target.ConnectionName = connectionConfig.Name
+			target.ConnectionConfig = *connectionConfig
+		}
+		restart = true
+	case "groups":
+		newGroups := []string{}
+		if properties[1] != "-" {
+			newGroups = strings.Split(properties[1], ",")
+		}
+		if err := validateGroups(newGroups); err != nil {
+			return nil, false, err
+		}
+		apply = func(target *Job) { target.Groups = newGroups }
+	case "error_log_path":
+		if err := validateErrorLogPath(properties[1]); err != nil {
+			return nil, false, err
+		}
+		apply = func(target *Job) { target.ErrorLogPath = properties[1] }
+	case "error_log_max_kb_size":
+		newMaxKBSize, err := strconv.ParseFloat(properties[1], 64)
+		if err != nil {
+			return nil, false, err
+		}
+		if newMaxKBSize < 0 {
+			return nil, false, errors.New("You cannot set a negative value")
+		}
+		apply = func(target *Job) { target.ErrorLogMaxKBSize = newMaxKBSize }
+	case "error_log_max_files":
+		newMaxFiles, err := strconv.Atoi(properties[1])
+		if err != nil {
+			return nil, false, err
+		}
+		if newMaxFiles < 0 {
+			return nil, false, errors.New("You cannot set a negative value")
+		}
+		apply = func(target *Job) { target.ErrorLogMaxFiles = newMaxFiles }
 	default:
-		return errors.New("Property not supported. The supported properties are: min_messages | sleep_time | sleep_increment | max_sleep | max_execution | spawn")
+		return nil, false, errors.New("Property not supported. The supported properties are: min_messages | sleep_time | sleep_increment | max_sleep | max_execution | command | working_dir | user | queue | connection | groups | error_log_path | error_log_max_kb_size | error_log_max_files")
+	}
+	return apply, restart, nil
+}
+
+// applyChange makes the change once checked on a copy of the job
+func (job *Job) applyChange(apply func(target *Job), restart bool) error {
+	if err := job.validateChange(apply); err != nil {
+		return err
+	}
+	job.mu.Lock()
+	apply(job)
+	job.mu.Unlock()
+	if restart {
+		job.restartLoop()
 	}
 	return nil
 }
+
+// validateChange checks the job as the change would leave it, with the
+// validation of the config file and the preflight checks. Problems the job
+// already had don't block the change.
+func (job *Job) validateChange(apply func(target *Job)) error {
+	connections := jobKiller.getConnections()
+	before := job.configCopy()
+	after := job.configCopy()
+	apply(after)
+	known := make(map[ConfigProblem]bool)
+	for _, problem := range append(validateJob(before, nil, "", connections), preflightJob(before, "")...) {
+		known[problem] = true
+	}
+	var problems []ConfigProblem
+	for _, problem := range append(validateJob(after, nil, "", connections), preflightJob(after, "")...) {
+		if !known[problem] {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return ConfigErrors(problems)
+	}
+	return nil
+}
+
+// configCopy returns a copy of the fields of the job that are set by its
+// configuration
+func (job *Job) configCopy() *Job {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	copied := &Job{ConnectionConfig: job.ConnectionConfig}
+	source, target := reflect.ValueOf(job).Elem(), reflect.ValueOf(copied).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if name := source.Type().Field(i).Tag.Get("json"); name != "" && name != "-" {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
+	return copied
+}
@@ -4,15 +4,33 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sync"
 	"text/tabwriter"
 	"time"
 )
 
 type JobKiller struct {
-	Jobs []*Job
+	Jobs           []*Job
+	Connections    []ConnectionConfig
+	ResourceLimits ResourceLimits
+	mu             sync.RWMutex // protects Jobs, changed by add-job and remove-job, and Connections, refreshed from Vault
 }
 
-func (jobKiller JobKiller) listening() {
+// getConnections returns a copy of the connections of the configuration
+func (jobKiller *JobKiller) getConnections() []ConnectionConfig {
+	jobKiller.mu.RLock()
+	defer jobKiller.mu.RUnlock()
+	return append([]ConnectionConfig{}, jobKiller.Connections...)
+}
+
+// getJobs returns the jobs currently registered
+func (jobKiller *JobKiller) getJobs() []*Job {
+	jobKiller.mu.RLock()
+	defer jobKiller.mu.RUnlock()
+	return append([]*Job{}, jobKiller.Jobs...)
+}
+
+func (jobKiller *JobKiller) listening() {
 	for {
 		time.Sleep(time.Second)
 		select {
@@ -24,27 +42,40 @@ func (jobKiller JobKiller) listening() {
 }
 
 func (jobKiller *JobKiller) pauseAll() {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		if !jobKiller.Jobs[i].GetPause() {
-			jobKiller.Jobs[i].SetPause(true)
+	jobKiller.pauseAllFor(PauseInfo{})
+}
+
+func (jobKiller *JobKiller) pause(jobName string) {
+	jobKiller.pauseFor(jobName, PauseInfo{})
+}
+
+func (jobKiller *JobKiller) pauseGroup(groupName string) {
+	jobKiller.pauseGroupFor(groupName, PauseInfo{})
+}
+
+// pauseAllFor pauses every job, recording why and by whom
+func (jobKiller *JobKiller) pauseAllFor(info PauseInfo) {
+	for _, job := range jobKiller.getJobs() {
+		if !job.GetPause() {
+			job.pause(info)
 		}
 	}
 }
 
-func (jobKiller *JobKiller) pause(jobName string) {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		if !jobKiller.Jobs[i].GetPause() && jobKiller.Jobs[i].Name == jobName {
-			jobKiller.Jobs[i].SetPause(true)
+func (jobKiller *JobKiller) pauseFor(jobName string, info PauseInfo) {
+	for _, job := range jobKiller.getJobs() {
+		if !job.GetPause() && job.Name == jobName {
+			job.pause(info)
 			break
 		}
 	}
 }
 
-func (jobKiller *JobKiller) pauseGroup(groupName string) {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		for _, b := range jobKiller.Jobs[i].Groups {
+func (jobKiller *JobKiller) pauseGroupFor(groupName string, info PauseInfo) {
+	for _, job := range jobKiller.getJobs() {
+		for _, b := range job.GetGroups() {
 			if b == groupName {
-				jobKiller.Jobs[i].SetPause(true)
+				job.pause(info)
 				break
 			}
 		}
@@ -52,27 +83,27 @@ func (jobKiller *JobKiller) pauseGroup(groupName string) {
 }
 
 func (jobKiller *JobKiller) unpauseAll() {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		if jobKiller.Jobs[i].GetPause() {
-			jobKiller.Jobs[i].SetPause(false)
+	for _, job := range jobKiller.getJobs() {
+		if job.GetPause() {
+			job.unpause()
 		}
 	}
 }
 
 func (jobKiller *JobKiller) unpause(jobName string) {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		if jobKiller.Jobs[i].GetPause() && jobKiller.Jobs[i].Name == jobName {
-			jobKiller.Jobs[i].SetPause(false)
+	for _, job := range jobKiller.getJobs() {
+		if job.GetPause() && job.Name == jobName {
+			job.unpause()
 			break
 		}
 	}
 }
 
 func (jobKiller *JobKiller) unpauseGroup(groupName string) {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		for _, b := range jobKiller.Jobs[i].Groups {
+	for _, job := range jobKiller.getJobs() {
+		for _, b := range job.GetGroups() {
 			if b == groupName {
-				jobKiller.Jobs[i].SetPause(false)
+				job.unpause()
 				break
 			}
 		}
@@ -80,19 +111,8 @@ func (jobKiller *JobKiller) unpauseGroup(groupName string) {
 }
 
 func (jobKiller *JobKiller) killAll() {
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		jobKiller.Jobs[i].SetStop(true)
-		jobKiller.Jobs[i].OwnContextCancel()
-		if jobKiller.Jobs[i].GetPID() != 0 {
-			cmd := jobKiller.Jobs[i].GetCmdExecutable()
-			if cmd != nil && cmd.Process != nil {
-				err := cmd.Process.Kill()
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
-		}
-		jobKiller.Jobs[i].SetStatus(STATUS_TERMINATED)
+	for _, job := range jobKiller.getJobs() {
+		job.kill()
 	}
 }
 
@@ -100,12 +120,17 @@ func (jobKiller *JobKiller) returnStatus() string {
 	var b bytes.Buffer
 	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
 	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", "Job", "Groups", "Status", "PID", "User", "Sleep", "Last Exec")
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		job := jobKiller.Jobs[i]
+	for _, job := range jobKiller.getJobs() {
 		jobStatus := job.getStatus()
 		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", jobStatus["Name"], jobStatus["Groups"], jobStatus["Status"], jobStatus["PID"], jobStatus["User"], jobStatus["Sleep"], jobStatus["LastExec"])
 	}
 	writer.Flush()
+	if slotsStatus := slots.returnStatus(); slotsStatus != "" {
+		b.WriteString("\n" + slotsStatus)
+	}
+	if connectionsStatus := connectionRegistry.returnStatus(); connectionsStatus != "" {
+		b.WriteString("\n" + connectionsStatus)
+	}
 	return b.String()
 }
 
@@ -114,8 +139,7 @@ func (jobKiller *JobKiller) returnStatusOf(jobName string) string {
 	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
 	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", "Job", "Groups", "Status", "PID", "User", "Sleep", "Max sleep", "Last Exec")
 	found := false
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		job := jobKiller.Jobs[i]
+	for _, job := range jobKiller.getJobs() {
 		if job.Name == jobName {
 			found = true
 			jobStatus := job.getStatus()
@@ -126,16 +150,129 @@ func (jobKiller *JobKiller) returnStatusOf(jobName string) string {
 
 	if found {
 		writer.Flush()
+		job, _ := jobKiller.findJobByName(jobName)
+		if job.origin != nil {
+			b.WriteString("Defined in: " + job.origin.String() + "\n")
+		}
+		if info := job.getPauseInfo(); info != nil && (info.Reason != "" || info.By != "") {
+			b.WriteString(fmt.Sprintf("Paused by %v at %v: %v\n", info.By, info.At.Format(time.DateTime), info.Reason))
+		}
+		if runId := job.getLastRunId(); runId != "" {
+			b.WriteString("Last run: " + runId + "\n")
+		}
+		if reason := job.getAlarmReason(); reason != "" {
+			b.WriteString("Paused by alarm: " + reason + "\n")
+		}
+		if reason := job.getThrottleReason(); reason != "" && job.GetStatus() == STATUS_THROTTLED {
+			b.WriteString("Throttled: " + reason + "\n")
+		}
+		if reason := jobRelations.getBlockedReason(job); reason != "" && job.GetStatus() == STATUS_BLOCKED {
+			b.WriteString("Blocked: " + reason + "\n")
+		}
 		return b.String()
 	}
 	return fmt.Sprintf("Can't find job called %v\n", jobName)
 }
 
+// returnConnections probes every configured connection and lists its health
+func (jobKiller *JobKiller) returnConnections() string {
+	var probes sync.WaitGroup
+	for _, connectionConfig := range jobKiller.getConnections() {
+		probes.Add(1)
+		go func(connectionConfig ConnectionConfig) {
+			defer probes.Done()
+			probeConnection(connectionConfig)
+		}(connectionConfig)
+	}
+	probes.Wait()
+
+	var b bytes.Buffer
+	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
+	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", "Connection", "Type", "State", "Circuit", "Reachable", "Latency", "Node", "Version", "Last error")
+	for _, connectionConfig := range jobKiller.getConnections() {
+		state := connectionRegistry.register(connectionConfig)
+		health := state.getHealth()
+		reachable, latency, version, node, lastError := "unknown", "-", "-", "-", "-"
+		if health.Checked {
+			reachable = "no"
+			if health.Reachable {
+				reachable = "yes"
+			}
+			latency = health.LastLatency.Round(time.Millisecond).String()
+		}
+		if health.Version != "" {
+			version = health.Version
+		}
+		if current := state.getCurrent(); current != "" {
+			node = current
+		}
+		if health.LastError != "" {
+			lastError = fmt.Sprintf("%v (%v)", health.LastError, health.LastErrorAt.Format(time.DateTime))
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", connectionConfig.Name, connectionConfig.getType(), state.getStatusName(), state.breaker.getState(), reachable, latency, node, version, lastError)
+	}
+	writer.Flush()
+	return b.String()
+}
+
+// returnQueues lists what the last poll of each job observed
+func (jobKiller *JobKiller) returnQueues() string {
+	var b bytes.Buffer
+	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
+	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", "Job", "Connection", "Queue", "Messages", "Ready", "Unacked", "Consumers", "Last poll")
+	for _, job := range jobKiller.getJobs() {
+		queueInfo, lastPollAt := job.getLastQueueInfo()
+		if queueInfo == nil {
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", job.Name, job.ConnectionName, job.describeQueue(), "-", "-", "-", "-", "never")
+			continue
+		}
+		consumers := "-"
+		if connectionConfig := job.GetConnectionConfig(); connectionConfig.getType() == CONNECTION_TYPE_RABBITMQ {
+			consumers = fmt.Sprint(queueInfo.Consumers)
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", job.Name, job.ConnectionName, job.describeQueue(), queueInfo.Messages, queueInfo.MessagesReady, queueInfo.MessagesUnacknowledged, consumers, lastPollAt.Format(time.DateTime))
+	}
+	writer.Flush()
+	return b.String()
+}
+
+// returnHistory lists the last runs of the job kept in the state file
+func (jobKiller *JobKiller) returnHistory(jobName string) string {
+	if _, err := jobKiller.findJobByName(jobName); err != nil {
+		return fmt.Sprintf("Can't find job called %v\n", jobName)
+	}
+	var b bytes.Buffer
+	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
+	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", "Run", "Started", "Duration", "Exit code", "Result")
+	for _, run := range stateStore.getHistory(jobName) {
+		if run.Skipped != "" {
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", run.RunId, run.StartedAt.Format(time.DateTime), "-", "-", "SKIPPED: "+run.Skipped)
+			continue
+		}
+		result := "FAILED"
+		if run.Success {
+			result = "OK"
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", run.RunId, run.StartedAt.Format(time.DateTime), run.EndedAt.Sub(run.StartedAt).Round(time.Millisecond), run.ExitCode, result)
+	}
+	writer.Flush()
+	return b.String()
+}
+
+// getConnectionByName returns a copy of the connection
+func (jobKiller *JobKiller) getConnectionByName(name string) (*ConnectionConfig, error) {
+	for _, connectionConfig := range jobKiller.getConnections() {
+		if connectionConfig.Name == name {
+			return &connectionConfig, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown connection %v", name)
+}
+
 func (jobKiller *JobKiller) findJobByName(jobName string) (*Job, error) {
 	found := false
 	var jobToReturn *Job
-	for i := 0; i < len(jobKiller.Jobs); i++ {
-		job := jobKiller.Jobs[i]
+	for _, job := range jobKiller.getJobs() {
 		if job.Name == jobName {
 			found = true
 			jobToReturn = job
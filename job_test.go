@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"sync"
 	"testing"
 )
@@ -428,15 +429,14 @@ func TestJob_UpdateProperties_Spawn(t *testing.T) {
 	job := &Job{Spawn: 1}
 
 	err := job.updateProperties([]string{"spawn", "5"})
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+	if err == nil || !strings.Contains(err.Error(), "needs a restart") {
+		t.Errorf("Expected spawn to be refused at runtime, got %v", err)
 	}
-	// Note: Spawn uses direct field access via SetSpawn, need to check via lock
 	job.mu.RLock()
 	spawn := job.Spawn
 	job.mu.RUnlock()
-	if spawn != 5 {
-		t.Errorf("Expected Spawn 5, got %d", spawn)
+	if spawn != 1 {
+		t.Errorf("Expected Spawn 1, got %d", spawn)
 	}
 }
 
@@ -525,3 +525,118 @@ func TestJob_UpdateProperties_InsufficientArguments(t *testing.T) {
 		t.Error("Expected error for missing value")
 	}
 }
+
+func TestJob_UpdateProperties_Command(t *testing.T) {
+	job := &Job{Command: "echo a"}
+
+	if err := job.updateProperties([]string{"command", "sh", "worker.sh", "--verbose"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if job.GetCommand() != "sh worker.sh --verbose" {
+		t.Errorf("Expected the whole command to be set, got %q", job.GetCommand())
+	}
+	if err := job.updateProperties([]string{"command", "no_such_program_here", "--verbose"}); err == nil || !strings.Contains(err.Error(), "executable no_such_program_here not found") {
+		t.Errorf("Expected a missing executable to be refused, got %v", err)
+	}
+	if job.GetCommand() != "sh worker.sh --verbose" {
+		t.Error("Expected a refused change to leave the job as it was")
+	}
+}
+
+func TestJob_UpdateProperties_ValidatesJob(t *testing.T) {
+	jobKiller = JobKiller{Connections: []ConnectionConfig{
+		{Name: "rabbit", Endpoint: "http://localhost:15672", AmqpEndpoint: "amqp://localhost:5672"},
+		{Name: "nats", Type: CONNECTION_TYPE_NATS, Endpoint: "nats://localhost:4222"},
+	}}
+	job := &Job{Name: "job1", Command: "true", SleepTime: 5, MaxSleep: 60, ConnectionName: "rabbit", Queue: "work", EventMode: EVENT_MODE_CONSUMER}
+
+	err := job.updateProperties([]string{"connection", "nats"})
+
+	for _, expected := range []string{"stream: stream is required on nats connections", "consumer: consumer is required", "connection: delivery and event_mode need a rabbitmq connection"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q, got %v", expected, err)
+		}
+	}
+	if job.ConnectionName != "rabbit" {
+		t.Errorf("Expected the job to keep its connection, got %v", job.ConnectionName)
+	}
+	if err := job.updateProperties([]string{"sleep_time", "90"}); err == nil || !strings.Contains(err.Error(), "max_sleep can't be lower than sleep_time") {
+		t.Errorf("Expected a sleep time above max_sleep to be refused, got %v", err)
+	}
+}
+
+func TestJob_UpdateProperties_WorkingDir(t *testing.T) {
+	job := &Job{}
+	dir := t.TempDir()
+
+	if err := job.updateProperties([]string{"working_dir", dir}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if job.GetWorkingDir() != dir {
+		t.Errorf("Expected working dir %v, got %v", dir, job.GetWorkingDir())
+	}
+	if err := job.updateProperties([]string{"working_dir", dir + "/missing"}); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+	if job.GetWorkingDir() != dir {
+		t.Error("Expected a refused change to leave the job as it was")
+	}
+}
+
+func TestJob_UpdateProperties_User(t *testing.T) {
+	job := &Job{}
+
+	if err := job.updateProperties([]string{"user", "root"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if job.GetUserId() != "root" {
+		t.Errorf("Expected user root, got %v", job.GetUserId())
+	}
+	if err := job.updateProperties([]string{"user", "no_such_user_here"}); err == nil {
+		t.Error("Expected an error for an unknown user")
+	}
+}
+
+func TestJob_UpdateProperties_QueueAndGroups(t *testing.T) {
+	job := &Job{Queue: "old", Groups: []string{"a"}}
+
+	if err := job.updateProperties([]string{"queue", "new"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := job.updateProperties([]string{"groups", "b,c"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if job.GetQueue() != "new" || strings.Join(job.GetGroups(), ",") != "b,c" {
+		t.Errorf("Unexpected queue %v and groups %v", job.GetQueue(), job.GetGroups())
+	}
+	if err := job.updateProperties([]string{"groups", "-"}); err != nil || len(job.GetGroups()) != 0 {
+		t.Errorf("Expected the groups to be cleared, got %v (%v)", job.GetGroups(), err)
+	}
+	if err := job.updateProperties([]string{"groups", "b,,c"}); err == nil {
+		t.Error("Expected an error for an empty group name")
+	}
+}
+
+func TestJob_UpdateProperties_ErrorLog(t *testing.T) {
+	job := &Job{}
+	dir := t.TempDir() + "/"
+
+	if err := job.updateProperties([]string{"error_log_path", dir}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := job.updateProperties([]string{"error_log_max_kb_size", "512.5"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := job.updateProperties([]string{"error_log_max_files", "3"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if job.GetErrorLogPath() != dir || job.GetErrorLogMaxKBSize() != 512.5 || job.GetErrorLogMaxFiles() != 3 {
+		t.Errorf("Unexpected error log settings %v %v %v", job.GetErrorLogPath(), job.GetErrorLogMaxKBSize(), job.GetErrorLogMaxFiles())
+	}
+	if err := job.updateProperties([]string{"error_log_path", strings.TrimSuffix(dir, "/")}); err == nil {
+		t.Error("Expected an error for a path without trailing slash")
+	}
+	if err := job.updateProperties([]string{"error_log_max_files", "-1"}); err == nil {
+		t.Error("Expected an error for a negative value")
+	}
+}
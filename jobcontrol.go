@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RESTART_TIMEOUT is how long restart waits for the loop of the job to end
+const RESTART_TIMEOUT = 30 * time.Second
+
+// Signals that can be forwarded to the command of a job
+var forwardableSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGCONT": syscall.SIGCONT,
+	"SIGSTOP": syscall.SIGSTOP,
+}
+
+// loopStarts serializes the starts of the loops with the shutdown, so that
+// no loop is added to the wait group main is waiting on
+var loopStarts sync.Mutex
+
+// shutdown cancels mainContext, which ends the loops of the jobs and keeps
+// new ones from starting
+func shutdown() {
+	loopStarts.Lock()
+	defer loopStarts.Unlock()
+	cancelMainContext()
+}
+
+// start runs the loop of the job in its own goroutine, with a fresh context
+func (job *Job) start(wg *sync.WaitGroup) error {
+	loopStarts.Lock()
+	defer loopStarts.Unlock()
+	if mainContext.Err() != nil {
+		return errors.New("the supervisor is shutting down")
+	}
+	job.mu.Lock()
+	if job.loopDone != nil {
+		select {
+		case <-job.loopDone:
+		default:
+			job.mu.Unlock()
+			return fmt.Errorf("job %v is already running", job.Name)
+		}
+	}
+	wg.Add(1)
+	done := make(chan struct{})
+	job.loopDone = done
+	job.loopWaitGroup = wg
+	job.Stop = false
+	job.OwnContext, job.OwnContextCancel = context.WithCancel(mainContext)
+	job.mu.Unlock()
+
+	go func() {
+		job.executeCommand(wg)
+		close(done)
+	}()
+	return nil
+}
+
+// restartLoop restarts the loop of the job once it is done with what it is
+// doing, for the changes read when the loop starts (user, connection) to
+// take effect. The running command isn't interrupted.
+func (job *Job) restartLoop() {
+	job.mu.Lock()
+	done := job.loopDone
+	if done == nil || job.restartPending {
+		job.mu.Unlock()
+		return
+	}
+	select {
+	case <-done:
+		job.mu.Unlock()
+		return
+	default:
+	}
+	job.restartPending = true
+	job.Stop = true
+	wg := job.loopWaitGroup
+	job.mu.Unlock()
+	job.wakeUp()
+
+	go func() {
+		<-done
+		job.mu.Lock()
+		pending := job.restartPending
+		job.restartPending = false
+		job.mu.Unlock()
+		if !pending {
+			return
+		}
+		log.Printf("Restarting job: %v\n", job.Name)
+		if err := job.start(wg); err != nil {
+			log.Printf("Can't restart job %v: %v\n", job.Name, err)
+		}
+	}()
+}
+
+// kill stops the loop of the job for good, killing its running command.
+// The job is TERMINATED once its loop has ended.
+func (job *Job) kill() {
+	job.mu.Lock()
+	job.restartPending = false
+	job.mu.Unlock()
+	job.SetStop(true)
+	job.mu.RLock()
+	cancel := job.OwnContextCancel
+	job.mu.RUnlock()
+	if cancel != nil {
+		cancel()
+	}
+	if job.GetPID() != 0 {
+		cmd := job.GetCmdExecutable()
+		if cmd != nil && cmd.Process != nil {
+			err := cmd.Process.Kill()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	if !job.isLoopRunning() {
+		job.SetStatus(STATUS_TERMINATED)
+	}
+}
+
+// stop ends the loop of the job once its running command, if any, is done
+func (job *Job) stop() {
+	job.mu.Lock()
+	job.restartPending = false
+	job.Stop = true
+	job.mu.Unlock()
+	job.wakeUp()
+}
+
+// isLoopRunning tells whether the loop started by start hasn't ended yet
+func (job *Job) isLoopRunning() bool {
+	job.mu.RLock()
+	done := job.loopDone
+	job.mu.RUnlock()
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// waitForLoop waits for the loop of the job to end, returning false on
+// timeout
+func (job *Job) waitForLoop(timeout time.Duration) bool {
+	job.mu.RLock()
+	done := job.loopDone
+	job.mu.RUnlock()
+	if done == nil {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// signal forwards a signal to the running command of the job
+func (job *Job) signal(signalName string) error {
+	name := strings.ToUpper(signalName)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, found := forwardableSignals[name]
+	if !found {
+		return fmt.Errorf("unsupported signal %v", signalName)
+	}
+	cmd := job.GetCmdExecutable()
+	if job.GetPID() == 0 || cmd == nil || cmd.Process == nil {
+		return fmt.Errorf("job %v isn't running a command", job.Name)
+	}
+	return cmd.Process.Signal(sig)
+}
+
+func (jobKiller *JobKiller) kill(jobName string) error {
+	job, err := jobKiller.findJobByName(jobName)
+	if err != nil {
+		return err
+	}
+	job.kill()
+	return nil
+}
+
+func (jobKiller *JobKiller) killGroup(groupName string) {
+	for _, job := range jobKiller.getJobs() {
+		for _, group := range job.GetGroups() {
+			if group == groupName {
+				job.kill()
+				break
+			}
+		}
+	}
+}
+
+// start starts the loop of a terminated job again
+func (jobKiller *JobKiller) start(jobName string) error {
+	job, err := jobKiller.findJobByName(jobName)
+	if err != nil {
+		return err
+	}
+	return job.start(&wg)
+}
+
+// restart kills the job and starts its loop again once it has ended
+func (jobKiller *JobKiller) restart(jobName string) error {
+	job, err := jobKiller.findJobByName(jobName)
+	if err != nil {
+		return err
+	}
+	job.kill()
+	if !job.waitForLoop(RESTART_TIMEOUT) {
+		return errors.New("job " + jobName + " didn't stop in time, try start later")
+	}
+	return job.start(&wg)
+}
+
+func (jobKiller *JobKiller) signal(jobName string, signalName string) error {
+	job, err := jobKiller.findJobByName(jobName)
+	if err != nil {
+		return err
+	}
+	return job.signal(signalName)
+}
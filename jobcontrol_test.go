@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startControlledJob starts the loop of the job in test mode through start,
+// killing it when the test ends
+func startControlledJob(t *testing.T, job *Job, wg *sync.WaitGroup) {
+	t.Helper()
+	previousTestMode := *testMode
+	*testMode = true
+	job.MainPid = os.Getpid()
+	job.ConnectionConfig = ConnectionConfig{Name: "job_control_test", Endpoint: "http://localhost:59992"}
+	if err := job.start(wg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		job.kill()
+		wg.Wait()
+		*testMode = previousTestMode
+	})
+}
+
+func waitForPID(job *Job, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if job.GetPID() != 0 {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestJob_KillAndStart(t *testing.T) {
+	var wg sync.WaitGroup
+	job := createTestJob("control_job", nil)
+	job.Command = "sleep 30"
+	job.SleepTime = 60
+	startControlledJob(t, job, &wg)
+
+	if !waitForPID(job, 5*time.Second) {
+		t.Fatal("Expected the command to be running")
+	}
+	if err := job.start(&wg); err == nil {
+		t.Error("Expected start to refuse a running job")
+	}
+
+	job.kill()
+	if !job.waitForLoop(5 * time.Second) {
+		t.Fatal("Expected the loop to end after kill")
+	}
+	if job.GetStatus() != STATUS_TERMINATED {
+		t.Errorf("Expected TERMINATED status, got %v", job.getStatusName())
+	}
+
+	if err := job.start(&wg); err != nil {
+		t.Fatalf("Expected a terminated job to start again, got %v", err)
+	}
+	if !waitForPID(job, 5*time.Second) {
+		t.Error("Expected the command to run again after start")
+	}
+}
+
+func TestJob_Kill_TerminatedWhenLoopEnds(t *testing.T) {
+	var wg sync.WaitGroup
+	job := createTestJob("control_job", nil)
+	job.SetStatus(STATUS_RUNNING)
+	loopDone := make(chan struct{})
+	job.loopDone = loopDone
+
+	job.kill()
+
+	// The loop is still ending: start refuses and the status says so
+	if job.GetStatus() == STATUS_TERMINATED {
+		t.Error("Expected the job not to be TERMINATED before its loop ends")
+	}
+	if err := job.start(&wg); err == nil {
+		t.Error("Expected start to refuse a job whose loop is still running")
+	}
+
+	close(loopDone)
+	job.kill()
+	if job.GetStatus() != STATUS_TERMINATED {
+		t.Errorf("Expected TERMINATED status without a loop, got %v", job.getStatusName())
+	}
+}
+
+func TestJob_Start_RefusedDuringShutdown(t *testing.T) {
+	var wg sync.WaitGroup
+	previous, previousCancel := mainContext, cancelMainContext
+	mainContext, cancelMainContext = context.WithCancel(context.Background())
+	t.Cleanup(func() { mainContext, cancelMainContext = previous, previousCancel })
+	job := createTestJob("control_job", nil)
+
+	shutdown()
+
+	if err := job.start(&wg); err == nil || err.Error() != "the supervisor is shutting down" {
+		t.Errorf("Expected start to be refused, got %v", err)
+	}
+	wg.Wait()
+}
+
+func TestJob_Signal(t *testing.T) {
+	var wg sync.WaitGroup
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "reloaded")
+	script := filepath.Join(dir, "consumer.sh")
+	os.WriteFile(script, []byte("trap 'touch "+marker+"; exit 0' USR1\nwhile true; do sleep 0.1; done\n"), 0755)
+	job := createTestJob("signal_job", nil)
+	job.Command = "sh " + script
+	job.SleepTime = 60
+
+	if err := job.signal("SIGUSR1"); err == nil {
+		t.Error("Expected error when no command is running")
+	}
+
+	startControlledJob(t, job, &wg)
+	if !waitForPID(job, 5*time.Second) {
+		t.Fatal("Expected the command to be running")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if err := job.signal("SIGFOO"); err == nil {
+		t.Error("Expected error for an unsupported signal")
+	}
+	if err := job.signal("usr1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !waitForFile(marker, 5*time.Second) {
+		t.Error("Expected the command to receive SIGUSR1")
+	}
+}
+
+func TestJobKiller_Restart(t *testing.T) {
+	var wg sync.WaitGroup
+	job := createTestJob("restart_job", nil)
+	job.Command = "sleep 30"
+	job.SleepTime = 60
+	startControlledJob(t, job, &wg)
+	if !waitForPID(job, 5*time.Second) {
+		t.Fatal("Expected the command to be running")
+	}
+	firstPid := job.GetPID()
+
+	jk := &JobKiller{Jobs: []*Job{job}}
+	if err := jk.restart("restart_job"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		job.kill()
+		job.waitForLoop(5 * time.Second)
+	})
+	if !waitForPID(job, 5*time.Second) || job.GetPID() == firstPid {
+		t.Error("Expected a new command after restart")
+	}
+
+	if err := jk.restart("missing"); err == nil {
+		t.Error("Expected error for an unknown job")
+	}
+}
+
+func TestJobKiller_KillGroup(t *testing.T) {
+	job1 := createTestJob("job1", []string{"group1"})
+	job2 := createTestJob("job2", []string{"group2"})
+	jk := &JobKiller{Jobs: []*Job{job1, job2}}
+
+	jk.killGroup("group1")
+
+	if !job1.GetStop() || job1.GetStatus() != STATUS_TERMINATED {
+		t.Error("Expected job1 to be killed")
+	}
+	if job2.GetStop() {
+		t.Error("Expected job2 to keep running")
+	}
+}
+
+func TestJob_UpdateConnectionRestartsLoop(t *testing.T) {
+	var wg sync.WaitGroup
+	job := createTestJob("restart_loop_job", nil)
+	job.Command = "true"
+	job.Queue = "work"
+	job.SleepTime = 60
+	startControlledJob(t, job, &wg)
+	jobKiller = JobKiller{Jobs: []*Job{job}, Connections: []ConnectionConfig{{Name: "other", Endpoint: "http://localhost:59994"}}}
+	job.mu.RLock()
+	firstLoop := job.loopDone
+	job.mu.RUnlock()
+
+	if err := job.updateProperties([]string{"connection", "other"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	select {
+	case <-firstLoop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the loop to end")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job.mu.RLock()
+		restarted := job.loopDone != firstLoop && !job.Stop
+		job.mu.RUnlock()
+		if restarted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the loop to be started again")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if connectionConfig := job.GetConnectionConfig(); connectionConfig.Name != "other" || job.ConnectionName != "other" {
+		t.Errorf("Expected the job to use the new connection, got %v", connectionConfig.Name)
+	}
+}
+
+func TestJob_UpdateConnectionUnknown(t *testing.T) {
+	jobKiller = JobKiller{}
+	job := createTestJob("job1", nil)
+
+	if err := job.updateProperties([]string{"connection", "missing"}); err == nil {
+		t.Error("Expected an error for an unknown connection")
+	}
+}
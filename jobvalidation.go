@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// Checks of the job fields that can be changed with update-job
+
+func validateCommand(command string) error {
+	if strings.TrimSpace(command) == "" {
+		return errors.New("command can't be empty")
+	}
+	return nil
+}
+
+func validateWorkingDir(workingDir string) error {
+	if workingDir == "" {
+		return nil
+	}
+	info, err := os.Stat(workingDir)
+	if err != nil {
+		return fmt.Errorf("working_dir %v: %w", workingDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("working_dir %v is not a directory", workingDir)
+	}
+	return nil
+}
+
+func validateUser(userName string) error {
+	if userName == "" {
+		return nil
+	}
+	if _, err := user.Lookup(userName); err != nil {
+		return fmt.Errorf("unknown user %v", userName)
+	}
+	return nil
+}
+
+func validateQueue(queue string) error {
+	if strings.TrimSpace(queue) == "" {
+		return errors.New("queue can't be empty")
+	}
+	return nil
+}
+
+func validateGroups(groups []string) error {
+	for _, group := range groups {
+		if strings.TrimSpace(group) == "" {
+			return errors.New("group names can't be empty")
+		}
+	}
+	return nil
+}
+
+// validateErrorLogPath checks that the logs of the job can be written in
+// the directory. The path is used as a prefix of the job name, so it must
+// end with a slash.
+func validateErrorLogPath(errorLogPath string) error {
+	if errorLogPath == "" {
+		return nil
+	}
+	if !strings.HasSuffix(errorLogPath, "/") {
+		return fmt.Errorf("error_log_path %v must end with /", errorLogPath)
+	}
+	info, err := os.Stat(errorLogPath)
+	if err != nil {
+		return fmt.Errorf("error_log_path %v: %w", errorLogPath, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("error_log_path %v is not a directory", errorLogPath)
+	}
+	return nil
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"os/user"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -15,11 +18,15 @@ import (
 
 var (
 	configFile           = flag.String("config", "./gonc-config.json", "path of configuration file")
-	operationInstruction = flag.String("operation", "", "Available operations: install | uninstall | service")
-	serviceCommand       = flag.String("option", "", "Available options: status | status-of <job name> | pause <job name> | pause-group <group name> | pause-all | unpause <job name> | unpause-group <group name> | unpause-all | kill-all | version")
+	configDir            = flag.String("config-dir", "", "directory of config files merged into the configuration (connections, jobs and templates)")
+	operationInstruction = flag.String("operation", "", "Available operations: install | uninstall | service | check | convert-config | encrypt-value | rotate-key")
+	serviceCommand       = flag.String("option", "", "Available options: status | status-of <job name> | connections | queues | pause <job name> [reason] [--by <who>] | pause-group <group name> [reason] [--by <who>] | pause-all [reason] [--by <who>] | unpause <job name> | unpause-group <group name> | unpause-all | run-now <job name> [--ignore-threshold] | run-now-group <group name> [--ignore-threshold] | kill <job name> | kill-group <group name> | restart <job name> | start <job name> | signal <job name> <SIGUSR1|SIGHUP|...> | kill-all | add-job <job json> | remove-job <job name> [--graceful] | update-job <job name> <property> <value> [--persist] | save-config | config [<job name>] | state | state reset | history <job name> | version")
 	logPath              = flag.String("log", "./", "path where to store logs")
 	port                 = flag.String("port", "9000", "Port where the server should listen")
 	testMode             = flag.Bool("testing", false, "")
+	stateFilePath        = flag.String("state", "", "path of the state file (default <log>gormq-state.json)")
+	secretKeyFile        = flag.String("secret-key-file", "", "key file of the encrypted values of the configuration (default gormq.key next to the config file)")
+	outputFile           = flag.String("output", "", "path of the file written by convert-config, its extension gives the format (.json | .yaml | .yml | .toml)")
 	installMethod        = flag.String("installMethod", "servicectl", "Install method (servicectl | initd)")
 	silentInstall        = flag.Bool("silent", false, "Install with default values")
 )
@@ -36,10 +43,10 @@ var log Logger
 
 const VERSION = "v0.1"
 
-var mainContext context.Context
+// mainContext is cancelled when the supervisor shuts down
+var mainContext, cancelMainContext = context.WithCancel(context.Background())
 
 func main() {
-	mainContext = context.Background()
 	flag.Parse()
 
 	instruction := *operationInstruction
@@ -54,6 +61,43 @@ func main() {
 			os.Exit(0)
 		case "service":
 			commandLineService(*serviceCommand)
+		case "check":
+			log = Logger{Path: *logPath + "goncsupervisorlogs.txt"}
+			os.Exit(reportConfigCheck(*configFile, os.Stdout))
+		case "convert-config":
+			if err := convertConfig(*configFile, *outputFile); err != nil {
+				fmt.Printf("Failed to convert configuration: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%v written\n", *outputFile)
+			os.Exit(0)
+		case "encrypt-value":
+			// The value is read from stdin to stay out of the shell history
+			value, err := io.ReadAll(os.Stdin)
+			encrypted, created := "", false
+			if err == nil {
+				encrypted, created, err = encryptValue(*configFile, strings.TrimRight(string(value), "\r\n"))
+			}
+			if err != nil {
+				fmt.Printf("Failed to encrypt value: %v\n", err)
+				os.Exit(1)
+			}
+			if created {
+				fmt.Fprintf(os.Stderr, "Created key file %v\n", keyFilePath(*configFile))
+			}
+			fmt.Println(encrypted)
+			os.Exit(0)
+		case "rotate-key":
+			written, err := rotateKey(*configFile)
+			for _, path := range written {
+				fmt.Printf("%v re-encrypted\n", path)
+			}
+			if err != nil {
+				fmt.Printf("Failed to rotate key: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%v rotated\n", keyFilePath(*configFile))
+			os.Exit(0)
 		default:
 			fmt.Println(usage)
 			os.Exit(0)
@@ -82,10 +126,22 @@ func main() {
 		}
 		log.Println("configuration loaded")
 
+		statePath := *stateFilePath
+		if statePath == "" {
+			statePath = *logPath + "gormq-state.json"
+		}
+		stateStore, err = loadStateStore(statePath)
+		if err != nil {
+			log.Printf("Failed to load state: %v\n", err)
+		}
+		configSource = configuration.source
+
 		log.Println("Starting workers")
 		go worker(configuration)
 		<-stop
+		shutdown()
 		wg.Wait()
+		stateStore.flush()
 		log.Println("All jobs have stopped")
 		log.Println("Terminated")
 		log.Println("- - - - - - - - - - - - - - -")
@@ -95,6 +151,7 @@ func main() {
 
 func worker(configuration ConfigFile) {
 	mainPid := os.Getpid()
+	slots = createSlotScheduler(configuration.MaxConcurrent, configuration.GroupLimits)
 	for j := 0; j < len(configuration.Jobs); j++ {
 		connectionConfig, err := configuration.getConnectionByName(configuration.Jobs[j].ConnectionName)
 		if err != nil {
@@ -103,12 +160,21 @@ func worker(configuration ConfigFile) {
 			continue
 		}
 
-		wg.Add(1)
 		configuration.Jobs[j].ConnectionConfig = *connectionConfig
 		configuration.Jobs[j].MainPid = mainPid
-		configuration.Jobs[j].OwnContext, configuration.Jobs[j].OwnContextCancel = context.WithCancel(mainContext)
-		go configuration.Jobs[j].executeCommand(&wg)
-		jobKiller.Jobs = append(jobKiller.Jobs, &configuration.Jobs[j])
+		jobKiller.Jobs = append(jobKiller.Jobs, configuration.Jobs[j])
+	}
+	jobKiller.Connections = configuration.ConnectionConfigs
+	jobKiller.ResourceLimits = configuration.ResourceLimits
+	jobs := jobKiller.getJobs()
+	stateStore.apply(jobs)
+	for _, job := range jobs {
+		job.start(&wg)
+	}
+	jobRelations = createJobRelations(jobs)
+	startAlarmWatchers(mainContext, configuration.ConnectionConfigs, jobs)
+	if configuration.vault != nil {
+		go configuration.vault.run(mainContext)
 	}
 	go jobKiller.listening()
 
@@ -157,7 +223,7 @@ func server() {
 
 func handleRequest(conn net.Conn) {
 	for {
-		buf := make([]byte, 1024)
+		buf := make([]byte, 65536)
 		size, err := conn.Read(buf)
 		if err != nil {
 			return
@@ -172,7 +238,7 @@ func handleRequest(conn net.Conn) {
 func createResponse(command string) string {
 	inputCommand := strings.Fields(command)
 	if len(inputCommand) == 0 {
-		return "Commands available:\nstatus | status-of <job name> | pause <job name> | pause-group <group name> | pause-all | unpause <job name> | unpause-group <group name> | unpause-all | kill-all | version\n"
+		return "Commands available:\nstatus | status-of <job name> | connections | queues | pause <job name> [reason] [--by <who>] | pause-group <group name> [reason] [--by <who>] | pause-all [reason] [--by <who>] | unpause <job name> | unpause-group <group name> | unpause-all | run-now <job name> [--ignore-threshold] | run-now-group <group name> [--ignore-threshold] | kill <job name> | kill-group <group name> | restart <job name> | start <job name> | signal <job name> <SIGUSR1|SIGHUP|...> | kill-all | add-job <job json> | remove-job <job name> [--graceful] | update-job <job name> <property> <value> [--persist] | save-config | config [<job name>] | state | state reset | history <job name> | version\n"
 	}
 	action := inputCommand[0]
 	arguments := ""
@@ -184,14 +250,24 @@ func createResponse(command string) string {
 		return jobKiller.returnStatus()
 	case "status-of":
 		return jobKiller.returnStatusOf(arguments)
+	case "connections":
+		return jobKiller.returnConnections()
+	case "queues":
+		return jobKiller.returnQueues()
 	case "pause":
-		jobKiller.pause(arguments)
-		return "Job will be paused after getting out of sleep cycle or after execution. Current status: \n" + jobKiller.returnStatusOf(arguments)
+		if len(inputCommand) < 2 {
+			return "In order to pause a job you need to pass the job name, optionally followed by a reason and --by <who>."
+		}
+		jobKiller.pauseFor(inputCommand[1], parsePauseInfo(inputCommand[2:]))
+		return "Job will be paused after getting out of sleep cycle or after execution. Current status: \n" + jobKiller.returnStatusOf(inputCommand[1])
 	case "pause-group":
-		jobKiller.pauseGroup(arguments)
+		if len(inputCommand) < 2 {
+			return "In order to pause a group you need to pass the group name, optionally followed by a reason and --by <who>."
+		}
+		jobKiller.pauseGroupFor(inputCommand[1], parsePauseInfo(inputCommand[2:]))
 		return "Jobs will be paused after getting out of sleep cycle or after execution. Current status: \n" + jobKiller.returnStatus()
 	case "pause-all":
-		jobKiller.pauseAll()
+		jobKiller.pauseAllFor(parsePauseInfo(inputCommand[1:]))
 		return "Jobs will be paused after getting out of sleep cycle or after execution. Current status: \n" + jobKiller.returnStatus()
 	case "unpause":
 		jobKiller.unpause(arguments)
@@ -205,12 +281,142 @@ func createResponse(command string) string {
 		jobKiller.unpauseAll()
 		time.Sleep(1 * time.Second)
 		return jobKiller.returnStatus()
+	case "run-now":
+		if len(inputCommand) < 2 {
+			return "In order to run a job now you need to pass the job name, optionally followed by --ignore-threshold."
+		}
+		ignoreThreshold, err := parseRunNowOptions(inputCommand[2:])
+		if err != nil {
+			return err.Error()
+		}
+		runId, err := jobKiller.runNow(inputCommand[1], ignoreThreshold)
+		if err != nil {
+			return err.Error()
+		}
+		time.Sleep(1 * time.Second)
+		return "Run " + runId + " requested. Current status: \n" + jobKiller.returnStatusOf(inputCommand[1])
+	case "run-now-group":
+		if len(inputCommand) < 2 {
+			return "In order to run a group now you need to pass the group name, optionally followed by --ignore-threshold."
+		}
+		ignoreThreshold, err := parseRunNowOptions(inputCommand[2:])
+		if err != nil {
+			return err.Error()
+		}
+		runIds, err := jobKiller.runNowGroup(inputCommand[1], ignoreThreshold)
+		if err != nil {
+			return err.Error()
+		}
+		jobNames := make([]string, 0, len(runIds))
+		for jobName := range runIds {
+			jobNames = append(jobNames, jobName)
+		}
+		sort.Strings(jobNames)
+		response := ""
+		for _, jobName := range jobNames {
+			response += "Run " + runIds[jobName] + " requested for job " + jobName + "\n"
+		}
+		time.Sleep(1 * time.Second)
+		return response + "Current status: \n" + jobKiller.returnStatus()
+	case "kill":
+		if err := jobKiller.kill(arguments); err != nil {
+			return err.Error()
+		}
+		return jobKiller.returnStatusOf(arguments)
+	case "kill-group":
+		jobKiller.killGroup(arguments)
+		return jobKiller.returnStatus()
+	case "restart":
+		if err := jobKiller.restart(arguments); err != nil {
+			return err.Error()
+		}
+		time.Sleep(1 * time.Second)
+		return "Job restarted. Current status: \n" + jobKiller.returnStatusOf(arguments)
+	case "start":
+		if err := jobKiller.start(arguments); err != nil {
+			return err.Error()
+		}
+		time.Sleep(1 * time.Second)
+		return "Job started. Current status: \n" + jobKiller.returnStatusOf(arguments)
+	case "signal":
+		if len(inputCommand) < 3 {
+			return "In order to signal a job you need to pass the job name and the signal (e.g. SIGUSR1), separated by space."
+		}
+		if err := jobKiller.signal(inputCommand[1], inputCommand[2]); err != nil {
+			return err.Error()
+		}
+		return "Signal " + inputCommand[2] + " sent to job " + inputCommand[1] + "\n"
 	case "kill-all":
 		jobKiller.killAll()
 		return jobKiller.returnStatus()
+	case "state":
+		if arguments == "reset" {
+			if err := stateStore.reset(); err != nil {
+				return "Can't reset the state: " + err.Error() + "\n"
+			}
+			return "State cleared\n"
+		}
+		return stateStore.returnStatus()
+	case "history":
+		return jobKiller.returnHistory(arguments)
 	case "version":
 		return VERSION
+	case "add-job":
+		definition := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(command), "add-job"))
+		if definition == "" {
+			return "In order to add a job you need to pass its definition in JSON, as in the jobs of the config file."
+		}
+		jobs, err := jobKiller.addJob(definition)
+		if err != nil {
+			return "Can't add the job: " + err.Error() + "\n"
+		}
+		response := ""
+		for _, job := range jobs {
+			response += "Job " + job.Name + " added\n"
+		}
+		time.Sleep(1 * time.Second)
+		return response + "Current status: \n" + jobKiller.returnStatus()
+	case "remove-job":
+		if len(inputCommand) < 2 {
+			return "In order to remove a job you need to pass the job name, optionally followed by --graceful."
+		}
+		graceful := len(inputCommand) > 2 && inputCommand[2] == "--graceful"
+		jobs, err := jobKiller.removeJob(inputCommand[1], graceful)
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		response := ""
+		for _, job := range jobs {
+			if graceful {
+				response += "Job " + job.Name + " will be removed once its running command is done\n"
+			} else {
+				response += "Job " + job.Name + " removed\n"
+			}
+		}
+		return response
+	case "config":
+		return dumpConfig(arguments)
+	case "save-config":
+		saved, err := configSource.saveJobs(jobKiller.getJobs())
+		if err != nil {
+			return "Can't save the configuration: " + err.Error() + "\n"
+		}
+		response := ""
+		if len(saved) == 0 {
+			response = "The configuration already has the values of the jobs\n"
+		}
+		for _, file := range saved {
+			response += "Configuration saved to " + file.Path + ", previous version kept in " + file.BackupPath + "\n"
+		}
+		return response
 	case "update-job":
+		persist := false
+		for i := len(inputCommand) - 1; i >= 0; i-- {
+			if inputCommand[i] == "--persist" {
+				persist = true
+				inputCommand = append(inputCommand[:i], inputCommand[i+1:]...)
+			}
+		}
 		if len(inputCommand) < 4 {
 			return "In order to update the job property you need to pass the job name, the property that you need to update and the new value, all separated by space."
 		}
@@ -224,33 +430,79 @@ func createResponse(command string) string {
 		if err != nil {
 			return err.Error()
 		}
+		stateStore.recordOverride(jobName, updateJobArguments[0], strings.Join(updateJobArguments[1:], " "))
+		if persist {
+			saved, err := configSource.saveJobs([]*Job{job})
+			if err != nil {
+				return "Job updated but not saved to the configuration: " + err.Error() + "\n" + jobKiller.returnStatusOf(jobName)
+			}
+			if len(saved) == 0 {
+				return "Job updated, the configuration already has its values. Current status: \n" + jobKiller.returnStatusOf(jobName)
+			}
+			return "Job updated and saved to " + saved[0].Path + " (backup " + saved[0].BackupPath + "). Current status: \n" + jobKiller.returnStatusOf(jobName)
+		}
 		return "Job updated successfully. Current status: \n" + jobKiller.returnStatusOf(jobName)
 	default:
-		return "Commands available:\nstatus | status-of <job name> | pause <job name> | pause-group <group name> | pause-all | unpause <job name> | unpause-group <group name> | unpause-all | kill-all | version\n"
+		return "Commands available:\nstatus | status-of <job name> | connections | queues | pause <job name> [reason] [--by <who>] | pause-group <group name> [reason] [--by <who>] | pause-all [reason] [--by <who>] | unpause <job name> | unpause-group <group name> | unpause-all | run-now <job name> [--ignore-threshold] | run-now-group <group name> [--ignore-threshold] | kill <job name> | kill-group <group name> | restart <job name> | start <job name> | signal <job name> <SIGUSR1|SIGHUP|...> | kill-all | add-job <job json> | remove-job <job name> [--graceful] | update-job <job name> <property> <value> [--persist] | save-config | config [<job name>] | state | state reset | history <job name> | version\n"
 	}
 }
 
+// parsePauseInfo reads the optional "[reason...] [--by <who>]" of the pause commands
+func parsePauseInfo(arguments []string) PauseInfo {
+	var info PauseInfo
+	reason := []string{}
+	for i := 0; i < len(arguments); i++ {
+		if arguments[i] == "--by" && i+1 < len(arguments) {
+			info.By = arguments[i+1]
+			i++
+			continue
+		}
+		reason = append(reason, arguments[i])
+	}
+	info.Reason = strings.Join(reason, " ")
+	return info
+}
+
+// withPausedBy adds who runs the command line to the pause commands that
+// don't say who is pausing
+func withPausedBy(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || (fields[0] != "pause" && fields[0] != "pause-group" && fields[0] != "pause-all") {
+		return command
+	}
+	for _, field := range fields {
+		if field == "--by" {
+			return command
+		}
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return command
+	}
+	return command + " --by " + currentUser.Username
+}
+
 func commandLineService(command string) {
-	endpoint := "localhost:" + *port
+	sendCommand("localhost:"+*port, withPausedBy(command), os.Stdout)
+}
+
+// sendCommand sends the command to the service and copies its response,
+// which ends when the service closes the connection, to output
+func sendCommand(endpoint string, command string, output io.Writer) {
 	connection, err := net.Dial("tcp", endpoint)
 	if err != nil {
-		fmt.Printf("Failed to connect to service at %s: %v\n", endpoint, err)
+		fmt.Fprintf(output, "Failed to connect to service at %s: %v\n", endpoint, err)
 		return
 	}
 	defer connection.Close()
 
 	_, err = connection.Write([]byte(command))
 	if err != nil {
-		fmt.Printf("Failed to send command: %v\n", err)
+		fmt.Fprintf(output, "Failed to send command: %v\n", err)
 		return
 	}
 
-	buffer := make([]byte, 4096)
-	n, err := connection.Read(buffer)
-	if err != nil {
-		fmt.Printf("Failed to read response: %v\n", err)
-		return
+	if _, err := io.Copy(output, connection); err != nil {
+		fmt.Fprintf(output, "Failed to read response: %v\n", err)
 	}
-
-	fmt.Print(string(buffer[:n]))
 }
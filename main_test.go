@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -79,3 +84,86 @@ func TestCreateResponse_UpdateJob_InsufficientArgs(t *testing.T) {
 		t.Error("Expected usage message for insufficient arguments")
 	}
 }
+
+func TestCreateResponse_Connections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/overview" {
+			t.Errorf("Expected overview request, got %v", r.URL.Path)
+		}
+		w.Write([]byte(`{"rabbitmq_version":"3.13.7","cluster_name":"rabbit@test"}`))
+	}))
+	defer server.Close()
+	jobKiller = JobKiller{Jobs: []*Job{}, Connections: []ConnectionConfig{
+		{Name: "overview_test", Endpoint: server.URL},
+		{Name: "overview_test_down", Endpoint: "http://localhost:59994"},
+	}}
+
+	response := createResponse("connections")
+
+	if !strings.Contains(response, "3.13.7") {
+		t.Errorf("Expected RabbitMQ version in response, got:\n%s", response)
+	}
+	for _, line := range strings.Split(response, "\n") {
+		if strings.HasPrefix(line, "overview_test ") && !strings.Contains(line, "yes") {
+			t.Errorf("Expected reachable connection, got: %s", line)
+		}
+		if strings.HasPrefix(line, "overview_test_down ") && (!strings.Contains(line, "no") || !strings.Contains(line, "refused")) {
+			t.Errorf("Expected unreachable connection with its error, got: %s", line)
+		}
+	}
+}
+
+func TestCreateResponse_Queues(t *testing.T) {
+	polled := &Job{Name: "polled", ConnectionName: "main", Queue: "work", ConnectionConfig: ConnectionConfig{Name: "main", Vhost: "/"}}
+	polled.recordQueueInfo(&QueueInfo{Messages: 12, MessagesReady: 10, MessagesUnacknowledged: 2, Consumers: 3})
+	idle := &Job{Name: "idle", ConnectionName: "main", Queue: "other", ConnectionConfig: ConnectionConfig{Name: "main", Vhost: "/"}}
+	jobKiller = JobKiller{Jobs: []*Job{polled, idle}}
+
+	response := createResponse("queues")
+
+	lines := strings.Split(response, "\n")
+	if len(lines) < 3 {
+		t.Fatalf("Expected a line per job, got:\n%s", response)
+	}
+	for _, expected := range []string{"12", "10", "2", "3", "queue: work on vhost: /"} {
+		if !strings.Contains(lines[1], expected) {
+			t.Errorf("Expected %q in %q", expected, lines[1])
+		}
+	}
+	if !strings.Contains(lines[2], "never") {
+		t.Errorf("Expected job never polled, got %q", lines[2])
+	}
+}
+
+func TestSendCommand_ReadsWholeResponse(t *testing.T) {
+	useTestConfig(t, dumpTestConfig)
+	for _, queue := range []string{"refunds", "payments"} {
+		if _, err := jobKiller.addJob(`{"name": "` + queue + `", "extends": "php", "queue": "` + queue + `"}`); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleRequest(conn)
+		}
+	}()
+
+	var output bytes.Buffer
+	sendCommand(listener.Addr().String(), "config", &output)
+
+	if output.Len() <= 4096 {
+		t.Fatalf("Expected a dump larger than 4 KB, got %v bytes", output.Len())
+	}
+	if !json.Valid(output.Bytes()) || output.String() != createResponse("config") {
+		t.Errorf("Expected the whole dump, got %v bytes:\n%s", output.Len(), output.String())
+	}
+}
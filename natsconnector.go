@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var errNatsJobIncomplete = errors.New("a NATS job needs both a stream and a consumer")
+
+type NatsClient struct {
+	Name       string
+	Endpoint   string
+	Username   string
+	Password   string
+	TLSConfig  *tls.Config
+	cluster    *ConnectionState
+	connection *nats.Conn
+	mu         sync.Mutex // protects connection
+}
+
+func createNatsClient(connectionConfig ConnectionConfig) *NatsClient {
+	client := NatsClient{
+		Name:     connectionConfig.Name,
+		Endpoint: strings.Join(connectionConfig.getEndpoints(), ","),
+		Username: connectionConfig.Username,
+		Password: connectionConfig.Password,
+	}
+
+	return &client
+}
+
+// connect returns a JetStream handle, dialing the server again if the
+// previous connection was never established or has been closed.
+// Reconnects of a live connection are handled by the NATS client itself.
+func (client *NatsClient) connect() (jetstream.JetStream, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.connection == nil || client.connection.IsClosed() {
+		options := []nats.Option{
+			nats.Name("gormq-supervisor"),
+			nats.Timeout(10 * time.Second),
+			nats.MaxReconnects(-1),
+			nats.ReconnectWait(2 * time.Second),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+				if err != nil {
+					log.Printf("Disconnected from NATS connection %q: %v\n", client.Name, err)
+				}
+			}),
+			nats.ReconnectHandler(func(conn *nats.Conn) {
+				log.Printf("Reconnected to NATS connection %q at %v\n", client.Name, conn.ConnectedUrl())
+			}),
+		}
+		if client.Username != "" {
+			// Asked again on every reconnect, to use the credentials
+			// refreshed from Vault
+			options = append(options, nats.UserInfoHandler(func() (string, string) {
+				credentials := client.cluster.getCredentials(ConnectionCredentials{Username: client.Username, Password: client.Password})
+				return credentials.Username, credentials.Password
+			}))
+		}
+		if client.TLSConfig != nil {
+			options = append(options, nats.Secure(client.TLSConfig))
+		}
+		connection, err := nats.Connect(client.Endpoint, options...)
+		if err != nil {
+			return nil, err
+		}
+		client.connection = connection
+	}
+	if !client.connection.IsConnected() {
+		return nil, fmt.Errorf("connection to %v is %v", client.Endpoint, client.connection.Status())
+	}
+
+	return jetstream.New(client.connection)
+}
+
+func (client *NatsClient) getQueueInfo(job *Job) (*QueueInfo, error) {
+	if job.Stream == "" || job.Consumer == "" {
+		return nil, errNatsJobIncomplete
+	}
+	js, err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	consumer, err := js.Consumer(ctx, job.Stream, job.Consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.cluster != nil {
+		client.cluster.markSuccess(client.connection.ConnectedUrl())
+	}
+
+	info := consumer.CachedInfo()
+	pending := int(info.NumPending)
+	return &QueueInfo{
+		Messages:               pending + info.NumAckPending,
+		MessagesReady:          pending,
+		MessagesUnacknowledged: info.NumAckPending,
+	}, nil
+}
+
+func (client *NatsClient) Close() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.connection != nil {
+		client.connection.Close()
+		client.connection = nil
+	}
+}
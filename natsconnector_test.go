@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func startTestNatsServer(t *testing.T) *natsserver.Server {
+	t.Helper()
+	natsServer, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start in time")
+	}
+	t.Cleanup(natsServer.Shutdown)
+	return natsServer
+}
+
+// setupTestStream creates a stream with a durable consumer, publishes the
+// given number of messages and fetches (without acking) the given number of them
+func setupTestStream(t *testing.T, url string, published int, fetched int) {
+	t.Helper()
+	conn, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer conn.Close()
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatalf("Failed to create JetStream context: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "EDGE", Subjects: []string{"edge.>"}})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   "ingest",
+		AckPolicy: jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	for i := 0; i < published; i++ {
+		if _, err := js.Publish(ctx, "edge.data", []byte("payload")); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+	if fetched > 0 {
+		batch, err := consumer.Fetch(fetched, jetstream.FetchMaxWait(2*time.Second))
+		if err != nil {
+			t.Fatalf("Failed to fetch: %v", err)
+		}
+		for range batch.Messages() {
+		}
+	}
+}
+
+func TestNatsClient_GetQueueInfo_PendingAndAckPending(t *testing.T) {
+	natsServer := startTestNatsServer(t)
+	setupTestStream(t, natsServer.ClientURL(), 5, 2)
+
+	client := createNatsClient(ConnectionConfig{Name: "edge", Type: "nats", Endpoint: natsServer.ClientURL()})
+	defer client.Close()
+
+	job := &Job{Name: "nats_job", Stream: "EDGE", Consumer: "ingest"}
+	queueInfo, err := client.getQueueInfo(job)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if queueInfo.MessagesReady != 3 {
+		t.Errorf("Expected 3 pending messages, got %d", queueInfo.MessagesReady)
+	}
+	if queueInfo.MessagesUnacknowledged != 2 {
+		t.Errorf("Expected 2 ack pending messages, got %d", queueInfo.MessagesUnacknowledged)
+	}
+	if queueInfo.Messages != 5 {
+		t.Errorf("Expected 5 messages, got %d", queueInfo.Messages)
+	}
+}
+
+func TestNatsClient_GetQueueInfo_UnknownConsumer(t *testing.T) {
+	natsServer := startTestNatsServer(t)
+	setupTestStream(t, natsServer.ClientURL(), 0, 0)
+
+	client := createNatsClient(ConnectionConfig{Name: "edge", Type: "nats", Endpoint: natsServer.ClientURL()})
+	defer client.Close()
+
+	job := &Job{Name: "nats_job", Stream: "EDGE", Consumer: "missing"}
+	queueInfo, err := client.getQueueInfo(job)
+	if err == nil {
+		t.Error("Expected error for unknown consumer")
+	}
+	if queueInfo != nil {
+		t.Error("Expected nil queueInfo for unknown consumer")
+	}
+}
+
+func TestNatsClient_GetQueueInfo_MissingStreamOrConsumer(t *testing.T) {
+	client := createNatsClient(ConnectionConfig{Name: "edge", Type: "nats", Endpoint: "nats://127.0.0.1:1"})
+
+	_, err := client.getQueueInfo(&Job{Name: "nats_job", Consumer: "ingest"})
+	if err == nil {
+		t.Error("Expected error for missing stream")
+	}
+	_, err = client.getQueueInfo(&Job{Name: "nats_job", Stream: "EDGE"})
+	if err == nil {
+		t.Error("Expected error for missing consumer")
+	}
+}
+
+func TestNatsClient_GetQueueInfo_ConnectionRefused(t *testing.T) {
+	client := createNatsClient(ConnectionConfig{Name: "edge", Type: "nats", Endpoint: "nats://127.0.0.1:59998"})
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "nats_job", Stream: "EDGE", Consumer: "ingest"})
+	if err == nil {
+		t.Error("Expected error for connection refused")
+	}
+	if queueInfo != nil {
+		t.Error("Expected nil queueInfo for connection refused")
+	}
+}
+
+func TestNatsClient_ReconnectsAfterServerRestart(t *testing.T) {
+	storeDir := t.TempDir()
+	options := &natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoLog:     true,
+		NoSigs:    true,
+	}
+	natsServer, err := natsserver.NewServer(options)
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start in time")
+	}
+	url := natsServer.ClientURL()
+	port := natsServer.Addr().(*net.TCPAddr).Port
+	setupTestStream(t, url, 1, 0)
+
+	client := createNatsClient(ConnectionConfig{Name: "edge", Type: "nats", Endpoint: url})
+	defer client.Close()
+	job := &Job{Name: "nats_job", Stream: "EDGE", Consumer: "ingest"}
+
+	if _, err := client.getQueueInfo(job); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	natsServer.Shutdown()
+	natsServer.WaitForShutdown()
+	for client.connection.IsConnected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.getQueueInfo(job); err == nil {
+		t.Error("Expected error while the server is down")
+	}
+
+	options.Port = port
+	restarted, err := natsserver.NewServer(options)
+	if err != nil {
+		t.Fatalf("Failed to restart NATS server: %v", err)
+	}
+	go restarted.Start()
+	defer restarted.Shutdown()
+	if !restarted.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not restart in time")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		queueInfo, err := client.getQueueInfo(job)
+		if err == nil {
+			if queueInfo.Messages != 1 {
+				t.Errorf("Expected 1 message after reconnect, got %d", queueInfo.Messages)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Client did not reconnect: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -9,13 +10,49 @@ import (
 )
 
 type Client struct {
-	Endpoint string
-	Username string
-	Password string
+	Endpoint  string
+	Username  string
+	Password  string
+	Transport http.RoundTripper
+	cluster   *ConnectionState
+}
+
+// StatusError is returned when the management API answers with an
+// unexpected status code
+type StatusError struct {
+	StatusCode int
+	Vhost      string
+	QueueName  string
+}
+
+func (err *StatusError) Error() string {
+	if isAuthFailure(err) {
+		return fmt.Sprintf("management API refused the credentials with status %v", err.StatusCode)
+	}
+	if err.QueueName == "" {
+		return fmt.Sprintf("management API answered with status %v", err.StatusCode)
+	}
+	return fmt.Sprintf("can't recover information for queue %v on virtual host %v", err.QueueName, err.Vhost)
 }
 
 type QueueInfo struct {
-	Messages int `json:"messages"`
+	Messages               int `json:"messages"`
+	MessagesReady          int `json:"messages_ready"`
+	MessagesUnacknowledged int `json:"messages_unacknowledged"`
+	Consumers              int `json:"consumers"`
+}
+
+// NodeInfo is the part of /api/nodes describing the resource alarms of a node
+type NodeInfo struct {
+	Name          string `json:"name"`
+	MemAlarm      bool   `json:"mem_alarm"`
+	DiskFreeAlarm bool   `json:"disk_free_alarm"`
+}
+
+// Overview is the part of /api/overview describing the broker
+type Overview struct {
+	RabbitmqVersion string `json:"rabbitmq_version"`
+	ClusterName     string `json:"cluster_name"`
 }
 
 func createClient(Endpoint string, Username string, Password string) *Client {
@@ -29,18 +66,30 @@ func createClient(Endpoint string, Username string, Password string) *Client {
 	return &client
 }
 
+// credentials returns the username and password of the connection, as
+// refreshed from Vault when they come from it
+func (client *Client) credentials() (string, string) {
+	credentials := client.cluster.getCredentials(ConnectionCredentials{Username: client.Username, Password: client.Password})
+	return credentials.Username, credentials.Password
+}
+
 func (client *Client) getQueue(Vhost string, QueueName string) (*QueueInfo, error) {
+	return client.getQueueFrom(client.Endpoint, Vhost, QueueName)
+}
+
+func (client *Client) getQueueFrom(Endpoint string, Vhost string, QueueName string) (*QueueInfo, error) {
 	httpClient := &http.Client{
-		Timeout: time.Second * 10,
+		Timeout:   time.Second * 10,
+		Transport: client.Transport,
 	}
 
-	apiEndpoint := client.Endpoint + "/api/queues/" + url.QueryEscape(Vhost) + "/" + url.QueryEscape(QueueName)
+	apiEndpoint := Endpoint + "/api/queues/" + url.QueryEscape(Vhost) + "/" + url.QueryEscape(QueueName)
 
 	req, err := http.NewRequest("GET", apiEndpoint, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(client.Username, client.Password)
+	req.SetBasicAuth(client.credentials())
 	response, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -48,7 +97,7 @@ func (client *Client) getQueue(Vhost string, QueueName string) (*QueueInfo, erro
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("can't recover information for queue %v on virtual host %v", QueueName, Vhost)
+		return nil, &StatusError{StatusCode: response.StatusCode, Vhost: Vhost, QueueName: QueueName}
 	}
 
 	var queueInfo QueueInfo
@@ -57,18 +106,106 @@ func (client *Client) getQueue(Vhost string, QueueName string) (*QueueInfo, erro
 	return &queueInfo, nil
 }
 
-func (client *Client) getMessages(job *Job) (int, bool) {
-	if *testMode {
-		return 1, true
+func (client *Client) getQueueInfo(job *Job) (*QueueInfo, error) {
+	var queueInfo *QueueInfo
+	err := client.tryEndpoints(func(endpoint string) error {
+		var err error
+		queueInfo, err = client.getQueueFrom(endpoint, job.GetConnectionConfig().Vhost, job.GetQueue())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queueInfo, nil
+}
+
+func (client *Client) getOverview() (*Overview, error) {
+	var overview *Overview
+	err := client.tryEndpoints(func(endpoint string) error {
+		var err error
+		overview, err = client.getOverviewFrom(endpoint)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return overview, nil
+}
+
+func (client *Client) getOverviewFrom(Endpoint string) (*Overview, error) {
+	var overview Overview
+	if err := client.getJSONFrom(Endpoint, "/api/overview", &overview); err != nil {
+		return nil, err
+	}
+	return &overview, nil
+}
+
+func (client *Client) getNodes() ([]NodeInfo, error) {
+	var nodes []NodeInfo
+	err := client.tryEndpoints(func(endpoint string) error {
+		nodes = nil
+		return client.getJSONFrom(endpoint, "/api/nodes", &nodes)
+	})
+	if err != nil {
+		return nil, err
 	}
-	q, err := client.getQueue(job.ConnectionConfig.Vhost, job.Queue)
+	return nodes, nil
+}
+
+// getJSONFrom decodes the answer of the management API to path into target
+func (client *Client) getJSONFrom(Endpoint string, path string, target interface{}) error {
+	httpClient := &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: client.Transport,
+	}
+
+	req, err := http.NewRequest("GET", Endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(client.credentials())
+	response, err := httpClient.Do(req)
 	if err != nil {
-		var arrayOutput []string
-		output := fmt.Sprintf("Can't connect to queue: %v on vhost: %v - Error: %v", job.Queue, job.ConnectionConfig.Vhost, err)
-		arrayOutput = append(arrayOutput, output)
-		job.logOutput(arrayOutput)
-		return 0, false
+		return err
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: response.StatusCode}
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
 
-	return q.Messages, true
+// tryEndpoints sends request to the endpoints of the connection in turn,
+// until one of them answers. Answers that would be the same on every node of
+// the cluster (e.g. a missing queue) are returned straight away.
+func (client *Client) tryEndpoints(request func(endpoint string) error) error {
+	if client.cluster == nil {
+		return request(client.Endpoint)
+	}
+	var lastErr error
+	for _, endpoint := range client.cluster.candidates() {
+		err := request(endpoint)
+		if err == nil || !isNodeFailure(err) {
+			client.cluster.markSuccess(endpoint)
+			return err
+		}
+		client.cluster.markFailure(endpoint, err)
+		lastErr = err
+	}
+	return lastErr
+}
+
+// isNodeFailure tells whether err comes from the node itself (unreachable,
+// overloaded, shutting down) rather than from the request
+func isNodeFailure(err error) bool {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= 500
+	}
+	return true
 }
+
+// Close is a no-op: every poll uses its own HTTP request
+func (client *Client) Close() {}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -239,3 +241,202 @@ func TestClient_GetQueue_LargeMessageCount(t *testing.T) {
 		t.Errorf("Expected 1000000 messages, got %d", queueInfo.Messages)
 	}
 }
+
+func newMutualTLSServer(t *testing.T, certificates testCertificates) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(QueueInfo{Messages: 3})
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{certificates.serverCert},
+		ClientCAs:    certificates.caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_GetQueue_MutualTLS(t *testing.T) {
+	certificates := createTestCertificates(t)
+	server := newMutualTLSServer(t, certificates)
+
+	connector, err := createConnector(ConnectionConfig{
+		Name:       "secure",
+		Endpoint:   server.URL,
+		CaFile:     certificates.caFile,
+		CertFile:   certificates.certFile,
+		KeyFile:    certificates.keyFile,
+		ServerName: "rabbit.internal",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	queueInfo, err := connector.(*Client).getQueue("/", "test_queue")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if queueInfo.Messages != 3 {
+		t.Errorf("Expected 3 messages, got %d", queueInfo.Messages)
+	}
+}
+
+func TestClient_GetQueue_MutualTLS_Rejected(t *testing.T) {
+	certificates := createTestCertificates(t)
+	server := newMutualTLSServer(t, certificates)
+
+	tests := []struct {
+		name   string
+		config ConnectionConfig
+	}{
+		{"without client certificate", ConnectionConfig{Name: "secure", Endpoint: server.URL, CaFile: certificates.caFile, ServerName: "rabbit.internal"}},
+		{"without custom CA", ConnectionConfig{Name: "secure", Endpoint: server.URL, CertFile: certificates.certFile, KeyFile: certificates.keyFile, ServerName: "rabbit.internal"}},
+		{"with wrong server name", ConnectionConfig{Name: "secure", Endpoint: server.URL, CaFile: certificates.caFile, CertFile: certificates.certFile, KeyFile: certificates.keyFile, ServerName: "other.internal"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector, err := createConnector(tt.config)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := connector.(*Client).getQueue("/", "test_queue"); err == nil {
+				t.Errorf("Expected TLS error %s", tt.name)
+			}
+		})
+	}
+}
+
+func TestClient_GetQueue_InsecureSkipVerify(t *testing.T) {
+	certificates := createTestCertificates(t)
+	server := newMutualTLSServer(t, certificates)
+
+	connector, err := createConnector(ConnectionConfig{
+		Name:               "insecure",
+		Endpoint:           server.URL,
+		CertFile:           certificates.certFile,
+		KeyFile:            certificates.keyFile,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := connector.(*Client).getQueue("/", "test_queue"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func newClusterTestClient(endpoints ...string) *Client {
+	connectionConfig := ConnectionConfig{Name: "cluster", Endpoints: endpoints, Vhost: "/"}
+	client := createClient(endpoints[0], "guest", "guest")
+	client.cluster = createConnectionState(connectionConfig)
+	return client
+}
+
+func newQueueServer(t *testing.T, statusCode int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if statusCode != http.StatusOK {
+			w.WriteHeader(statusCode)
+			return
+		}
+		json.NewEncoder(w).Encode(QueueInfo{Messages: 7})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_GetQueueInfo_Failover(t *testing.T) {
+	down := newQueueServer(t, http.StatusServiceUnavailable)
+	up := newQueueServer(t, http.StatusOK)
+	client := newClusterTestClient(down.URL, up.URL)
+	job := &Job{Name: "job1", Queue: "test_queue", ConnectionConfig: ConnectionConfig{Vhost: "/"}}
+
+	queueInfo, err := client.getQueueInfo(job)
+	if err != nil {
+		t.Fatalf("Expected failover to the second node, got %v", err)
+	}
+	if queueInfo.Messages != 7 {
+		t.Errorf("Expected 7 messages, got %d", queueInfo.Messages)
+	}
+	if client.cluster.getCurrent() != up.URL {
+		t.Errorf("Expected current node %v, got %v", up.URL, client.cluster.getCurrent())
+	}
+	if client.cluster.Endpoints[0].Healthy {
+		t.Error("Expected the first node to be marked unhealthy")
+	}
+}
+
+func TestClient_GetQueueInfo_FailoverOnClosedNode(t *testing.T) {
+	closed := newQueueServer(t, http.StatusOK)
+	closed.Close()
+	up := newQueueServer(t, http.StatusOK)
+	client := newClusterTestClient(closed.URL, up.URL)
+
+	_, err := client.getQueueInfo(&Job{Name: "job1", Queue: "test_queue"})
+	if err != nil {
+		t.Fatalf("Expected failover to the second node, got %v", err)
+	}
+}
+
+func TestClient_GetQueueInfo_NoFailoverOnNotFound(t *testing.T) {
+	missing := newQueueServer(t, http.StatusNotFound)
+	up := newQueueServer(t, http.StatusOK)
+	client := newClusterTestClient(missing.URL, up.URL)
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "job1", Queue: "test_queue"})
+	if err == nil {
+		t.Error("Expected the missing queue error")
+	}
+	if queueInfo != nil {
+		t.Error("Expected nil queueInfo for a missing queue")
+	}
+	if !client.cluster.Endpoints[0].Healthy {
+		t.Error("Expected a missing queue not to mark the node unhealthy")
+	}
+}
+
+func TestClient_GetQueueInfo_AllNodesDown(t *testing.T) {
+	first := newQueueServer(t, http.StatusBadGateway)
+	second := newQueueServer(t, http.StatusServiceUnavailable)
+	client := newClusterTestClient(first.URL, second.URL)
+
+	_, err := client.getQueueInfo(&Job{Name: "job1", Queue: "test_queue"})
+	if err == nil {
+		t.Error("Expected an error when every node is down")
+	}
+	if healthy, _ := client.cluster.countHealthy(); healthy != 0 {
+		t.Errorf("Expected no healthy node, got %d", healthy)
+	}
+}
+
+func TestClient_GetOverview_Failover(t *testing.T) {
+	down := newQueueServer(t, http.StatusServiceUnavailable)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/overview" {
+			t.Errorf("Expected overview request, got %v", r.URL.Path)
+		}
+		w.Write([]byte(`{"rabbitmq_version":"4.0.5","cluster_name":"rabbit@node2"}`))
+	}))
+	defer up.Close()
+	client := newClusterTestClient(down.URL, up.URL)
+
+	overview, err := client.getOverview()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if overview.RabbitmqVersion != "4.0.5" || overview.ClusterName != "rabbit@node2" {
+		t.Errorf("Unexpected overview %+v", overview)
+	}
+}
+
+func TestClient_GetOverview_Unauthorized(t *testing.T) {
+	server := newQueueServer(t, http.StatusUnauthorized)
+	client := createClient(server.URL, "guest", "wrong")
+
+	_, err := client.getOverview()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected status in error, got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// JobRelations enforces the relations between jobs: a job doesn't launch
+// while a job it conflicts with (in either direction) runs, and a job with
+// dependencies launches only once each of them completed a run (a
+// successful one with on_success) since its own last launch. Relations name
+// jobs as in the configuration, so they cover every spawned copy.
+type JobRelations struct {
+	jobs     map[string][]*Job
+	states   map[*Job]*jobRunState
+	sequence int
+	mu       sync.Mutex // protects every field
+}
+
+type jobRunState struct {
+	running       bool
+	startedAt     int
+	completedAt   int
+	succeededAt   int
+	blockedReason string
+}
+
+// jobRelations is replaced by worker with the jobs of the configuration
+var jobRelations = createJobRelations(nil)
+
+func createJobRelations(jobs []*Job) *JobRelations {
+	relations := JobRelations{
+		jobs:   make(map[string][]*Job),
+		states: make(map[*Job]*jobRunState),
+	}
+	for _, job := range jobs {
+		relations.jobs[job.getBaseName()] = append(relations.jobs[job.getBaseName()], job)
+		relations.states[job] = &jobRunState{}
+	}
+
+	return &relations
+}
+
+// add registers a job added at runtime
+func (relations *JobRelations) add(job *Job) {
+	relations.mu.Lock()
+	defer relations.mu.Unlock()
+	relations.jobs[job.getBaseName()] = append(relations.jobs[job.getBaseName()], job)
+	relations.states[job] = &jobRunState{}
+}
+
+// remove forgets a job removed at runtime
+func (relations *JobRelations) remove(job *Job) {
+	relations.mu.Lock()
+	defer relations.mu.Unlock()
+	copies := relations.jobs[job.getBaseName()]
+	for i, other := range copies {
+		if other == job {
+			copies = append(copies[:i:i], copies[i+1:]...)
+			break
+		}
+	}
+	if len(copies) == 0 {
+		delete(relations.jobs, job.getBaseName())
+	} else {
+		relations.jobs[job.getBaseName()] = copies
+	}
+	delete(relations.states, job)
+}
+
+// tryStart marks the job as running when its relations allow it to launch,
+// otherwise it records (and returns) why it is held back
+func (relations *JobRelations) tryStart(job *Job) (bool, string) {
+	relations.mu.Lock()
+	defer relations.mu.Unlock()
+
+	state := relations.getStateLocked(job)
+	reason := relations.blockedReasonLocked(job, state)
+	state.blockedReason = reason
+	if reason != "" {
+		return false, reason
+	}
+	relations.sequence++
+	state.running = true
+	state.startedAt = relations.sequence
+	return true, ""
+}
+
+// finish marks the job as no longer running. Dependent jobs only count the
+// runs that executed the command.
+func (relations *JobRelations) finish(job *Job, executed bool, succeeded bool) {
+	relations.mu.Lock()
+	defer relations.mu.Unlock()
+
+	state := relations.getStateLocked(job)
+	state.running = false
+	if !executed {
+		return
+	}
+	relations.sequence++
+	state.completedAt = relations.sequence
+	if succeeded {
+		state.succeededAt = relations.sequence
+	}
+}
+
+func (relations *JobRelations) getBlockedReason(job *Job) string {
+	relations.mu.Lock()
+	defer relations.mu.Unlock()
+	return relations.getStateLocked(job).blockedReason
+}
+
+func (relations *JobRelations) getStateLocked(job *Job) *jobRunState {
+	state, found := relations.states[job]
+	if !found {
+		state = &jobRunState{}
+		relations.states[job] = state
+	}
+	return state
+}
+
+func (relations *JobRelations) blockedReasonLocked(job *Job, state *jobRunState) string {
+	for other, otherState := range relations.states {
+		if other != job && otherState.running && conflicts(job, other) {
+			return "conflicts with running job " + other.Name
+		}
+	}
+	var waitingFor []string
+	for _, dependency := range job.After {
+		if !relations.hasRunSinceLocked(dependency, state.startedAt, job.OnSuccess) {
+			waitingFor = append(waitingFor, dependency)
+		}
+	}
+	if len(waitingFor) > 0 {
+		if job.OnSuccess {
+			return "waiting for a successful run of " + strings.Join(waitingFor, ", ")
+		}
+		return "waiting for a run of " + strings.Join(waitingFor, ", ")
+	}
+	return ""
+}
+
+// hasRunSinceLocked tells whether a copy of the named job completed a run
+// after the given point
+func (relations *JobRelations) hasRunSinceLocked(name string, since int, onSuccess bool) bool {
+	for _, dependency := range relations.jobs[name] {
+		state := relations.getStateLocked(dependency)
+		completedAt := state.completedAt
+		if onSuccess {
+			completedAt = state.succeededAt
+		}
+		if completedAt > since {
+			return true
+		}
+	}
+	return false
+}
+
+// conflicts tells whether one of the jobs declared conflicts_with the other
+func conflicts(job *Job, other *Job) bool {
+	for _, name := range job.ConflictsWith {
+		if name == other.getBaseName() {
+			return true
+		}
+	}
+	for _, name := range other.ConflictsWith {
+		if name == job.getBaseName() {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRelations checks that relations name existing jobs and that the
+// dependencies don't form a cycle
+func validateRelations(jobs []*Job) error {
+	dependencies := make(map[string][]string)
+	for _, job := range jobs {
+		dependencies[job.Name] = job.After
+	}
+	for _, job := range jobs {
+		for _, name := range append(append([]string{}, job.ConflictsWith...), job.After...) {
+			if name == job.Name {
+				return fmt.Errorf("job %q can't refer to itself in its relations", job.Name)
+			}
+			if _, found := dependencies[name]; !found {
+				return fmt.Errorf("job %q refers to unknown job %q", job.Name, name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(dependencies))
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	const visiting, visited = 1, 2
+	marks := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		switch marks[name] {
+		case visiting:
+			start := 0
+			for path[start] != name {
+				start++
+			}
+			return fmt.Errorf("jobs have a dependency cycle: %v", strings.Join(path[start:], " -> "))
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, dependency := range dependencies[name] {
+			if err := visit(dependency, path); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func createRelatedJob(name string, configure func(job *Job)) *Job {
+	job := createTestJob(name, nil)
+	if configure != nil {
+		configure(job)
+	}
+	return job
+}
+
+func TestValidateRelations(t *testing.T) {
+	valid := []*Job{
+		createRelatedJob("import", nil),
+		createRelatedJob("reindex", func(job *Job) { job.ConflictsWith = []string{"import"} }),
+		createRelatedJob("report", func(job *Job) { job.After = []string{"import", "reindex"} }),
+	}
+	if err := validateRelations(valid); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	unknown := []*Job{createRelatedJob("report", func(job *Job) { job.After = []string{"missing"} })}
+	if err := validateRelations(unknown); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected unknown job error, got %v", err)
+	}
+
+	self := []*Job{createRelatedJob("import", func(job *Job) { job.ConflictsWith = []string{"import"} })}
+	if err := validateRelations(self); err == nil {
+		t.Error("Expected error for a job referring to itself")
+	}
+
+	cycle := []*Job{
+		createRelatedJob("a", func(job *Job) { job.After = []string{"b"} }),
+		createRelatedJob("b", func(job *Job) { job.After = []string{"c"} }),
+		createRelatedJob("c", func(job *Job) { job.After = []string{"a"} }),
+	}
+	err := validateRelations(cycle)
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("Expected the cycle in the error, got %v", err)
+	}
+}
+
+func TestJobRelations_ConflictsBothWays(t *testing.T) {
+	importJob := createRelatedJob("import", nil)
+	reindex := createRelatedJob("reindex", func(job *Job) { job.ConflictsWith = []string{"import"} })
+	relations := createJobRelations([]*Job{importJob, reindex})
+
+	if started, _ := relations.tryStart(importJob); !started {
+		t.Fatal("Expected import to start")
+	}
+	started, reason := relations.tryStart(reindex)
+	if started || !strings.Contains(reason, "import") {
+		t.Errorf("Expected reindex to be blocked by import, got %v %q", started, reason)
+	}
+	relations.finish(importJob, true, true)
+
+	if started, _ := relations.tryStart(reindex); !started {
+		t.Fatal("Expected reindex to start")
+	}
+	if started, _ := relations.tryStart(importJob); started {
+		t.Error("Expected import to be blocked by reindex")
+	}
+}
+
+func TestJobRelations_ConflictsWithSpawnedCopies(t *testing.T) {
+	import0 := createRelatedJob("import_0", func(job *Job) { job.baseName = "import" })
+	import1 := createRelatedJob("import_1", func(job *Job) { job.baseName = "import" })
+	reindex := createRelatedJob("reindex", func(job *Job) { job.ConflictsWith = []string{"import"} })
+	relations := createJobRelations([]*Job{import0, import1, reindex})
+
+	relations.tryStart(import1)
+	if started, _ := relations.tryStart(reindex); started {
+		t.Error("Expected reindex to be blocked by a spawned copy of import")
+	}
+	if started, _ := relations.tryStart(import0); !started {
+		t.Error("Expected copies of the same job not to conflict")
+	}
+}
+
+func TestJobRelations_After(t *testing.T) {
+	importJob := createRelatedJob("import", nil)
+	report := createRelatedJob("report", func(job *Job) { job.After = []string{"import"} })
+	relations := createJobRelations([]*Job{importJob, report})
+
+	started, reason := relations.tryStart(report)
+	if started || reason != "waiting for a run of import" {
+		t.Errorf("Expected report to wait for import, got %v %q", started, reason)
+	}
+
+	// A run that didn't execute the command doesn't count
+	relations.tryStart(importJob)
+	relations.finish(importJob, false, false)
+	if started, _ := relations.tryStart(report); started {
+		t.Error("Expected report to keep waiting")
+	}
+
+	relations.tryStart(importJob)
+	relations.finish(importJob, true, false)
+	if started, _ := relations.tryStart(report); !started {
+		t.Fatal("Expected report to start after import ran")
+	}
+	relations.finish(report, true, true)
+
+	// Each run of report needs a new run of import
+	if started, _ := relations.tryStart(report); started {
+		t.Error("Expected report to wait for the next run of import")
+	}
+}
+
+func TestJobRelations_AfterOnSuccess(t *testing.T) {
+	importJob := createRelatedJob("import", nil)
+	report := createRelatedJob("report", func(job *Job) {
+		job.After = []string{"import"}
+		job.OnSuccess = true
+	})
+	relations := createJobRelations([]*Job{importJob, report})
+
+	relations.tryStart(importJob)
+	relations.finish(importJob, true, false)
+	started, reason := relations.tryStart(report)
+	if started || reason != "waiting for a successful run of import" {
+		t.Errorf("Expected report to wait for a successful import, got %v %q", started, reason)
+	}
+
+	relations.tryStart(importJob)
+	relations.finish(importJob, true, true)
+	if started, _ := relations.tryStart(report); !started {
+		t.Error("Expected report to start after import succeeded")
+	}
+}
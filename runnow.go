@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RunRequest is a run asked through the run-now commands, executed as soon
+// as the job is done with what it is doing
+type RunRequest struct {
+	Id              string
+	IgnoreThreshold bool
+}
+
+// requestRun asks the job to execute its command right away, interrupting
+// its sleep, and returns the ID the run will have. A request made while
+// another one is pending joins it.
+func (job *Job) requestRun(ignoreThreshold bool) (string, error) {
+	job.mu.Lock()
+	if job.Status == STATUS_TERMINATED {
+		job.mu.Unlock()
+		return "", fmt.Errorf("job %v is terminated", job.Name)
+	}
+	if job.pendingRun == nil {
+		job.pendingRun = &RunRequest{Id: job.newRunIdLocked()}
+	}
+	job.pendingRun.IgnoreThreshold = job.pendingRun.IgnoreThreshold || ignoreThreshold
+	runId := job.pendingRun.Id
+	job.mu.Unlock()
+
+	job.wakeUp()
+	return runId, nil
+}
+
+// takeRunRequest returns the pending run request, if any, and clears it
+func (job *Job) takeRunRequest() *RunRequest {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	request := job.pendingRun
+	job.pendingRun = nil
+	return request
+}
+
+func (job *Job) hasRunRequest() bool {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.pendingRun != nil
+}
+
+// startRun returns the ID of the run about to be executed
+func (job *Job) startRun(request *RunRequest) string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if request != nil {
+		job.lastRunId = request.Id
+	} else {
+		job.lastRunId = job.newRunIdLocked()
+	}
+	return job.lastRunId
+}
+
+// skipRun records in the history of the job that the requested run was not
+// executed, and why
+func (job *Job) skipRun(request *RunRequest, reason string) {
+	if request == nil {
+		return
+	}
+	now := time.Now()
+	stateStore.recordRun(job.Name, RunRecord{RunId: request.Id, StartedAt: now, EndedAt: now, Skipped: reason})
+}
+
+func (job *Job) getLastRunId() string {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.lastRunId
+}
+
+// newRunIdLocked returns a new run ID, unique across restarts of the
+// supervisor - caller must hold Lock
+func (job *Job) newRunIdLocked() string {
+	job.runCounter++
+	return fmt.Sprintf("%v-%v-%d", job.Name, time.Now().Format("20060102150405"), job.runCounter)
+}
+
+// parseRunNowOptions returns whether the options of a run-now command ask to
+// ignore the threshold, refusing the ones it doesn't know
+func parseRunNowOptions(options []string) (bool, error) {
+	ignoreThreshold := false
+	for _, option := range options {
+		if option != "--ignore-threshold" {
+			return false, fmt.Errorf("unknown option %v, only --ignore-threshold is supported", option)
+		}
+		ignoreThreshold = true
+	}
+	return ignoreThreshold, nil
+}
+
+// runNow requests a run of the named job
+func (jobKiller *JobKiller) runNow(jobName string, ignoreThreshold bool) (string, error) {
+	job, err := jobKiller.findJobByName(jobName)
+	if err != nil {
+		return "", err
+	}
+	return job.requestRun(ignoreThreshold)
+}
+
+// runNowGroup requests a run of every job of the group, returning the run
+// IDs by job name
+func (jobKiller *JobKiller) runNowGroup(groupName string, ignoreThreshold bool) (map[string]string, error) {
+	runIds := make(map[string]string)
+	for _, job := range jobKiller.getJobs() {
+		for _, group := range job.GetGroups() {
+			if group != groupName {
+				continue
+			}
+			if runId, err := job.requestRun(ignoreThreshold); err == nil {
+				runIds[job.Name] = runId
+			}
+			break
+		}
+	}
+	if len(runIds) == 0 {
+		return nil, errors.New("no running job in group " + groupName)
+	}
+	return runIds, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestLoop runs the loop of the job in test mode, where every poll
+// finds one message, until the test ends
+func startTestLoop(t *testing.T, job *Job) {
+	t.Helper()
+	previousTestMode := *testMode
+	*testMode = true
+	job.MainPid = os.Getpid()
+	job.ConnectionConfig = ConnectionConfig{Name: "run_now_test", Endpoint: "http://localhost:59993"}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go job.executeCommand(&wg)
+	t.Cleanup(func() {
+		job.SetStop(true)
+		job.OwnContextCancel()
+		wg.Wait()
+		*testMode = previousTestMode
+	})
+}
+
+func waitForFile(path string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestJob_RequestRun_JoinsPendingRequest(t *testing.T) {
+	job := createTestJob("job1", nil)
+
+	first, err := job.requestRun(false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, _ := job.requestRun(true)
+
+	if first != second || !strings.HasPrefix(first, "job1-") {
+		t.Errorf("Expected the second request to join the first, got %q and %q", first, second)
+	}
+	request := job.takeRunRequest()
+	if request == nil || !request.IgnoreThreshold {
+		t.Errorf("Expected a pending request ignoring the threshold, got %+v", request)
+	}
+	if job.takeRunRequest() != nil {
+		t.Error("Expected the request to be taken once")
+	}
+	if runId := job.startRun(request); runId != first || job.getLastRunId() != first {
+		t.Errorf("Expected the run to use the requested ID, got %q", runId)
+	}
+}
+
+func TestJob_RequestRun_Terminated(t *testing.T) {
+	job := createTestJob("job1", nil)
+	job.SetStatus(STATUS_TERMINATED)
+
+	if _, err := job.requestRun(false); err == nil {
+		t.Error("Expected error for a terminated job")
+	}
+}
+
+func TestJobKiller_RunNowGroup(t *testing.T) {
+	job1 := createTestJob("job1", []string{"group1"})
+	job2 := createTestJob("job2", []string{"group1", "group2"})
+	job3 := createTestJob("job3", []string{"group2"})
+	jk := &JobKiller{Jobs: []*Job{job1, job2, job3}}
+
+	runIds, err := jk.runNowGroup("group1", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(runIds) != 2 || runIds["job1"] == "" || runIds["job2"] == "" {
+		t.Errorf("Expected runs for job1 and job2, got %v", runIds)
+	}
+	if job3.hasRunRequest() {
+		t.Error("Expected no run for job3")
+	}
+	if _, err := jk.runNowGroup("missing", false); err == nil {
+		t.Error("Expected error for an unknown group")
+	}
+}
+
+func TestJob_RunNow_InterruptsSleep(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	job := createTestJob("run_now_job", nil)
+	job.Command = "touch " + marker
+	job.MinMessages = 5
+	job.SleepTime = 60
+	job.MaxSleep = 60
+	job.SetCurrentSleepTime(60)
+	useStateStore(t)
+	startTestLoop(t, job)
+
+	// One message is below MinMessages: a plain run-now only polls again
+	time.Sleep(200 * time.Millisecond)
+	skippedId, _ := job.requestRun(false)
+	if waitForFile(marker, 500*time.Millisecond) {
+		t.Fatal("Expected MinMessages to apply without --ignore-threshold")
+	}
+	history := stateStore.getHistory(job.Name)
+	if len(history) != 1 || history[0].RunId != skippedId || history[0].Skipped != "1 messages in queue, below min_messages 5" {
+		t.Fatalf("Expected the skipped run in the history, got %+v", history)
+	}
+
+	runId, _ := job.requestRun(true)
+	if !waitForFile(marker, 5*time.Second) {
+		t.Fatal("Expected the command to run right away")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for job.getLastRunId() != runId && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if job.getLastRunId() != runId {
+		t.Errorf("Expected last run %q, got %q", runId, job.getLastRunId())
+	}
+}
+
+func TestJob_RunNow_WhilePaused(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	job := createTestJob("paused_job", nil)
+	job.Command = "touch " + marker
+	job.SleepTime = 60
+	job.MaxSleep = 60
+	job.SetPause(true)
+	startTestLoop(t, job)
+
+	job.requestRun(false)
+	if !waitForFile(marker, 5*time.Second) {
+		t.Fatal("Expected run-now to go through the pause")
+	}
+	if !job.GetPause() {
+		t.Error("Expected the job to stay paused")
+	}
+}
+
+func TestParseRunNowOptions(t *testing.T) {
+	if ignoreThreshold, err := parseRunNowOptions(nil); err != nil || ignoreThreshold {
+		t.Errorf("Expected no option, got %v (%v)", ignoreThreshold, err)
+	}
+	if ignoreThreshold, err := parseRunNowOptions([]string{"--ignore-threshold"}); err != nil || !ignoreThreshold {
+		t.Errorf("Expected the threshold to be ignored, got %v (%v)", ignoreThreshold, err)
+	}
+	if _, err := parseRunNowOptions([]string{"--ignore-treshold"}); err == nil || !strings.Contains(err.Error(), "unknown option --ignore-treshold") {
+		t.Errorf("Expected an unknown option to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// spawnJob returns the copies of the job to run: the job itself, or when it
+// spawns more than one, the job renamed <name>_0 followed by its clones
+// <name>_1, <name>_2...
+func spawnJob(job *Job) []*Job {
+	if job.Spawn <= 1 {
+		return []*Job{job}
+	}
+	copies := []*Job{job}
+	for spawn := 1; spawn < job.Spawn; spawn++ {
+		copies = append(copies, job.clone(spawn))
+	}
+	job.Name = job.Name + "_0"
+	job.Spawn = 1
+	return copies
+}
+
+// addJob registers the job defined in JSON, as in the jobs of the config
+// file, and starts it (each of its copies when it spawns more than one)
+func (jobKiller *JobKiller) addJob(definition string) ([]*Job, error) {
+	if mainContext.Err() != nil {
+		return nil, errors.New("the supervisor is shutting down")
+	}
+	root, err := decodeOrderedJSON([]byte(definition))
+	if err != nil {
+		return nil, fmt.Errorf("invalid job definition: %w", err)
+	}
+	entry, ok := root.(*jsonObject)
+	if !ok {
+		return nil, errors.New("invalid job definition: not a JSON object")
+	}
+	if problems := checkJSONShape(root, reflect.TypeOf(Job{}), ""); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid job definition:\n%w", ConfigErrors(problems))
+	}
+	// The job inherits from the defaults and templates of the configuration
+	var inheritance *jobInheritance
+	configFile := ""
+	if configSource != nil {
+		inheritance, configFile = configSource.inheritance, configSource.Path
+	}
+	problems := interpolateConfig(entry, "")
+	problems = append(problems, decryptConfig(entry, "", &secretKeyLoader{path: keyFilePath(configFile)})...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid job definition:\n%w", ConfigErrors(problems))
+	}
+	entry, inherited, err := inheritance.expand(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job definition: extends: %w", err)
+	}
+	expanded, err := encodeJSONConfig(entry, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job definition: %w", err)
+	}
+	job := &Job{}
+	if err := json.Unmarshal(expanded, job); err != nil {
+		return nil, fmt.Errorf("invalid job definition: %w", err)
+	}
+	job.origin = &jobOrigin{File: configFile, Index: -1, Extends: job.Extends, inherited: inherited}
+	// The same checks as the jobs of the config file, preflight included
+	// since the job starts right away
+	problems = validateJob(job, entry, "", jobKiller.getConnections())
+	for _, check := range []struct {
+		field string
+		err   error
+	}{
+		{"working_dir", validateWorkingDir(job.WorkingDir)},
+		{"user", validateUser(job.UserId)},
+		{"error_log_path", validateErrorLogPath(job.ErrorLogPath)},
+	} {
+		if check.err != nil {
+			problems = append(problems, ConfigProblem{check.field, check.err.Error()})
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid job definition:\n%w", ConfigErrors(problems))
+	}
+	connectionConfig, err := jobKiller.getConnectionByName(job.ConnectionName)
+	if err != nil {
+		return nil, fmt.Errorf("job %q: %w", job.Name, err)
+	}
+
+	jobKiller.mu.Lock()
+	// Relations name the jobs as in the configuration
+	configured := []*Job{job}
+	seen := make(map[string]bool)
+	for _, other := range jobKiller.Jobs {
+		if other.Name == job.Name || other.getBaseName() == job.Name {
+			jobKiller.mu.Unlock()
+			return nil, fmt.Errorf("a job called %v already exists", job.Name)
+		}
+		if !seen[other.getBaseName()] {
+			seen[other.getBaseName()] = true
+			configured = append(configured, &Job{Name: other.getBaseName(), ConflictsWith: other.ConflictsWith, After: other.After})
+		}
+	}
+	if err := validateRelations(configured); err != nil {
+		jobKiller.mu.Unlock()
+		return nil, err
+	}
+	job.baseName = job.Name
+	job.definition = []byte(definition)
+	job.resourceLimits = jobKiller.ResourceLimits.override(job.ResourceLimits)
+	copies := spawnJob(job)
+	for _, jobCopy := range copies {
+		jobCopy.ConnectionConfig = *connectionConfig
+		jobCopy.MainPid = os.Getpid()
+		jobCopy.definition = job.definition
+		jobKiller.Jobs = append(jobKiller.Jobs, jobCopy)
+	}
+	jobKiller.mu.Unlock()
+
+	for _, jobCopy := range copies {
+		jobRelations.add(jobCopy)
+		for _, watcher := range alarmWatchers {
+			watcher.addJob(jobCopy)
+		}
+		if err := jobCopy.start(&wg); err != nil {
+			log.Printf("Job %v added but not started: %v\n", jobCopy.Name, err)
+			continue
+		}
+		log.Printf("Job %v added\n", jobCopy.Name)
+	}
+	return copies, nil
+}
+
+// removeJob retires the named job, or every jobCopy of a spawned job when
+// given the name in the configuration. The running command is killed,
+// unless graceful, in which case the job is retired once it is done. A job
+// other jobs refer to in their relations can't be removed.
+func (jobKiller *JobKiller) removeJob(jobName string, graceful bool) ([]*Job, error) {
+	jobKiller.mu.Lock()
+	var removed, kept []*Job
+	for _, job := range jobKiller.Jobs {
+		if job.Name == jobName || job.getBaseName() == jobName {
+			removed = append(removed, job)
+		} else {
+			kept = append(kept, job)
+		}
+	}
+	if len(removed) == 0 {
+		jobKiller.mu.Unlock()
+		return nil, fmt.Errorf("Can't find job called %v", jobName)
+	}
+	remaining := make(map[string]bool)
+	for _, job := range kept {
+		remaining[job.getBaseName()] = true
+	}
+	for _, job := range kept {
+		for _, name := range append(append([]string{}, job.ConflictsWith...), job.After...) {
+			if name == removed[0].getBaseName() && !remaining[name] {
+				jobKiller.mu.Unlock()
+				return nil, fmt.Errorf("job %v refers to %v in its relations", job.Name, name)
+			}
+		}
+	}
+	jobKiller.Jobs = kept
+	jobKiller.mu.Unlock()
+
+	relations, watchers, store := jobRelations, alarmWatchers, stateStore
+	for _, job := range removed {
+		if graceful {
+			job.stop()
+		} else {
+			job.kill()
+		}
+		go func(job *Job) {
+			job.mu.RLock()
+			done := job.loopDone
+			job.mu.RUnlock()
+			if done != nil {
+				<-done
+			}
+			relations.remove(job)
+			for _, watcher := range watchers {
+				watcher.removeJob(job)
+			}
+			store.forget(job.Name)
+			log.Printf("Job %v removed\n", job.Name)
+		}(job)
+	}
+	return removed, nil
+}
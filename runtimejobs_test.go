@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRuntimeJobKiller sets up jobKiller with a connection, running the jobs
+// added in test mode until the test ends
+func useRuntimeJobKiller(t *testing.T) {
+	t.Helper()
+	previousTestMode := *testMode
+	*testMode = true
+	jobKiller = JobKiller{Connections: []ConnectionConfig{{Name: "main", Endpoint: "http://localhost:59995"}}}
+	jobRelations = createJobRelations(nil)
+	t.Cleanup(func() {
+		jobKiller.killAll()
+		wg.Wait()
+		*testMode = previousTestMode
+	})
+}
+
+func TestJobKiller_AddJob(t *testing.T) {
+	useRuntimeJobKiller(t)
+	output := filepath.Join(t.TempDir(), "ran")
+
+	jobs, err := jobKiller.addJob(`{"name": "onboarded", "command": "touch ` + output + `", "connection": "main", "queue": "new", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "spawn": 2}`)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].Name != "onboarded_0" || jobs[1].Name != "onboarded_1" {
+		t.Fatalf("Expected two copies of the job, got %v", jobs)
+	}
+	if len(jobKiller.getJobs()) != 2 {
+		t.Errorf("Expected the copies to be registered, got %d jobs", len(jobKiller.getJobs()))
+	}
+	if !waitForFile(output, 5*time.Second) {
+		t.Error("Expected the added job to run")
+	}
+	if jobs[1].GetConnectionConfig().Name != "main" || jobs[1].getBaseName() != "onboarded" {
+		t.Errorf("Expected the clone to be set up like the job, got %+v", jobs[1].GetConnectionConfig())
+	}
+}
+
+func TestJobKiller_AddJob_Invalid(t *testing.T) {
+	useRuntimeJobKiller(t)
+	if _, err := jobKiller.addJob(`{"name": "existing", "command": "true", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	definitions := map[string]string{
+		"not json":           `{"name": `,
+		"no name":            `{"command": "true", "connection": "main"}`,
+		"no command":         `{"name": "other", "connection": "main"}`,
+		"unknown connection": `{"name": "other", "command": "true", "connection": "missing"}`,
+		"duplicate":          `{"name": "existing", "command": "true", "connection": "main"}`,
+		"unknown relation":   `{"name": "other", "command": "true", "connection": "main", "after": ["missing"]}`,
+		"missing directory":  `{"name": "other", "command": "true", "connection": "main", "working_dir": "/no/such/dir"}`,
+		"unknown field":      `{"name": "other", "command": "true", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "sleep_tim": 5}`,
+	}
+	for description, definition := range definitions {
+		if _, err := jobKiller.addJob(definition); err == nil {
+			t.Errorf("Expected an error for %v", description)
+		}
+	}
+	if len(jobKiller.getJobs()) != 1 {
+		t.Errorf("Expected refused jobs not to be registered, got %d jobs", len(jobKiller.getJobs()))
+	}
+}
+
+func TestJobKiller_RemoveJob(t *testing.T) {
+	useRuntimeJobKiller(t)
+	jobs, _ := jobKiller.addJob(`{"name": "retired", "command": "sleep 30", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+	if !waitForPID(jobs[0], 5*time.Second) {
+		t.Fatal("Expected the command to be running")
+	}
+
+	removed, err := jobKiller.removeJob("retired", false)
+
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("Expected the job to be removed, got %v (%v)", removed, err)
+	}
+	if len(jobKiller.getJobs()) != 0 {
+		t.Error("Expected the job to be unregistered")
+	}
+	if !jobs[0].waitForLoop(5 * time.Second) {
+		t.Error("Expected the running command to be killed")
+	}
+	if _, err := jobKiller.removeJob("retired", false); err == nil {
+		t.Error("Expected an error removing an unknown job")
+	}
+}
+
+func TestJobKiller_RemoveJob_Graceful(t *testing.T) {
+	useRuntimeJobKiller(t)
+	output := filepath.Join(t.TempDir(), "done")
+	script := writeScript(t, "sleep 1\ntouch "+output)
+	jobs, _ := jobKiller.addJob(`{"name": "draining", "command": "sh ` + script + `", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+	if !waitForPID(jobs[0], 5*time.Second) {
+		t.Fatal("Expected the command to be running")
+	}
+
+	if _, err := jobKiller.removeJob("draining", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !jobs[0].waitForLoop(5 * time.Second) {
+		t.Fatal("Expected the loop to end")
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Error("Expected the running command to complete")
+	}
+}
+
+func TestJobKiller_RemoveJob_Referenced(t *testing.T) {
+	useRuntimeJobKiller(t)
+	jobKiller.addJob(`{"name": "import", "command": "true", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+	jobKiller.addJob(`{"name": "report", "command": "true", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0, "after": ["import"]}`)
+
+	_, err := jobKiller.removeJob("import", false)
+
+	if err == nil || !strings.Contains(err.Error(), "report") {
+		t.Errorf("Expected the removal to be refused, got %v", err)
+	}
+	if len(jobKiller.getJobs()) != 2 {
+		t.Error("Expected both jobs to stay")
+	}
+}
+
+func TestCreateResponse_AddJobKeepsSpaces(t *testing.T) {
+	useRuntimeJobKiller(t)
+
+	response := createResponse(`add-job {"name": "spaced", "command": "echo  a", "connection": "main", "queue": "q", "sleep_time": 60, "sleep_increment": 0, "max_sleep": 60, "min_messages": 0}`)
+
+	if !strings.Contains(response, "Job spaced added") {
+		t.Fatalf("Unexpected response: %s", response)
+	}
+	job, _ := jobKiller.findJobByName("spaced")
+	if job.GetCommand() != "echo  a" {
+		t.Errorf("Expected the definition to be kept as sent, got %q", job.GetCommand())
+	}
+}
+
+// writeScript writes a shell script in a temporary directory
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte(content+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJobKiller_AddJob_RefusedDuringShutdown(t *testing.T) {
+	previous, previousCancel := mainContext, cancelMainContext
+	mainContext, cancelMainContext = context.WithCancel(context.Background())
+	t.Cleanup(func() { mainContext, cancelMainContext = previous, previousCancel })
+	useRuntimeJobKiller(t)
+	shutdown()
+
+	if _, err := jobKiller.addJob(`{"name": "late", "command": "true", "connection": "main", "queue": "late"}`); err == nil || err.Error() != "the supervisor is shutting down" {
+		t.Errorf("Expected add-job to be refused, got %v", err)
+	}
+	if len(jobKiller.getJobs()) != 0 {
+		t.Errorf("Expected no job to be added, got %v", jobKiller.getJobs())
+	}
+}
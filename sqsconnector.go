@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+type SqsClient struct {
+	Name      string
+	Endpoint  string
+	Region    string
+	service   *sqs.Client
+	queueUrls map[string]string
+	mu        sync.Mutex // protects queueUrls
+}
+
+// createSqsClient builds an SQS client. When the connection has no static
+// keys, credentials are resolved by the AWS default chain (environment,
+// shared config, instance role). Endpoint overrides the AWS endpoint, so
+// that ElasticMQ or localstack can stand in for SQS.
+func createSqsClient(connectionConfig ConnectionConfig, tlsConfig *tls.Config) (*SqsClient, error) {
+	if connectionConfig.Region == "" {
+		return nil, fmt.Errorf("connection %q of type sqs needs a region", connectionConfig.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	options := []func(*config.LoadOptions) error{
+		config.WithRegion(connectionConfig.Region),
+	}
+	if connectionConfig.AccessKeyId != "" || connectionConfig.SecretAccessKey != "" {
+		// The keys expire every minute for the SDK to ask again for the
+		// ones refreshed from Vault
+		cluster := connectionRegistry.register(connectionConfig)
+		options = append(options, config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			keys := cluster.getCredentials(connectionConfig.getCredentials())
+			return aws.Credentials{
+				AccessKeyID:     keys.AccessKeyId,
+				SecretAccessKey: keys.SecretAccessKey,
+				Source:          "gormq-supervisor",
+				CanExpire:       true,
+				Expires:         time.Now().Add(time.Minute),
+			}, nil
+		})))
+	}
+	if tlsConfig != nil {
+		options = append(options, config.WithHTTPClient(&http.Client{Transport: createHTTPTransport(tlsConfig)}))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	service := sqs.NewFromConfig(awsConfig, func(o *sqs.Options) {
+		if connectionConfig.Endpoint != "" {
+			o.BaseEndpoint = aws.String(connectionConfig.Endpoint)
+		}
+	})
+
+	client := SqsClient{
+		Name:      connectionConfig.Name,
+		Endpoint:  connectionConfig.Endpoint,
+		Region:    connectionConfig.Region,
+		service:   service,
+		queueUrls: make(map[string]string),
+	}
+
+	return &client, nil
+}
+
+// getQueueUrl accepts either a queue URL or a queue name, resolving (and
+// caching) the URL of the latter
+func (client *SqsClient) getQueueUrl(ctx context.Context, queue string) (string, error) {
+	if strings.HasPrefix(queue, "http://") || strings.HasPrefix(queue, "https://") {
+		return queue, nil
+	}
+
+	client.mu.Lock()
+	queueUrl, found := client.queueUrls[queue]
+	client.mu.Unlock()
+	if found {
+		return queueUrl, nil
+	}
+
+	output, err := client.service.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if err != nil {
+		return "", err
+	}
+	queueUrl = aws.ToString(output.QueueUrl)
+
+	client.mu.Lock()
+	client.queueUrls[queue] = queueUrl
+	client.mu.Unlock()
+	return queueUrl, nil
+}
+
+func (client *SqsClient) getQueueInfo(job *Job) (*QueueInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	queueUrl, err := client.getQueueUrl(ctx, job.GetQueue())
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := client.service.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queueUrl),
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	visible, err := parseSqsAttribute(output.Attributes, types.QueueAttributeNameApproximateNumberOfMessages)
+	if err != nil {
+		return nil, err
+	}
+	notVisible, err := parseSqsAttribute(output.Attributes, types.QueueAttributeNameApproximateNumberOfMessagesNotVisible)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueueInfo{
+		Messages:               visible + notVisible,
+		MessagesReady:          visible,
+		MessagesUnacknowledged: notVisible,
+	}, nil
+}
+
+func parseSqsAttribute(attributes map[string]string, name types.QueueAttributeName) (int, error) {
+	value, found := attributes[string(name)]
+	if !found {
+		return 0, fmt.Errorf("attribute %v missing from GetQueueAttributes response", name)
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("attribute %v has invalid value %q", name, value)
+	}
+	return parsed, nil
+}
+
+// Close is a no-op: the SQS client has no long-lived connection to release
+func (client *SqsClient) Close() {}
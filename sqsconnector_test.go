@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFakeSqsServer answers the SQS JSON protocol the way ElasticMQ does for
+// a single queue called "work"
+func newFakeSqsServer(t *testing.T, attributes map[string]string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var targets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Amz-Target")
+		targets = append(targets, target)
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDTEST/") {
+			t.Errorf("Expected request signed with the static access key, got %q", r.Header.Get("Authorization"))
+		}
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch target {
+		case "AmazonSQS.GetQueueUrl":
+			if body["QueueName"] != "work" {
+				w.Header().Set("x-amzn-query-error", "AWS.SimpleQueueService.NonExistentQueue;Sender")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"The specified queue does not exist."}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"QueueUrl": "http://" + r.Host + "/000000000000/work"})
+		case "AmazonSQS.GetQueueAttributes":
+			json.NewEncoder(w).Encode(map[string]interface{}{"Attributes": attributes})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &targets
+}
+
+func createTestSqsClient(t *testing.T, endpoint string) *SqsClient {
+	t.Helper()
+	client, err := createSqsClient(ConnectionConfig{
+		Name:            "hybrid",
+		Type:            "sqs",
+		Endpoint:        endpoint,
+		Region:          "elasticmq",
+		AccessKeyId:     "AKIDTEST",
+		SecretAccessKey: "secret",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return client
+}
+
+func TestCreateSqsClient_MissingRegion(t *testing.T) {
+	client, err := createSqsClient(ConnectionConfig{Name: "hybrid", Type: "sqs"}, nil)
+
+	if err == nil {
+		t.Error("Expected error for missing region")
+	}
+	if client != nil {
+		t.Error("Expected nil client for missing region")
+	}
+}
+
+func TestSqsClient_GetQueueInfo_ByName(t *testing.T) {
+	server, targets := newFakeSqsServer(t, map[string]string{
+		"ApproximateNumberOfMessages":           "12",
+		"ApproximateNumberOfMessagesNotVisible": "3",
+	})
+	client := createTestSqsClient(t, server.URL)
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "sqs_job", Queue: "work"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if queueInfo.MessagesReady != 12 {
+		t.Errorf("Expected 12 ready messages, got %d", queueInfo.MessagesReady)
+	}
+	if queueInfo.MessagesUnacknowledged != 3 {
+		t.Errorf("Expected 3 in flight messages, got %d", queueInfo.MessagesUnacknowledged)
+	}
+	if queueInfo.Messages != 15 {
+		t.Errorf("Expected 15 messages, got %d", queueInfo.Messages)
+	}
+
+	// The queue URL is cached after the first lookup
+	client.getQueueInfo(&Job{Name: "sqs_job", Queue: "work"})
+	lookups := 0
+	for _, target := range *targets {
+		if target == "AmazonSQS.GetQueueUrl" {
+			lookups++
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected 1 GetQueueUrl call, got %d", lookups)
+	}
+}
+
+func TestSqsClient_GetQueueInfo_ByUrl(t *testing.T) {
+	server, targets := newFakeSqsServer(t, map[string]string{
+		"ApproximateNumberOfMessages":           "0",
+		"ApproximateNumberOfMessagesNotVisible": "0",
+	})
+	client := createTestSqsClient(t, server.URL)
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "sqs_job", Queue: server.URL + "/000000000000/work"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if queueInfo.Messages != 0 {
+		t.Errorf("Expected 0 messages, got %d", queueInfo.Messages)
+	}
+	if len(*targets) != 1 || (*targets)[0] != "AmazonSQS.GetQueueAttributes" {
+		t.Errorf("Expected only a GetQueueAttributes call, got %v", *targets)
+	}
+}
+
+func TestSqsClient_GetQueueInfo_UnknownQueue(t *testing.T) {
+	server, _ := newFakeSqsServer(t, map[string]string{})
+	client := createTestSqsClient(t, server.URL)
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "sqs_job", Queue: "missing"})
+	if err == nil {
+		t.Error("Expected error for unknown queue")
+	}
+	if queueInfo != nil {
+		t.Error("Expected nil queueInfo for unknown queue")
+	}
+}
+
+func TestSqsClient_GetQueueInfo_MissingAttribute(t *testing.T) {
+	server, _ := newFakeSqsServer(t, map[string]string{
+		"ApproximateNumberOfMessages": "4",
+	})
+	client := createTestSqsClient(t, server.URL)
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "sqs_job", Queue: "work"})
+	if err == nil {
+		t.Error("Expected error for missing attribute")
+	}
+	if queueInfo != nil {
+		t.Error("Expected nil queueInfo for missing attribute")
+	}
+}
+
+func TestSqsClient_GetQueueInfo_ConnectionRefused(t *testing.T) {
+	client := createTestSqsClient(t, "http://localhost:59997")
+
+	queueInfo, err := client.getQueueInfo(&Job{Name: "sqs_job", Queue: "work"})
+	if err == nil {
+		t.Error("Expected error for connection refused")
+	}
+	if queueInfo != nil {
+		t.Error("Expected nil queueInfo for connection refused")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// STATE_HISTORY_SIZE is how many runs are kept in the history of each job
+const STATE_HISTORY_SIZE = 20
+
+// STATE_FLUSH_DELAY is how long the sleep times of the jobs, which change on
+// every poll, wait before being written to the state file
+const STATE_FLUSH_DELAY = 10 * time.Second
+
+// PauseInfo tells why and by whom a job was paused
+type PauseInfo struct {
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// RunRecord is an execution of the command of a job
+type RunRecord struct {
+	RunId     string    `json:"run_id"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	ExitCode  int       `json:"exit_code"`
+	Success   bool      `json:"success"`
+	Skipped   string    `json:"skipped,omitempty"` // why a requested run was not executed
+}
+
+// JobState is what is kept of a job across restarts
+type JobState struct {
+	Pause            *PauseInfo        `json:"pause,omitempty"`
+	Overrides        map[string]string `json:"overrides,omitempty"`
+	CurrentSleepTime int               `json:"current_sleep_time,omitempty"`
+	History          []RunRecord       `json:"history,omitempty"`
+}
+
+// StateStore keeps the runtime state of the jobs in a file, rewritten
+// atomically on every change and loaded at startup. The sleep times are
+// written at most every STATE_FLUSH_DELAY. A nil store keeps nothing, so
+// that jobs run without one in tests.
+type StateStore struct {
+	Path         string
+	Jobs         map[string]*JobState
+	mu           sync.Mutex // protects Jobs, the file and flushPending
+	flushPending bool       // a sleep time changed since the file was written
+}
+
+var stateStore *StateStore
+
+// loadStateStore reads the state file at path. A missing file is an empty
+// state; an unreadable one is moved aside, so that it can be inspected, and
+// an empty state is returned along with the error.
+func loadStateStore(path string) (*StateStore, error) {
+	store := StateStore{Path: path, Jobs: make(map[string]*JobState)}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &store, nil
+	}
+	if err != nil {
+		return &store, err
+	}
+	if err := json.Unmarshal(content, &store.Jobs); err != nil || store.Jobs == nil {
+		store.Jobs = make(map[string]*JobState)
+		os.Rename(path, path+".corrupt")
+		return &store, fmt.Errorf("state file %v is corrupt, moved to %v.corrupt: %v", path, path, err)
+	}
+	return &store, nil
+}
+
+// saveLocked writes the state file atomically - caller must hold Lock
+func (store *StateStore) saveLocked() error {
+	content, err := json.MarshalIndent(store.Jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	store.flushPending = false
+	return writeFileAtomically(store.Path, content, 0600)
+}
+
+// flush writes the sleep times changed since the state file was written
+func (store *StateStore) flush() {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.flushPending {
+		return
+	}
+	if err := store.saveLocked(); err != nil {
+		log.Printf("Can't save state file %v: %v\n", store.Path, err)
+	}
+}
+
+// jobStateLocked returns the state of the job, created empty if needed -
+// caller must hold Lock
+func (store *StateStore) jobStateLocked(jobName string) *JobState {
+	state, found := store.Jobs[jobName]
+	if !found {
+		state = &JobState{}
+		store.Jobs[jobName] = state
+	}
+	return state
+}
+
+// update changes the state of a job and saves the state file
+func (store *StateStore) update(jobName string, change func(state *JobState)) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	change(store.jobStateLocked(jobName))
+	if err := store.saveLocked(); err != nil {
+		log.Printf("Can't save state file %v: %v\n", store.Path, err)
+	}
+}
+
+func (store *StateStore) recordPause(jobName string, pause *PauseInfo) {
+	store.update(jobName, func(state *JobState) {
+		state.Pause = pause
+	})
+}
+
+func (store *StateStore) recordOverride(jobName string, property string, value string) {
+	store.update(jobName, func(state *JobState) {
+		if state.Overrides == nil {
+			state.Overrides = make(map[string]string)
+		}
+		state.Overrides[property] = value
+	})
+}
+
+// clearOverrides forgets the overrides of the job written to the config
+// file
+func (store *StateStore) clearOverrides(jobName string, isWritten func(property string) bool) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state, found := store.Jobs[jobName]
+	if !found {
+		return
+	}
+	cleared := false
+	for property := range state.Overrides {
+		if isWritten(property) {
+			delete(state.Overrides, property)
+			cleared = true
+		}
+	}
+	if len(state.Overrides) == 0 {
+		state.Overrides = nil
+	}
+	if cleared {
+		if err := store.saveLocked(); err != nil {
+			log.Printf("Can't save state file %v: %v\n", store.Path, err)
+		}
+	}
+}
+
+// recordSleepTime keeps the current sleep time of the job, written with
+// the next change or by the flush STATE_FLUSH_DELAY later
+func (store *StateStore) recordSleepTime(jobName string, sleepTime int) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.jobStateLocked(jobName).CurrentSleepTime = sleepTime
+	if !store.flushPending {
+		store.flushPending = true
+		time.AfterFunc(STATE_FLUSH_DELAY, store.flush)
+	}
+}
+
+func (store *StateStore) recordRun(jobName string, run RunRecord) {
+	store.update(jobName, func(state *JobState) {
+		state.History = append(state.History, run)
+		if len(state.History) > STATE_HISTORY_SIZE {
+			state.History = state.History[len(state.History)-STATE_HISTORY_SIZE:]
+		}
+	})
+}
+
+func (store *StateStore) getHistory(jobName string) []RunRecord {
+	if store == nil {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if state, found := store.Jobs[jobName]; found {
+		return append([]RunRecord{}, state.History...)
+	}
+	return nil
+}
+
+// forget drops the state of a job removed at runtime
+func (store *StateStore) forget(jobName string) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, found := store.Jobs[jobName]; found {
+		delete(store.Jobs, jobName)
+		if err := store.saveLocked(); err != nil {
+			log.Printf("Can't save state file %v: %v\n", store.Path, err)
+		}
+	}
+}
+
+// reset clears the state, leaving the jobs as they are in memory
+func (store *StateStore) reset() error {
+	if store == nil {
+		return errors.New("no state file in use")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.Jobs = make(map[string]*JobState)
+	return store.saveLocked()
+}
+
+// apply restores the saved state on the jobs, at startup. State of jobs no
+// longer in the configuration is dropped, as are overrides the job refuses.
+func (store *StateStore) apply(jobs []*Job) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	known := make(map[string]bool)
+	for _, job := range jobs {
+		known[job.Name] = true
+		state, found := store.Jobs[job.Name]
+		if !found {
+			continue
+		}
+		properties := make([]string, 0, len(state.Overrides))
+		for property := range state.Overrides {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		// The overrides are checked together, as one can be valid only
+		// along with another, such as sleep_time with a higher max_sleep
+		var changes []func(target *Job)
+		var applied []string
+		restart := false
+		for _, property := range properties {
+			apply, needsRestart, err := job.propertyChange([]string{property, state.Overrides[property]})
+			if err != nil {
+				log.Printf("For job: \"%v\" dropping saved %v=%v: %v\n", job.Name, property, state.Overrides[property], err)
+				delete(state.Overrides, property)
+				continue
+			}
+			changes = append(changes, apply)
+			applied = append(applied, property)
+			restart = restart || needsRestart
+		}
+		if len(changes) > 0 {
+			applyAll := func(target *Job) {
+				for _, apply := range changes {
+					apply(target)
+				}
+			}
+			if err := job.applyChange(applyAll, restart); err != nil {
+				log.Printf("For job: \"%v\" dropping saved %v: %v\n", job.Name, strings.Join(applied, ", "), err)
+				for _, property := range applied {
+					delete(state.Overrides, property)
+				}
+			}
+		}
+		if state.CurrentSleepTime > 0 {
+			job.SetCurrentSleepTime(state.CurrentSleepTime)
+		}
+		if state.Pause != nil {
+			job.setPauseInfo(state.Pause)
+			log.Printf("For job: \"%v\" restoring pause by %v: %v\n", job.Name, state.Pause.By, state.Pause.Reason)
+		}
+	}
+	for jobName := range store.Jobs {
+		if !known[jobName] {
+			delete(store.Jobs, jobName)
+		}
+	}
+	if err := store.saveLocked(); err != nil {
+		log.Printf("Can't save state file %v: %v\n", store.Path, err)
+	}
+}
+
+// returnStatus describes what the state file holds for each job
+func (store *StateStore) returnStatus() string {
+	if store == nil {
+		return "No state file in use\n"
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	jobNames := make([]string, 0, len(store.Jobs))
+	for jobName := range store.Jobs {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames)
+
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("State file: %v\n", store.Path))
+	writer := tabwriter.NewWriter(&b, 10, 0, 2, ' ', tabwriter.Debug)
+	fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", "Job", "Paused", "Overrides", "Runs")
+	for _, jobName := range jobNames {
+		state := store.Jobs[jobName]
+		paused := "-"
+		if state.Pause != nil {
+			paused = fmt.Sprintf("by %v: %v", state.Pause.By, state.Pause.Reason)
+		}
+		overrides := make([]string, 0, len(state.Overrides))
+		for property, value := range state.Overrides {
+			overrides = append(overrides, property+"="+value)
+		}
+		sort.Strings(overrides)
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", jobName, paused, strings.Join(overrides, " "), len(state.History))
+	}
+	writer.Flush()
+	return b.String()
+}
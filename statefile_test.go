@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useStateStore makes the jobs persist to a fresh state file until the test ends
+func useStateStore(t *testing.T) *StateStore {
+	t.Helper()
+	store, err := loadStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	previous := stateStore
+	stateStore = store
+	t.Cleanup(func() { stateStore = previous })
+	return store
+}
+
+func TestStateStore_SaveAndLoad(t *testing.T) {
+	store := useStateStore(t)
+
+	store.recordPause("job1", &PauseInfo{Reason: "maintenance", By: "alice"})
+	store.recordOverride("job1", "sleep_time", "30")
+	store.recordSleepTime("job1", 45)
+	store.recordRun("job1", RunRecord{RunId: "job1-1", ExitCode: 2})
+
+	loaded, err := loadStateStore(store.Path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	state := loaded.Jobs["job1"]
+	if state == nil || state.Pause == nil || state.Pause.Reason != "maintenance" || state.Pause.By != "alice" {
+		t.Fatalf("Expected the pause to be saved, got %+v", state)
+	}
+	if state.Overrides["sleep_time"] != "30" || state.CurrentSleepTime != 45 {
+		t.Errorf("Expected the override and sleep time to be saved, got %+v", state)
+	}
+	if len(state.History) != 1 || state.History[0].ExitCode != 2 {
+		t.Errorf("Expected the run to be saved, got %+v", state.History)
+	}
+	matches, _ := filepath.Glob(store.Path + ".tmp*")
+	if len(matches) != 0 {
+		t.Errorf("Expected no temporary file left behind, got %v", matches)
+	}
+}
+
+func TestStateStore_SleepTimeIsFlushedLater(t *testing.T) {
+	store := useStateStore(t)
+
+	store.recordSleepTime("job1", 45)
+
+	if _, err := os.Stat(store.Path); err == nil {
+		t.Error("Expected the sleep time not to be written right away")
+	}
+	store.flush()
+	loaded, _ := loadStateStore(store.Path)
+	if state := loaded.Jobs["job1"]; state == nil || state.CurrentSleepTime != 45 {
+		t.Errorf("Expected the sleep time to be written by the flush, got %+v", state)
+	}
+	os.Remove(store.Path)
+	store.flush()
+	if _, err := os.Stat(store.Path); err == nil {
+		t.Error("Expected nothing to be written without a change")
+	}
+}
+
+func TestLoadStateStore_Missing(t *testing.T) {
+	store, err := loadStateStore(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(store.Jobs) != 0 {
+		t.Errorf("Expected an empty state, got %v", store.Jobs)
+	}
+}
+
+func TestLoadStateStore_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{not json"), 0644)
+
+	store, err := loadStateStore(path)
+
+	if err == nil {
+		t.Error("Expected an error for a corrupt state file")
+	}
+	if store == nil || len(store.Jobs) != 0 {
+		t.Errorf("Expected an empty state, got %+v", store)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("Expected the corrupt file to be moved aside: %v", err)
+	}
+}
+
+func TestStateStore_HistoryIsCapped(t *testing.T) {
+	store := useStateStore(t)
+
+	for i := 0; i < STATE_HISTORY_SIZE+5; i++ {
+		store.recordRun("job1", RunRecord{ExitCode: i})
+	}
+
+	history := store.getHistory("job1")
+	if len(history) != STATE_HISTORY_SIZE {
+		t.Fatalf("Expected %d runs, got %d", STATE_HISTORY_SIZE, len(history))
+	}
+	if history[0].ExitCode != 5 {
+		t.Errorf("Expected the oldest runs to be dropped, got %+v", history[0])
+	}
+}
+
+func TestStateStore_Apply(t *testing.T) {
+	store := useStateStore(t)
+	store.recordPause("job1", &PauseInfo{Reason: "deploy", By: "bob", At: time.Now()})
+	store.recordOverride("job1", "min_messages", "12")
+	store.recordOverride("job1", "sleep_time", "-3")
+	store.recordSleepTime("job1", 25)
+	store.recordRun("gone", RunRecord{RunId: "gone-1"})
+
+	job := createTestJob("job1", nil)
+	store.apply([]*Job{job})
+
+	if !job.GetPause() || job.getPauseInfo() == nil || job.getPauseInfo().By != "bob" {
+		t.Errorf("Expected the job to be paused by bob, got %+v", job.getPauseInfo())
+	}
+	if job.GetMinMessages() != 12 {
+		t.Errorf("Expected min_messages 12, got %d", job.GetMinMessages())
+	}
+	if job.GetCurrentSleepTime() != 25 {
+		t.Errorf("Expected current sleep time 25, got %d", job.GetCurrentSleepTime())
+	}
+	if _, found := store.Jobs["job1"].Overrides["sleep_time"]; found {
+		t.Error("Expected the refused override to be dropped")
+	}
+	if _, found := store.Jobs["gone"]; found {
+		t.Error("Expected the state of unknown jobs to be dropped")
+	}
+}
+
+func TestStateStore_Apply_ChecksOverridesTogether(t *testing.T) {
+	store := useStateStore(t)
+	// Replayed alone, max_sleep 20 would be lower than the sleep_time 30 of the config
+	store.recordOverride("job1", "max_sleep", "20")
+	store.recordOverride("job1", "sleep_time", "10")
+	store.recordOverride("job2", "max_sleep", "20")
+	store.recordOverride("job2", "min_messages", "4")
+
+	job1 := createTestJob("job1", nil)
+	job2 := createTestJob("job2", nil)
+	for _, job := range []*Job{job1, job2} {
+		job.SleepTime = 30
+		job.MaxSleep = 60
+	}
+	store.apply([]*Job{job1, job2})
+
+	if job1.GetMaxSleep() != 20 || job1.GetSleepTime() != 10 {
+		t.Errorf("Expected max_sleep 20 and sleep_time 10, got %d and %d", job1.GetMaxSleep(), job1.GetSleepTime())
+	}
+	if len(store.Jobs["job1"].Overrides) != 2 {
+		t.Errorf("Expected the overrides to be kept, got %v", store.Jobs["job1"].Overrides)
+	}
+	if job2.GetMaxSleep() != 60 || job2.GetMinMessages() != 0 || len(store.Jobs["job2"].Overrides) != 0 {
+		t.Errorf("Expected the overrides invalid together to be dropped, got %v", store.Jobs["job2"].Overrides)
+	}
+}
+
+func TestStateStore_Reset(t *testing.T) {
+	store := useStateStore(t)
+	store.recordPause("job1", &PauseInfo{Reason: "deploy"})
+
+	if err := store.reset(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	loaded, _ := loadStateStore(store.Path)
+	if len(loaded.Jobs) != 0 {
+		t.Errorf("Expected an empty state after reset, got %v", loaded.Jobs)
+	}
+	var nilStore *StateStore
+	if nilStore.reset() == nil {
+		t.Error("Expected an error resetting without a state file")
+	}
+}
+
+func TestCreateResponse_PauseIsPersisted(t *testing.T) {
+	store := useStateStore(t)
+	job := createTestJob("job1", nil)
+	jobKiller = JobKiller{Jobs: []*Job{job}}
+
+	response := createResponse("pause job1 disk full --by carol")
+
+	if !strings.Contains(response, "Paused by carol") || !strings.Contains(response, "disk full") {
+		t.Errorf("Expected the pause reason in the status, got: %s", response)
+	}
+	if pause := store.Jobs["job1"].Pause; pause == nil || pause.Reason != "disk full" || pause.By != "carol" {
+		t.Errorf("Expected the pause to be saved, got %+v", pause)
+	}
+
+	createResponse("unpause job1")
+
+	if store.Jobs["job1"].Pause != nil {
+		t.Error("Expected the unpause to be saved")
+	}
+}
+
+func TestCreateResponse_StateReset(t *testing.T) {
+	store := useStateStore(t)
+	store.recordOverride("job1", "sleep_time", "30")
+
+	if response := createResponse("state"); !strings.Contains(response, "sleep_time=30") {
+		t.Errorf("Expected the override in the state, got: %s", response)
+	}
+	if response := createResponse("state reset"); !strings.Contains(response, "State cleared") {
+		t.Errorf("Unexpected response: %s", response)
+	}
+	if len(store.Jobs) != 0 {
+		t.Errorf("Expected an empty state, got %v", store.Jobs)
+	}
+}
+
+func TestWithPausedBy(t *testing.T) {
+	if got := withPausedBy("pause job1 --by dave"); got != "pause job1 --by dave" {
+		t.Errorf("Expected the command unchanged, got %q", got)
+	}
+	if got := withPausedBy("status"); got != "status" {
+		t.Errorf("Expected the command unchanged, got %q", got)
+	}
+	if got := withPausedBy("pause-all upgrade"); !strings.HasPrefix(got, "pause-all upgrade --by ") {
+		t.Errorf("Expected the current user to be added, got %q", got)
+	}
+}
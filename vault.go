@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection fields written vault:<path>#<key> are read from the key of the
+// secret at path in Vault (e.g. vault:secret/data/rabbit#password)
+const vaultPrefix = "vault:"
+
+// VAULT_RETRY_INTERVAL is how long a secret that couldn't be read again
+// waits before the next attempt, its previous value being kept meanwhile
+const VAULT_RETRY_INTERVAL = 30 * time.Second
+
+type VaultConfig struct {
+	Address         string          `json:"address"`
+	Namespace       string          `json:"namespace"`
+	CaFile          string          `json:"ca_file"`
+	RefreshInterval int             `json:"refresh_interval"`
+	Auth            VaultAuthConfig `json:"auth"`
+}
+
+// VaultAuthConfig is either a token file, read again whenever Vault refuses
+// the token (e.g. kept up to date by Vault Agent), or an AppRole login
+type VaultAuthConfig struct {
+	TokenFile    string `json:"token_file"`
+	RoleId       string `json:"role_id"`
+	SecretId     string `json:"secret_id"`
+	SecretIdFile string `json:"secret_id_file"`
+	Mount        string `json:"mount"`
+}
+
+// vaultSecret is a connection field read from Vault
+type vaultSecret struct {
+	connection string
+	field      string
+	path       string
+	key        string
+}
+
+// VaultClient reads the secrets of the connections from Vault, and reads
+// them again when their lease expires
+type VaultClient struct {
+	config      VaultConfig
+	configFile  string
+	httpClient  *http.Client
+	token       string
+	tokenExpiry time.Time // zero when the token doesn't expire or it isn't known
+	secrets     []vaultSecret
+	refreshAt   map[string]time.Time      // by path of secret
+	loaded      map[string]map[string]any // secrets read while loading the config, by path
+	mu          sync.Mutex                // protects token, tokenExpiry, secrets, refreshAt and loaded
+}
+
+// vaultError is an answer of Vault with an unexpected status code
+type vaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (err *vaultError) Error() string {
+	if len(err.Errors) == 0 {
+		return fmt.Sprintf("vault answered with status %v", err.StatusCode)
+	}
+	return fmt.Sprintf("vault answered with status %v: %v", err.StatusCode, strings.Join(err.Errors, ", "))
+}
+
+func isVaultReference(value any) bool {
+	text, ok := value.(string)
+	return ok && strings.HasPrefix(text, vaultPrefix)
+}
+
+// parseVaultReference splits vault:<path>#<key>
+func parseVaultReference(reference string) (string, string, error) {
+	path, key, found := strings.Cut(strings.TrimPrefix(reference, vaultPrefix), "#")
+	path = strings.Trim(path, "/")
+	if !found || path == "" || key == "" {
+		return "", "", fmt.Errorf("invalid Vault reference %q (expected vault:<path>#<key>)", reference)
+	}
+	return path, key, nil
+}
+
+// createVaultClient returns the client of the vault block of the config, nil
+// with the problems of the block when it is invalid
+func createVaultClient(block *jsonObject, configFile string) (*VaultClient, []ConfigProblem) {
+	content, err := encodeJSONConfig(block, nil)
+	if err != nil {
+		return nil, []ConfigProblem{{"vault", err.Error()}}
+	}
+	var config VaultConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, []ConfigProblem{{"vault", err.Error()}}
+	}
+
+	var problems []ConfigProblem
+	if config.Address == "" {
+		problems = append(problems, ConfigProblem{"vault.address", "address is required"})
+	}
+	if config.RefreshInterval < 0 {
+		problems = append(problems, ConfigProblem{"vault.refresh_interval", "refresh_interval can't be negative"})
+	}
+	auth := config.Auth
+	switch {
+	case auth.TokenFile != "" && auth.RoleId != "":
+		problems = append(problems, ConfigProblem{"vault.auth", "token_file and role_id can't both be set"})
+	case auth.TokenFile == "" && auth.RoleId == "":
+		problems = append(problems, ConfigProblem{"vault.auth", "token_file or role_id is required"})
+	case auth.RoleId != "" && (auth.SecretId == "") == (auth.SecretIdFile == ""):
+		problems = append(problems, ConfigProblem{"vault.auth", "an AppRole login needs either secret_id or secret_id_file"})
+	}
+	if auth.Mount == "" {
+		config.Auth.Mount = "approle"
+	}
+	transport := http.DefaultTransport
+	if config.CaFile != "" {
+		pool := x509.NewCertPool()
+		certificates, err := os.ReadFile(relativeToConfig(config.CaFile, configFile))
+		if err != nil {
+			problems = append(problems, ConfigProblem{"vault.ca_file", err.Error()})
+		} else if !pool.AppendCertsFromPEM(certificates) {
+			problems = append(problems, ConfigProblem{"vault.ca_file", "no certificate found"})
+		}
+		transport = createHTTPTransport(&tls.Config{RootCAs: pool})
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return &VaultClient{
+		config:     config,
+		configFile: configFile,
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		refreshAt:  make(map[string]time.Time),
+		loaded:     make(map[string]map[string]any),
+	}, nil
+}
+
+// relativeToConfig resolves a path relative to the directory of the config
+func relativeToConfig(path string, configFile string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFile), path)
+}
+
+// resolveVaultReferences sets the connection fields written as Vault
+// references to the value of their secret. A secret is read once while the
+// config is loaded, so that the username and password of dynamic
+// credentials go together.
+func resolveVaultReferences(connection *jsonObject, path string, client *VaultClient, hasVaultBlock bool) []ConfigProblem {
+	var problems []ConfigProblem
+	name, _ := connection.values["name"].(string)
+	for _, key := range connection.keys {
+		reference, ok := connection.values[key].(string)
+		if !ok || !isVaultReference(reference) {
+			continue
+		}
+		if client == nil {
+			if !hasVaultBlock {
+				problems = append(problems, ConfigProblem{joinPath(path, key), "Vault reference without a vault block in the configuration"})
+			}
+			continue
+		}
+		secretPath, secretKey, err := parseVaultReference(reference)
+		if err != nil {
+			problems = append(problems, ConfigProblem{joinPath(path, key), err.Error()})
+			continue
+		}
+		value, err := client.load(secretPath, secretKey)
+		if err != nil {
+			problems = append(problems, ConfigProblem{joinPath(path, key), fmt.Sprintf("can't read %v: %v", reference, err)})
+			continue
+		}
+		connection.set(key, value)
+		client.mu.Lock()
+		client.secrets = append(client.secrets, vaultSecret{connection: name, field: key, path: secretPath, key: secretKey})
+		client.mu.Unlock()
+	}
+	return problems
+}
+
+// load returns a key of a secret, reading the secret the first time
+func (client *VaultClient) load(path string, key string) (string, error) {
+	client.mu.Lock()
+	data, found := client.loaded[path]
+	client.mu.Unlock()
+	if !found {
+		var lease time.Duration
+		var err error
+		data, lease, err = client.read(path)
+		if err != nil {
+			return "", err
+		}
+		client.mu.Lock()
+		client.loaded[path] = data
+		client.schedule(path, lease, time.Now())
+		client.mu.Unlock()
+	}
+	return secretValue(data, path, key)
+}
+
+func secretValue(data map[string]any, path string, key string) (string, error) {
+	value, found := data[key]
+	if !found {
+		return "", fmt.Errorf("secret %v has no key %q", path, key)
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("key %q of secret %v is not a string", key, path)
+	}
+	return text, nil
+}
+
+// schedule sets when the secret at path is read again: at two thirds of its
+// lease, or after the refresh interval of the config for secrets without a
+// lease such as the ones of KV version 2. Must be called with mu held.
+func (client *VaultClient) schedule(path string, lease time.Duration, now time.Time) {
+	switch {
+	case lease > 0:
+		client.refreshAt[path] = now.Add(lease * 2 / 3)
+	case client.config.RefreshInterval > 0:
+		client.refreshAt[path] = now.Add(time.Duration(client.config.RefreshInterval) * time.Second)
+	default:
+		delete(client.refreshAt, path)
+	}
+}
+
+// read returns the data of the secret at path and its lease. The data of a
+// KV version 2 secret is the one of its current version. A refused token is
+// replaced once.
+func (client *VaultClient) read(path string) (map[string]any, time.Duration, error) {
+	var answer struct {
+		LeaseDuration int            `json:"lease_duration"`
+		Data          map[string]any `json:"data"`
+	}
+	err := client.request(http.MethodGet, path, nil, &answer)
+	var statusError *vaultError
+	if errors.As(err, &statusError) && statusError.StatusCode == http.StatusForbidden {
+		client.mu.Lock()
+		client.token = ""
+		client.mu.Unlock()
+		err = client.request(http.MethodGet, path, nil, &answer)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	data := answer.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, versioned := data["metadata"].(map[string]any); versioned {
+			data = inner
+		}
+	}
+	return data, time.Duration(answer.LeaseDuration) * time.Second, nil
+}
+
+// request calls the Vault API with a valid token, logging in first when
+// there is none
+func (client *VaultClient) request(method string, path string, body any, target any) error {
+	token, err := client.getToken()
+	if err != nil {
+		return fmt.Errorf("can't log in to Vault: %w", err)
+	}
+	return client.call(method, path, token, body, target)
+}
+
+func (client *VaultClient) call(method string, path string, token string, body any, target any) error {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, strings.TrimRight(client.config.Address, "/")+"/v1/"+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+	if client.config.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", client.config.Namespace)
+	}
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		statusError := &vaultError{StatusCode: response.StatusCode}
+		var answer struct {
+			Errors []string `json:"errors"`
+		}
+		if json.NewDecoder(response.Body).Decode(&answer) == nil {
+			statusError.Errors = answer.Errors
+		}
+		return statusError
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+// getToken returns the token of the client, reading the token file or
+// logging in with AppRole when there is none or it expired
+func (client *VaultClient) getToken() (string, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.token != "" && (client.tokenExpiry.IsZero() || time.Now().Before(client.tokenExpiry)) {
+		return client.token, nil
+	}
+	auth := client.config.Auth
+	if auth.TokenFile != "" {
+		content, err := os.ReadFile(relativeToConfig(auth.TokenFile, client.configFile))
+		if err != nil {
+			return "", err
+		}
+		client.token, client.tokenExpiry = strings.TrimSpace(string(content)), time.Time{}
+		return client.token, nil
+	}
+	secretId := auth.SecretId
+	if auth.SecretIdFile != "" {
+		content, err := os.ReadFile(relativeToConfig(auth.SecretIdFile, client.configFile))
+		if err != nil {
+			return "", err
+		}
+		secretId = strings.TrimSpace(string(content))
+	}
+	var answer struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	login := map[string]string{"role_id": auth.RoleId, "secret_id": secretId}
+	if err := client.call(http.MethodPost, "auth/"+auth.Mount+"/login", "", login, &answer); err != nil {
+		return "", err
+	}
+	if answer.Auth.ClientToken == "" {
+		return "", errors.New("no token in the answer of the AppRole login")
+	}
+	client.token, client.tokenExpiry = answer.Auth.ClientToken, time.Time{}
+	if answer.Auth.LeaseDuration > 0 {
+		// Logged in again a little before the token expires
+		client.tokenExpiry = time.Now().Add(time.Duration(answer.Auth.LeaseDuration) * time.Second * 9 / 10)
+	}
+	return client.token, nil
+}
+
+// nextRefresh returns when the next secret has to be read again, false when
+// no secret expires
+func (client *VaultClient) nextRefresh() (time.Time, bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	var next time.Time
+	for _, refreshAt := range client.refreshAt {
+		if next.IsZero() || refreshAt.Before(next) {
+			next = refreshAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// run reads the secrets again as they expire, until ctx is done
+func (client *VaultClient) run(ctx context.Context) {
+	for {
+		next, found := client.nextRefresh()
+		if !found {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		client.refresh(time.Now())
+	}
+}
+
+// refresh reads again the secrets due at now and gives their new values to
+// the connections. A secret that can't be read keeps its value and is tried
+// again later.
+func (client *VaultClient) refresh(now time.Time) {
+	client.mu.Lock()
+	var paths []string
+	for path, refreshAt := range client.refreshAt {
+		if !refreshAt.After(now) {
+			paths = append(paths, path)
+		}
+	}
+	secrets := append([]vaultSecret{}, client.secrets...)
+	client.mu.Unlock()
+	sort.Strings(paths)
+
+	updates := make(map[string]map[string]string)
+	for _, path := range paths {
+		data, lease, err := client.read(path)
+		client.mu.Lock()
+		if err != nil {
+			client.refreshAt[path] = now.Add(VAULT_RETRY_INTERVAL)
+		} else {
+			client.schedule(path, lease, now)
+		}
+		client.mu.Unlock()
+		if err != nil {
+			log.Printf("Can't read Vault secret %v again, keeping its previous value: %v\n", path, err)
+			continue
+		}
+		for _, secret := range secrets {
+			if secret.path != path {
+				continue
+			}
+			value, err := secretValue(data, path, secret.key)
+			if err != nil {
+				log.Printf("Connection %q: can't refresh %v from Vault: %v\n", secret.connection, secret.field, err)
+				continue
+			}
+			if updates[secret.connection] == nil {
+				updates[secret.connection] = make(map[string]string)
+			}
+			updates[secret.connection][secret.field] = value
+		}
+	}
+	for connection, values := range updates {
+		updateConnectionSecrets(connection, values)
+	}
+}
+
+// updateConnectionSecrets sets fields of a running connection, by JSON name,
+// for the jobs using it and the clients already connected
+func updateConnectionSecrets(name string, values map[string]string) {
+	jobKiller.mu.Lock()
+	var updated *ConnectionConfig
+	var changed []string
+	for i := range jobKiller.Connections {
+		if jobKiller.Connections[i].Name != name {
+			continue
+		}
+		for field, value := range values {
+			if setStringField(&jobKiller.Connections[i], field, value) {
+				changed = append(changed, field)
+			}
+		}
+		connectionConfig := jobKiller.Connections[i]
+		updated = &connectionConfig
+	}
+	jobKiller.mu.Unlock()
+	if updated == nil || len(changed) == 0 {
+		return
+	}
+
+	for _, job := range jobKiller.getJobs() {
+		if job.GetConnectionConfig().Name == name {
+			job.SetConnection(*updated)
+		}
+	}
+	connectionRegistry.register(*updated).refreshCredentials(updated.getCredentials())
+	sort.Strings(changed)
+	log.Printf("Connection %q: %v refreshed from Vault\n", name, strings.Join(changed, ", "))
+}
+
+// setStringField sets the string field of target with the JSON name to
+// value, and tells whether it changed
+func setStringField(target any, name string, value string) bool {
+	element := reflect.ValueOf(target).Elem()
+	for i := 0; i < element.NumField(); i++ {
+		tag, _, _ := strings.Cut(element.Type().Field(i).Tag.Get("json"), ",")
+		field := element.Field(i)
+		if tag == name && field.Kind() == reflect.String && field.String() != value {
+			field.SetString(value)
+			return true
+		}
+	}
+	return false
+}
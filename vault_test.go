@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault answers the AppRole login and the reads of the secrets it
+// holds, as Vault does
+type fakeVault struct {
+	server  *httptest.Server
+	tokens  map[string]bool
+	secrets map[string]func() (map[string]any, int) // data and lease of the secrets, by path
+	reads   map[string]int
+	logins  int
+	mu      sync.Mutex
+}
+
+func startFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	vault := &fakeVault{tokens: make(map[string]bool), secrets: make(map[string]func() (map[string]any, int)), reads: make(map[string]int)}
+	vault.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		if path == "auth/approle/login" {
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["role_id"] != "supervisor" || login["secret_id"] != "s3cret-id" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors": ["invalid role or secret ID"]}`))
+				return
+			}
+			vault.logins++
+			token := fmt.Sprintf("approle-token-%d", vault.logins)
+			vault.tokens[token] = true
+			fmt.Fprintf(w, `{"auth": {"client_token": %q, "lease_duration": 3600}}`, token)
+			return
+		}
+		if !vault.tokens[r.Header.Get("X-Vault-Token")] {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		secret, found := vault.secrets[path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		vault.reads[path]++
+		data, lease := secret()
+		json.NewEncoder(w).Encode(map[string]any{"lease_duration": lease, "data": data})
+	}))
+	t.Cleanup(vault.server.Close)
+	return vault
+}
+
+// kvSecret is a secret of the KV version 2 engine, without a lease
+func kvSecret(data map[string]any) func() (map[string]any, int) {
+	return func() (map[string]any, int) {
+		return map[string]any{"data": data, "metadata": map[string]any{"version": 3}}, 0
+	}
+}
+
+// vaultTestConfig returns a config whose connection reads its credentials
+// from Vault with AppRole
+func vaultTestConfig(vault *fakeVault, connection map[string]any) testConfig {
+	return testConfig{
+		connection: connection,
+		job:        map[string]any{"name": "import", "queue": "imports"},
+		root: map[string]any{"vault": map[string]any{
+			"address": vault.server.URL,
+			"auth":    map[string]any{"role_id": "supervisor", "secret_id_file": "secret_id"},
+		}},
+		files: map[string]string{"secret_id": "s3cret-id\n"},
+	}
+}
+
+func TestCreateConfig_VaultSecrets(t *testing.T) {
+	vault := startFakeVault(t)
+	vault.secrets["secret/data/rabbit"] = kvSecret(map[string]any{"username": "worker", "password": "from-vault"})
+
+	configuration, err := createConfig(writeTestConfig(t, vaultTestConfig(vault, map[string]any{"username": "vault:secret/data/rabbit#username", "password": "vault:secret/data/rabbit#password"})))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	connectionConfig := configuration.ConnectionConfigs[0]
+	if connectionConfig.Username != "worker" || connectionConfig.Password != "from-vault" {
+		t.Errorf("Expected the credentials of Vault, got %q and %q", connectionConfig.Username, connectionConfig.Password)
+	}
+	if vault.reads["secret/data/rabbit"] != 1 || vault.logins != 1 {
+		t.Errorf("Expected one login and one read of the secret, got %v and %v", vault.logins, vault.reads)
+	}
+	if _, found := configuration.vault.nextRefresh(); found {
+		t.Error("Expected a secret without lease nor refresh interval not to be read again")
+	}
+}
+
+func TestCreateConfig_VaultTokenFile(t *testing.T) {
+	vault := startFakeVault(t)
+	vault.tokens["agent-token"] = true
+	vault.secrets["kv/rabbit"] = func() (map[string]any, int) {
+		return map[string]any{"password": "from-kv1"}, 600
+	}
+	config := vaultTestConfig(vault, map[string]any{"username": "worker", "password": "vault:kv/rabbit#password"})
+	config.root["vault"].(map[string]any)["auth"] = map[string]any{"token_file": "token"}
+	config.files["token"] = "agent-token\n"
+
+	configuration, err := createConfig(writeTestConfig(t, config))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if configuration.ConnectionConfigs[0].Password != "from-kv1" {
+		t.Errorf("Expected the password of Vault, got %q", configuration.ConnectionConfigs[0].Password)
+	}
+	next, found := configuration.vault.nextRefresh()
+	if !found || time.Until(next) > 400*time.Second || time.Until(next) < 390*time.Second {
+		t.Errorf("Expected the secret to be read again at two thirds of its lease, got %v", next)
+	}
+}
+
+func TestCreateConfig_VaultProblems(t *testing.T) {
+	vault := startFakeVault(t)
+	vault.secrets["secret/data/rabbit"] = kvSecret(map[string]any{"password": "from-vault"})
+	tests := map[string]struct {
+		password string
+		change   func(vaultBlock map[string]any, root map[string]any)
+		expected string
+	}{
+		"missing key": {
+			"vault:secret/data/rabbit#pasword", nil,
+			`connections[0].password: can't read vault:secret/data/rabbit#pasword: secret secret/data/rabbit has no key "pasword"`,
+		},
+		"missing secret": {
+			"vault:secret/data/other#password", nil,
+			"connections[0].password: can't read vault:secret/data/other#password: vault answered with status 404",
+		},
+		"invalid reference": {
+			"vault:secret/data/rabbit", nil,
+			"connections[0].password: invalid Vault reference",
+		},
+		"refused login": {
+			"vault:secret/data/rabbit#password",
+			func(vaultBlock map[string]any, root map[string]any) {
+				vaultBlock["auth"].(map[string]any)["role_id"] = "other"
+			},
+			"connections[0].password: can't read vault:secret/data/rabbit#password: can't log in to Vault: vault answered with status 400: invalid role or secret ID",
+		},
+		"no auth": {
+			"vault:secret/data/rabbit#password",
+			func(vaultBlock map[string]any, root map[string]any) { vaultBlock["auth"] = map[string]any{} },
+			"vault.auth: token_file or role_id is required",
+		},
+		"no vault block": {
+			"vault:secret/data/rabbit#password",
+			func(vaultBlock map[string]any, root map[string]any) { root["vault"], root["_vault"] = nil, vaultBlock },
+			"connections[0].password: Vault reference without a vault block",
+		},
+	}
+	for description, test := range tests {
+		config := vaultTestConfig(vault, map[string]any{"password": test.password})
+		if test.change != nil {
+			test.change(config.root["vault"].(map[string]any), config.root)
+		}
+
+		_, err := createConfig(writeTestConfig(t, config))
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected %q, got %v", description, test.expected, err)
+		}
+	}
+}
+
+func TestVaultClient_RefreshesExpiredCredentials(t *testing.T) {
+	vault := startFakeVault(t)
+	generation := 0
+	// Dynamic credentials: every read creates a new user
+	vault.secrets["rabbitmq/creds/worker"] = func() (map[string]any, int) {
+		generation++
+		return map[string]any{"username": fmt.Sprintf("worker-%d", generation), "password": fmt.Sprintf("password-%d", generation)}, 60
+	}
+	var authorizations []string
+	var authorizationsMu sync.Mutex
+	rabbit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		authorizationsMu.Lock()
+		authorizations = append(authorizations, username+":"+password)
+		authorizationsMu.Unlock()
+		w.Write([]byte(`{"messages": 1}`))
+	}))
+	defer rabbit.Close()
+	configuration, _ := loadTestConfig(t, vaultTestConfig(vault, map[string]any{"endpoint": rabbit.URL, "username": "vault:rabbitmq/creds/worker#username", "password": "vault:rabbitmq/creds/worker#password"}))
+	useRuntimeJobKiller(t)
+	previousRegistry := connectionRegistry
+	connectionRegistry = createConnectionRegistry()
+	t.Cleanup(func() { connectionRegistry = previousRegistry })
+	jobKiller.Connections = configuration.ConnectionConfigs
+	job := configuration.Jobs[0]
+	job.ConnectionConfig = configuration.ConnectionConfigs[0]
+	jobKiller.Jobs = []*Job{job}
+	connector, _ := createConnector(job.GetConnectionConfig())
+	client := connector.(*Client)
+	client.getQueueInfo(job)
+
+	configuration.vault.refresh(time.Now().Add(time.Minute))
+	client.getQueueInfo(job)
+
+	if vault.reads["rabbitmq/creds/worker"] != 2 {
+		t.Errorf("Expected the expired credentials to be read again once, got %v reads", vault.reads["rabbitmq/creds/worker"])
+	}
+	if len(authorizations) != 2 || authorizations[0] != "worker-1:password-1" || authorizations[1] != "worker-2:password-2" {
+		t.Errorf("Expected the running client to use the new credentials, got %v", authorizations)
+	}
+	if connectionConfig := job.GetConnectionConfig(); connectionConfig.Username != "worker-2" || connectionConfig.Password != "password-2" {
+		t.Errorf("Expected the job to get the new credentials, got %+v", connectionConfig)
+	}
+	if connectionConfig, _ := jobKiller.getConnectionByName("main"); connectionConfig.Password != "password-2" {
+		t.Errorf("Expected the connection to get the new credentials, got %+v", connectionConfig)
+	}
+}
+
+func TestVaultClient_KeepsSecretsVaultRefuses(t *testing.T) {
+	vault := startFakeVault(t)
+	vault.secrets["secret/data/rabbit"] = kvSecret(map[string]any{"password": "from-vault"})
+	config := vaultTestConfig(vault, map[string]any{"password": "vault:secret/data/rabbit#password"})
+	config.root["vault"].(map[string]any)["refresh_interval"] = 300
+	configuration, _ := loadTestConfig(t, config)
+	useRuntimeJobKiller(t)
+	jobKiller.Connections = configuration.ConnectionConfigs
+	now := time.Now().Add(301 * time.Second)
+	vault.mu.Lock()
+	vault.tokens = make(map[string]bool)
+	vault.mu.Unlock()
+
+	configuration.vault.refresh(now)
+
+	if vault.logins != 2 {
+		t.Errorf("Expected the refused token to be replaced with a new login, got %v logins", vault.logins)
+	}
+	if connectionConfig, _ := jobKiller.getConnectionByName("main"); connectionConfig.Password != "from-vault" {
+		t.Errorf("Expected the password to be kept, got %q", connectionConfig.Password)
+	}
+
+	vault.mu.Lock()
+	delete(vault.secrets, "secret/data/rabbit")
+	vault.mu.Unlock()
+	later := now.Add(301 * time.Second)
+	configuration.vault.refresh(later)
+
+	next, found := configuration.vault.nextRefresh()
+	if !found || !next.Equal(later.Add(VAULT_RETRY_INTERVAL)) {
+		t.Errorf("Expected the secret Vault can't give to be tried again later, got %v", next)
+	}
+	if connectionConfig, _ := jobKiller.getConnectionByName("main"); connectionConfig.Password != "from-vault" {
+		t.Errorf("Expected the password to be kept, got %q", connectionConfig.Password)
+	}
+}